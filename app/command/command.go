@@ -8,29 +8,126 @@ import (
 )
 
 const (
-	Ping     = "ping"
-	Echo     = "echo"
-	Set      = "set"
-	Get      = "get"
-	Info     = "info"
-	Replconf = "replconf"
-	Psync    = "psync"
-	Wait     = "wait"
-	Config   = "config"
-	Keys     = "keys"
+	Ping          = "ping"
+	Echo          = "echo"
+	Set           = "set"
+	Get           = "get"
+	Info          = "info"
+	Replconf      = "replconf"
+	Psync         = "psync"
+	Wait          = "wait"
+	Config        = "config"
+	Keys          = "keys"
+	Replicaof     = "replicaof"
+	Slaveof       = "slaveof"
+	Save          = "save"
+	Bgsave        = "bgsave"
+	Lastsave      = "lastsave"
+	Shutdown      = "shutdown"
+	Bgrewriteaof  = "bgrewriteaof"
+	Debug         = "debug"
+	Dump          = "dump"
+	Restore       = "restore"
+	Del           = "del"
+	Migrate       = "migrate"
+	Select        = "select"
+	Cluster       = "cluster"
+	Asking        = "asking"
+	RestoreAsking = "restore-asking"
+	Subscribe     = "subscribe"
+	Unsubscribe   = "unsubscribe"
+	Publish       = "publish"
+	Message       = "message"
+	Sentinel      = "sentinel"
+	Client        = "client"
 )
 
 const (
-	Replication = "replication"
-	GetAck      = "getack"
-	Ack         = "ack"
-	Px          = "px"
-	Dir         = "dir"
-	DBfilename  = "dbfilename"
+	Replication              = "replication"
+	Persistence              = "persistence"
+	GetAck                   = "getack"
+	Ack                      = "ack"
+	ListeningPort            = "listening-port"
+	Capa                     = "capa"
+	EOF                      = "eof"
+	Px                       = "px"
+	Pxat                     = "pxat"
+	Dir                      = "dir"
+	DBfilename               = "dbfilename"
+	ClientOutputBufferLimit  = "client-output-buffer-limit"
+	Replica                  = "replica"
+	Slave                    = "slave"
+	ReplicaReadOnly          = "replica-read-only"
+	ReplicaServeStaleData    = "replica-serve-stale-data"
+	Yes                      = "yes"
+	MinReplicasToWrite       = "min-replicas-to-write"
+	MinReplicasMaxLag        = "min-replicas-max-lag"
+	ReplDisklessSync         = "repl-diskless-sync"
+	ReplDisklessSyncDelay    = "repl-diskless-sync-delay"
+	No                       = "no"
+	One                      = "one"
+	Nosave                   = "nosave"
+	Appendonly               = "appendonly"
+	Appendfilename           = "appendfilename"
+	Appendfsync              = "appendfsync"
+	AOFLoadTruncated         = "aof-load-truncated"
+	Appenddirname            = "appenddirname"
+	AOFUseRDBPreamble        = "aof-use-rdb-preamble"
+	AutoAOFRewritePercentage = "auto-aof-rewrite-percentage"
+	AutoAOFRewriteMinSize    = "auto-aof-rewrite-min-size"
+	Export                   = "export"
+	Replace                  = "replace"
+	Absttl                   = "absttl"
+	Idletime                 = "idletime"
+	Freq                     = "freq"
+	Copy                     = "copy"
+	Auth                     = "auth"
+	Auth2                    = "auth2"
+	Keyslot                  = "keyslot"
+	Meet                     = "meet"
+	Nodes                    = "nodes"
+	Slots                    = "slots"
+	Shards                   = "shards"
+	Addslots                 = "addslots"
+	Addslotsrange            = "addslotsrange"
+	Delslots                 = "delslots"
+	Setslot                  = "setslot"
+	Node                     = "node"
+	Myid                     = "myid"
+	Migrating                = "migrating"
+	Importing                = "importing"
+	Stable                   = "stable"
+	Getkeysinslot            = "getkeysinslot"
+	Countkeysinslot          = "countkeysinslot"
+	Replicate                = "replicate"
+	Failover                 = "failover"
+	Force                    = "force"
+	Takeover                 = "takeover"
+	Masters                  = "masters"
+	Master                   = "master"
+	Replicas                 = "replicas"
+	Slaves                   = "slaves"
+	Sentinels                = "sentinels"
+	GetMasterAddrByName      = "get-master-addr-by-name"
+	IsMasterDownByAddr       = "is-master-down-by-addr"
+	Monitor                  = "monitor"
+	Remove                   = "remove"
+	DownAfterMilliseconds    = "down-after-milliseconds"
+	FailoverTimeout          = "failover-timeout"
+	Quorum                   = "quorum"
+	Pause                    = "pause"
+	Unpause                  = "unpause"
+	Write                    = "write"
+	All                      = "all"
+	To                       = "to"
+	Timeout                  = "timeout"
+	Abort                    = "abort"
 )
 
 const (
 	SimpleString = '+'
+	Error        = '-'
+	Integer      = ':'
 	BulkString   = '$'
 	Arrays       = '*'
 )
@@ -38,6 +135,9 @@ const (
 type Command struct {
 	Args []string
 	Size int
+	// The command exactly as it was read, replicas forward it verbatim to
+	// their own replicas
+	Raw string
 }
 
 func NewCommand(reader *bufio.Reader) (*Command, error) {
@@ -47,9 +147,14 @@ func NewCommand(reader *bufio.Reader) (*Command, error) {
 	}
 
 	command := &Command{
-		Size: len([]byte(line)),
+		Raw: line,
 	}
 	line = strings.TrimSpace(line)
+	if line == "" {
+		command.Args = []string{}
+		command.Size = len(command.Raw)
+		return command, nil
+	}
 
 	switch line[0] {
 	default:
@@ -59,66 +164,67 @@ func NewCommand(reader *bufio.Reader) (*Command, error) {
 		command.Args = []string{line[1:]}
 
 	case BulkString:
-		formattedString, bytes, err := parseBulkString(reader)
+		formattedString, raw, err := parseBulkString(reader)
 		if err != nil {
 			return nil, err
 		}
 
 		command.Args = []string{formattedString}
-		command.Size += bytes
+		command.Raw += raw
 
 	case Arrays:
-		args, bytes, err := parseArray(reader, line)
+		args, raw, err := parseArray(reader, line)
 		if err != nil {
 			return nil, err
 		}
 
 		command.Args = args
-		command.Size += bytes
+		command.Raw += raw
 	}
 
+	command.Size = len(command.Raw)
 	return command, nil
 }
 
-func parseBulkString(reader *bufio.Reader) (string, int, error) {
+func parseBulkString(reader *bufio.Reader) (string, string, error) {
 	line, err := reader.ReadString('\n')
 	if err != nil {
-		return "", 0, err
+		return "", "", err
 	}
 
-	bytes := len([]byte(line))
+	raw := line
 	line = strings.TrimSpace(line)
 
 	size := 0
 	fmt.Sscanf(line, "$%d", &size)
 	data := make([]byte, size+2)
 
-	commandBytes, err := io.ReadFull(reader, data)
-	bytes += commandBytes
+	_, err = io.ReadFull(reader, data)
 	if err != nil {
-		return "", 0, err
+		return "", "", err
 	}
+	raw += string(data)
 
-	return string(data[:size]), bytes, nil
+	return string(data[:size]), raw, nil
 }
 
-func parseArray(reader *bufio.Reader, line string) ([]string, int, error) {
+func parseArray(reader *bufio.Reader, line string) ([]string, string, error) {
 	size := 0
 	_, err := fmt.Sscanf(line, "*%d", &size)
 	if err != nil {
-		return nil, 0, err
+		return nil, "", err
 	}
 
 	arrayArgs := make([]string, size)
-	totalBytes := 0
+	raw := ""
 	for i := 0; i < size; i++ {
-		arg, bytes, err := parseBulkString(reader)
+		arg, argRaw, err := parseBulkString(reader)
 		if err != nil {
-			return nil, 0, err
+			return nil, "", err
 		}
-		totalBytes += bytes
+		raw += argRaw
 		arrayArgs[i] = arg
 	}
 
-	return arrayArgs, totalBytes, nil
+	return arrayArgs, raw, nil
 }
@@ -1,12 +1,27 @@
 package command
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 const (
 	Null     = "$-1\r\n"
 	Ok       = "+OK\r\n"
 	Pong     = "+PONG\r\n"
 	Fullsync = "FULLRESYNC"
+	Continue = "CONTINUE"
+)
+
+const (
+	ReadOnlyError    = "READONLY You can't write against a read only replica."
+	NoReplicasError  = "NOREPLICAS Not enough good replicas to write."
+	MasterDownError  = "MASTERDOWN Link with MASTER is down and replica-serve-stale-data is set to 'no'."
+	CrossSlotError   = "CROSSSLOT Keys in request don't hash to the same slot"
+	UnboundError     = "CLUSTERDOWN Hash slot not served"
+	ClusterDownError = "CLUSTERDOWN The cluster is down"
+	TryAgainError    = "TRYAGAIN Multiple keys request during rehashing of slot"
+	NoClusterError   = "ERR This instance has cluster support disabled"
 )
 
 func NewInteger(number int) string {
@@ -17,6 +32,10 @@ func NewString(data string) string {
 	return fmt.Sprintf("+%s\r\n", data)
 }
 
+func NewError(message string) string {
+	return fmt.Sprintf("-%s\r\n", message)
+}
+
 func NewBulkString(data string) string {
 	return fmt.Sprintf("$%d\r\n%s\r\n", len(data), data)
 }
@@ -33,3 +52,9 @@ func NewArray(data []string) string {
 func NewRDBFile(fileContent []byte) string {
 	return fmt.Sprintf("$%d\r\n%s", len(fileContent), fileContent)
 }
+
+// NewNestedArray encodes an array of already encoded elements, for replies
+// mixing integers, bulk strings and arrays
+func NewNestedArray(elements []string) string {
+	return fmt.Sprintf("*%d\r\n%s", len(elements), strings.Join(elements, ""))
+}
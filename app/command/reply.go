@@ -0,0 +1,82 @@
+package command
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ReplyError is an error reply of a server, without the leading `-`
+type ReplyError string
+
+func (e ReplyError) Error() string { return string(e) }
+
+// ReadReply reads a simple string, integer or bulk string reply, a null
+// bulk string is read as an empty string. Error replies are returned as
+// a ReplyError
+func ReadReply(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return "", fmt.Errorf("empty reply")
+	}
+
+	switch line[0] {
+	case SimpleString, Integer:
+		return line[1:], nil
+	case Error:
+		return "", ReplyError(line[1:])
+	case BulkString:
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return "", fmt.Errorf("invalid bulk string length: %s", line)
+		}
+		if size < 0 {
+			return "", nil
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return "", err
+		}
+		return string(data[:size]), nil
+	}
+	return "", fmt.Errorf("unexpected reply: %s", line)
+}
+
+// ReadArrayReply reads an array reply whose elements are simple strings,
+// integers or bulk strings, a null array is read as an empty array
+func ReadArrayReply(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("empty reply")
+	}
+
+	switch line[0] {
+	case Error:
+		return nil, ReplyError(line[1:])
+	case Arrays:
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid array length: %s", line)
+		}
+		replies := make([]string, 0, max(size, 0))
+		for i := 0; i < size; i++ {
+			reply, err := ReadReply(reader)
+			if err != nil {
+				return nil, err
+			}
+			replies = append(replies, reply)
+		}
+		return replies, nil
+	}
+	return nil, fmt.Errorf("unexpected reply: %s", line)
+}
@@ -0,0 +1,39 @@
+package handler
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/codecrafters-io/redis-starter-go/app/command"
+	"github.com/codecrafters-io/redis-starter-go/app/server/config"
+	"github.com/codecrafters-io/redis-starter-go/app/storage"
+)
+
+// LoadAOF replays the append only file through the command handlers like
+// a client without connection, responses are discarded and nothing is propagated
+func LoadAOF(db *storage.Storage, cfg *config.Config) error {
+	h := &Handler{
+		db:        db,
+		cfg:       cfg,
+		writer:    bufio.NewWriter(io.Discard),
+		writeLock: &sync.Mutex{},
+	}
+
+	return db.LoadAOF(cfg.AOFDirPath(), cfg.AppendFileName(), cfg.AOFLoadTruncated(), func(userCommand *command.Command) error {
+		instruction := strings.ToLower(userCommand.Args[0])
+		handler, exist := commandHandlers[instruction]
+		if !exist {
+			return fmt.Errorf("unknown command: %s", strings.ToUpper(instruction))
+		}
+		return handler.handle(h, userCommand)
+	})
+}
+
+// StartAOF opens the AOF of the config, it is created from the dataset
+// when it doesn't exist
+func StartAOF(db *storage.Storage, cfg *config.Config) error {
+	return db.OpenAOF(cfg.AOFDirPath(), cfg.AppendFileName(), cfg.AppendFsync(), cfg.AOFRDBPreamble())
+}
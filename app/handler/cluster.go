@@ -0,0 +1,368 @@
+package handler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/codecrafters-io/redis-starter-go/app/command"
+	"github.com/codecrafters-io/redis-starter-go/app/server/cluster"
+)
+
+// Returns the error redirecting a command whose keys are not served by
+// this node, or an empty string when it can run here. All the keys of a
+// command must hash to the same slot.
+// While a slot migrates its keys are asked to the target once they were
+// moved, and the target serves them to asking clients only
+func (h *Handler) clusterRedirect(handler commandHandler, args []string, asking bool) string {
+	keys := handler.keys(args)
+	if len(keys) == 0 {
+		return ""
+	}
+
+	slot := cluster.KeySlot(keys[0])
+	for _, key := range keys[1:] {
+		if cluster.KeySlot(key) != slot {
+			return command.CrossSlotError
+		}
+	}
+
+	state := h.cfg.Cluster()
+	ownerID, addr := state.SlotOwner(slot)
+	if ownerID == "" {
+		return command.UnboundError
+	}
+	if !state.OK() {
+		return command.ClusterDownError
+	}
+
+	if ownerID == state.MyID() {
+		target := state.MigratingTo(slot)
+		if target == "" {
+			return ""
+		}
+		switch missing := h.missingKeys(keys); {
+		case missing == 0:
+			return ""
+		case missing < len(keys):
+			return command.TryAgainError
+		}
+		return fmt.Sprintf("ASK %d %s", slot, target)
+	}
+	if asking && state.Importing(slot) {
+		if len(keys) > 1 && h.missingKeys(keys) > 0 {
+			return command.TryAgainError
+		}
+		return ""
+	}
+	return fmt.Sprintf("MOVED %d %s", slot, addr)
+}
+
+func (h *Handler) missingKeys(keys []string) int {
+	missing := 0
+	for _, key := range keys {
+		if _, exists := h.db.GetEntry(key); !exists {
+			missing++
+		}
+	}
+	return missing
+}
+
+// ASKING
+func handleAsking(h *Handler, _ *command.Command) error {
+	if h.cfg.Cluster() == nil {
+		h.WriteResponse(command.NewError(command.NoClusterError))
+		return nil
+	}
+	h.asking = true
+	h.WriteResponse(command.Ok)
+	return nil
+}
+
+// CLUSTER <subcommand> [arguments]
+func handleCluster(h *Handler, userCommand *command.Command) error {
+	if len(userCommand.Args) < 2 {
+		return fmt.Errorf("%s command requires a subcommand", strings.ToUpper(command.Cluster))
+	}
+	state := h.cfg.Cluster()
+	if state == nil {
+		h.WriteResponse(command.NewError(command.NoClusterError))
+		return nil
+	}
+
+	subcommand := strings.ToLower(userCommand.Args[1])
+	args := userCommand.Args[2:]
+	switch subcommand {
+	case command.Keyslot:
+		if len(args) != 1 {
+			return fmt.Errorf("%s %s requires a key argument", strings.ToUpper(command.Cluster), strings.ToUpper(subcommand))
+		}
+		h.WriteResponse(command.NewInteger(cluster.KeySlot(args[0])))
+	case command.Myid:
+		h.WriteResponse(command.NewBulkString(state.MyID()))
+	case command.Info:
+		h.WriteResponse(command.NewBulkString(strings.Join(state.Info(), "\r\n") + "\r\n"))
+	case command.Nodes:
+		h.WriteResponse(command.NewBulkString(state.Nodes()))
+	case command.Slots:
+		h.WriteResponse(encodeClusterSlots(state.Slots()))
+	case command.Shards:
+		h.WriteResponse(encodeClusterShards(state.Shards()))
+	case command.Meet:
+		return clusterMeet(h, state, args)
+	case command.Addslots, command.Delslots, command.Addslotsrange:
+		return clusterSlots(h, state, subcommand, args)
+	case command.Setslot:
+		return clusterSetSlot(h, state, args)
+	case command.Getkeysinslot, command.Countkeysinslot:
+		return clusterKeysInSlot(h, subcommand, args)
+	case command.Replicate:
+		return clusterReplicate(h, state, args)
+	case command.Failover:
+		return clusterFailover(h, state, args)
+	default:
+		h.WriteResponse(command.NewError(fmt.Sprintf("ERR unknown subcommand '%s'", userCommand.Args[1])))
+	}
+	return nil
+}
+
+// CLUSTER MEET <ip> <port> [<cluster-bus-port>]
+func clusterMeet(h *Handler, state *cluster.State, args []string) error {
+	if len(args) != 2 && len(args) != 3 {
+		return fmt.Errorf("%s %s requires an ip and a port", strings.ToUpper(command.Cluster), strings.ToUpper(command.Meet))
+	}
+
+	port, err := strconv.Atoi(args[1])
+	if err != nil || port <= 0 || port > 65535 {
+		h.WriteResponse(command.NewError(fmt.Sprintf("ERR Invalid base port specified: %s", args[1])))
+		return nil
+	}
+	busPort := port + cluster.BusPortOffset
+	if len(args) == 3 {
+		busPort, err = strconv.Atoi(args[2])
+		if err != nil || busPort <= 0 || busPort > 65535 {
+			h.WriteResponse(command.NewError(fmt.Sprintf("ERR Invalid bus port specified: %s", args[2])))
+			return nil
+		}
+	}
+
+	if err := state.Meet(args[0], port, busPort); err != nil {
+		h.WriteResponse(command.NewError(fmt.Sprintf("ERR Invalid node address specified: %s:%s", args[0], args[1])))
+		return nil
+	}
+	h.WriteResponse(command.Ok)
+	return nil
+}
+
+// CLUSTER ADDSLOTS|DELSLOTS <slot> [<slot> ...]
+// CLUSTER ADDSLOTSRANGE <start> <end> [<start> <end> ...]
+func clusterSlots(h *Handler, state *cluster.State, subcommand string, args []string) error {
+	if len(args) == 0 || (subcommand == command.Addslotsrange && len(args)%2 != 0) {
+		return fmt.Errorf("wrong number of arguments for %s %s", strings.ToUpper(command.Cluster), strings.ToUpper(subcommand))
+	}
+
+	slots := make([]int, 0, len(args))
+	for _, arg := range args {
+		slot, err := cluster.ParseSlot(arg)
+		if err != nil {
+			h.WriteResponse(command.NewError("ERR " + err.Error()))
+			return nil
+		}
+		slots = append(slots, slot)
+	}
+	if subcommand == command.Addslotsrange {
+		ranges := slots
+		slots = []int{}
+		for i := 0; i < len(ranges); i += 2 {
+			if ranges[i] > ranges[i+1] {
+				h.WriteResponse(command.NewError(fmt.Sprintf("ERR start slot number %d is greater than end slot number %d", ranges[i], ranges[i+1])))
+				return nil
+			}
+			for slot := ranges[i]; slot <= ranges[i+1]; slot++ {
+				slots = append(slots, slot)
+			}
+		}
+	}
+
+	var err error
+	if subcommand == command.Delslots {
+		err = state.DelSlots(slots)
+	} else {
+		err = state.AddSlots(slots)
+	}
+	if err != nil {
+		h.WriteResponse(command.NewError("ERR " + err.Error()))
+		return nil
+	}
+	h.WriteResponse(command.Ok)
+	return nil
+}
+
+// CLUSTER SETSLOT <slot> <IMPORTING <node-id> | MIGRATING <node-id> | NODE <node-id> | STABLE>
+func clusterSetSlot(h *Handler, state *cluster.State, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("wrong number of arguments for %s %s", strings.ToUpper(command.Cluster), strings.ToUpper(command.Setslot))
+	}
+
+	slot, err := cluster.ParseSlot(args[0])
+	if err != nil {
+		h.WriteResponse(command.NewError("ERR " + err.Error()))
+		return nil
+	}
+	action := strings.ToLower(args[1])
+	if (action == command.Stable) != (len(args) == 2) || len(args) > 3 {
+		h.WriteResponse(command.NewError("ERR Invalid CLUSTER SETSLOT action or number of arguments. Try CLUSTER HELP"))
+		return nil
+	}
+
+	switch action {
+	case command.Migrating:
+		err = state.SetSlotMigrating(slot, args[2])
+	case command.Importing:
+		err = state.SetSlotImporting(slot, args[2])
+	case command.Stable:
+		state.SetSlotStable(slot)
+	case command.Node:
+		// The keys left in a slot would be lost once another node serves it
+		ownerID, _ := state.SlotOwner(slot)
+		if ownerID == state.MyID() && args[2] != ownerID && h.db.CountSlotKeys(slot) > 0 {
+			h.WriteResponse(command.NewError(fmt.Sprintf("ERR Can't assign hashslot %d to a different node while I still hold keys for this hash slot.", slot)))
+			return nil
+		}
+		err = state.SetSlotNode(slot, args[2])
+	default:
+		h.WriteResponse(command.NewError("ERR Invalid CLUSTER SETSLOT action or number of arguments. Try CLUSTER HELP"))
+		return nil
+	}
+	if err != nil {
+		h.WriteResponse(command.NewError("ERR " + err.Error()))
+		return nil
+	}
+	h.WriteResponse(command.Ok)
+	return nil
+}
+
+// CLUSTER GETKEYSINSLOT <slot> <count>
+// CLUSTER COUNTKEYSINSLOT <slot>
+func clusterKeysInSlot(h *Handler, subcommand string, args []string) error {
+	if subcommand == command.Getkeysinslot && len(args) != 2 || subcommand == command.Countkeysinslot && len(args) != 1 {
+		return fmt.Errorf("wrong number of arguments for %s %s", strings.ToUpper(command.Cluster), strings.ToUpper(subcommand))
+	}
+
+	slot, err := cluster.ParseSlot(args[0])
+	if err != nil {
+		h.WriteResponse(command.NewError("ERR " + err.Error()))
+		return nil
+	}
+	if subcommand == command.Countkeysinslot {
+		h.WriteResponse(command.NewInteger(h.db.CountSlotKeys(slot)))
+		return nil
+	}
+
+	count, err := strconv.Atoi(args[1])
+	if err != nil || count < 0 {
+		h.WriteResponse(command.NewError("ERR Invalid number of keys"))
+		return nil
+	}
+	h.WriteResponse(command.NewArray(h.db.SlotKeys(slot, count)))
+	return nil
+}
+
+// CLUSTER REPLICATE <node-id>
+func clusterReplicate(h *Handler, state *cluster.State, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("wrong number of arguments for %s %s", strings.ToUpper(command.Cluster), strings.ToUpper(command.Replicate))
+	}
+
+	// The dataset of a master would be replaced by the one of its new master
+	if err := state.Replicate(args[0], len(h.db.GetKeys()) == 0); err != nil {
+		h.WriteResponse(command.NewError("ERR " + err.Error()))
+		return nil
+	}
+	h.WriteResponse(command.Ok)
+	return nil
+}
+
+// CLUSTER FAILOVER [FORCE|TAKEOVER]
+func clusterFailover(h *Handler, state *cluster.State, args []string) error {
+	if len(args) > 1 {
+		h.WriteResponse(command.NewError("ERR syntax error"))
+		return nil
+	}
+
+	option := cluster.FailoverDefault
+	if len(args) == 1 {
+		switch strings.ToLower(args[0]) {
+		case command.Force:
+			option = cluster.FailoverForce
+		case command.Takeover:
+			option = cluster.FailoverTakeover
+		default:
+			h.WriteResponse(command.NewError("ERR syntax error"))
+			return nil
+		}
+	}
+
+	if err := state.Failover(option); err != nil {
+		h.WriteResponse(command.NewError("ERR " + err.Error()))
+		return nil
+	}
+	h.WriteResponse(command.Ok)
+	return nil
+}
+
+// Each range is an array of its first and last slot followed by an array
+// per node serving it, the master first
+func encodeClusterSlots(ranges []cluster.SlotRange) string {
+	elements := make([]string, 0, len(ranges))
+	for _, slotRange := range ranges {
+		rangeElements := []string{command.NewInteger(slotRange.Start), command.NewInteger(slotRange.End)}
+		for _, node := range slotRange.Nodes {
+			rangeElements = append(rangeElements, command.NewNestedArray([]string{
+				command.NewBulkString(node.Host),
+				command.NewInteger(node.Port),
+				command.NewBulkString(node.ID),
+				command.NewNestedArray(nil),
+			}))
+		}
+		elements = append(elements, command.NewNestedArray(rangeElements))
+	}
+	return command.NewNestedArray(elements)
+}
+
+// Each shard is a map with its slots, as pairs of bounds, and its nodes
+func encodeClusterShards(shards []cluster.Shard) string {
+	elements := make([]string, 0, len(shards))
+	for _, shard := range shards {
+		slots := make([]string, 0, 2*len(shard.Slots))
+		for _, slotRange := range shard.Slots {
+			slots = append(slots, command.NewInteger(slotRange[0]), command.NewInteger(slotRange[1]))
+		}
+
+		nodes := make([]string, 0, len(shard.Nodes))
+		for _, node := range shard.Nodes {
+			role, health := "replica", "online"
+			if node.Master {
+				role = "master"
+			}
+			if node.Failing {
+				health = "fail"
+			}
+			nodes = append(nodes, command.NewNestedArray([]string{
+				command.NewBulkString("id"), command.NewBulkString(node.ID),
+				command.NewBulkString("port"), command.NewInteger(node.Port),
+				command.NewBulkString("ip"), command.NewBulkString(node.Host),
+				command.NewBulkString("endpoint"), command.NewBulkString(node.Host),
+				command.NewBulkString("role"), command.NewBulkString(role),
+				command.NewBulkString("replication-offset"), command.NewInteger(node.ReplOffset),
+				command.NewBulkString("health"), command.NewBulkString(health),
+			}))
+		}
+
+		elements = append(elements, command.NewNestedArray([]string{
+			command.NewBulkString("slots"), command.NewNestedArray(slots),
+			command.NewBulkString("nodes"), command.NewNestedArray(nodes),
+		}))
+	}
+	return command.NewNestedArray(elements)
+}
@@ -1,14 +1,19 @@
 package handler
 
 import (
+	"errors"
 	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/codecrafters-io/redis-starter-go/app/command"
 	"github.com/codecrafters-io/redis-starter-go/app/server/config"
+	"github.com/codecrafters-io/redis-starter-go/app/storage"
 	"github.com/codecrafters-io/redis-starter-go/rdb"
 )
 
@@ -28,6 +33,42 @@ func handleEcho(h *Handler, userCommand *command.Command) error {
 	return nil
 }
 
+// SELECT index. There is a single database, only index 0 is accepted
+func handleSelect(h *Handler, userCommand *command.Command) error {
+	if len(userCommand.Args) != 2 {
+		return fmt.Errorf("%s command requires an index argument", strings.ToUpper(command.Select))
+	}
+
+	index, err := strconv.Atoi(userCommand.Args[1])
+	switch {
+	case err != nil:
+		h.WriteResponse(command.NewError("ERR value is not an integer or out of range"))
+	case index != 0:
+		h.WriteResponse(command.NewError("ERR DB index is out of range"))
+	default:
+		h.WriteResponse(command.Ok)
+	}
+	return nil
+}
+
+// AUTH [username] password. There is no password and only the default user,
+// which accepts any password like a Redis user with nopass
+func handleAuth(h *Handler, userCommand *command.Command) error {
+	switch len(userCommand.Args) {
+	case 2:
+		h.WriteResponse(command.NewError("ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?"))
+	case 3:
+		if userCommand.Args[1] != "default" {
+			h.WriteResponse(command.NewError("WRONGPASS invalid username-password pair or user is disabled."))
+			return nil
+		}
+		h.WriteResponse(command.Ok)
+	default:
+		return fmt.Errorf("%s command requires a password argument", strings.ToUpper(command.Auth))
+	}
+	return nil
+}
+
 func handleGet(h *Handler, userCommand *command.Command) error {
 	if len(userCommand.Args) < 2 {
 		return fmt.Errorf("%s command requires a key argument", strings.ToUpper(command.Get))
@@ -35,7 +76,9 @@ func handleGet(h *Handler, userCommand *command.Command) error {
 
 	key := userCommand.Args[1]
 	value, err := h.db.Get(key)
-	if err != nil {
+	if errors.Is(err, storage.ErrWrongType) {
+		h.WriteResponse(command.NewError(err.Error()))
+	} else if err != nil {
 		h.writer.WriteString(command.Null)
 	} else {
 		h.writer.WriteString(command.NewBulkString(value))
@@ -56,30 +99,34 @@ func handleSet(h *Handler, userCommand *command.Command) error {
 
 	if len(userCommand.Args) == 5 {
 		expInstruction := strings.ToLower(userCommand.Args[3])
-		if expInstruction != command.Px {
-			return fmt.Errorf("the command %s only allows the %s as a complimenting command",
-				strings.ToUpper(command.Set), strings.ToUpper(command.Px))
+		if expInstruction != command.Px && expInstruction != command.Pxat {
+			return fmt.Errorf("the command %s only allows the %s or %s as a complimenting command",
+				strings.ToUpper(command.Set), strings.ToUpper(command.Px), strings.ToUpper(command.Pxat))
 		}
 
-		time := userCommand.Args[4]
 		var err error
-		expTime, err = strconv.Atoi(time)
+		expTime, err = strconv.Atoi(userCommand.Args[4])
 		if err != nil {
-			return fmt.Errorf("the argument after %s should be an integer number", strings.ToUpper(command.Px))
+			return fmt.Errorf("the argument after %s should be an integer number", strings.ToUpper(expInstruction))
 		}
-	}
 
-	h.db.Set(key, value, expTime)
-	if h.cfg.Role() == config.RoleMaster {
-		wg := &sync.WaitGroup{}
-		command := command.NewArray(userCommand.Args)
-		for _, slave := range h.cfg.Slaves() {
-			wg.Add(1)
-			go slave.PropagateCommand(command, wg)
+		// PXAT is an absolute unix time in milliseconds. Like Redis, PX is
+		// propagated as PXAT so the key doesn't live longer when the AOF is
+		// replayed or a replica applies the command later
+		if expInstruction == command.Px && expTime > 0 {
+			expireAt := time.Now().UnixMilli() + int64(expTime)
+			userCommand.Args[3] = strings.ToUpper(command.Pxat)
+			userCommand.Args[4] = strconv.FormatInt(expireAt, 10)
+			expInstruction, expTime = command.Pxat, int(expireAt)
+		}
+		if expInstruction == command.Pxat {
+			h.db.SetExpireAt(key, value, int64(expTime))
+			h.WriteResponse(command.Ok)
+			return nil
 		}
-		wg.Wait()
-		h.UpdaterSlavesOffset(len([]byte(command)))
 	}
+
+	h.db.Set(key, value, expTime)
 	h.WriteResponse(command.Ok)
 
 	return nil
@@ -91,25 +138,83 @@ func handleInfo(h *Handler, userCommand *command.Command) error {
 	default:
 		return fmt.Errorf("%s is an invalid argument", infoOf)
 	case command.Replication:
+		info := []string{fmt.Sprintf("role:%s", h.cfg.Role())}
+		if h.cfg.Role() == config.RoleSlave {
+			host, port, _ := net.SplitHostPort(h.cfg.ReplicaOf())
+			linkStatus := "down"
+			if h.cfg.MasterLinkUp() {
+				linkStatus = "up"
+			}
+			info = append(info,
+				fmt.Sprintf("master_host:%s", host),
+				fmt.Sprintf("master_port:%s", port),
+				fmt.Sprintf("master_link_status:%s", linkStatus),
+				fmt.Sprintf("slave_read_only:%d", boolToInt(h.cfg.ReplicaReadOnly())),
+			)
+		}
+		info = append(info,
+			fmt.Sprintf("connected_slaves:%d", len(h.cfg.Slaves())),
+		)
+		if h.cfg.MinReplicasToWrite() > 0 {
+			info = append(info, fmt.Sprintf("min_slaves_good_slaves:%d", h.cfg.GoodReplicas()))
+		}
+		for i, slave := range h.cfg.Slaves() {
+			host, port, _ := net.SplitHostPort(slave.Addr())
+			info = append(info, fmt.Sprintf(
+				"slave%d:ip=%s,port=%s,state=online,offset=%d,lag=%d",
+				i, host, port, slave.AckOffset(), int(slave.Lag().Seconds()),
+			))
+		}
+		info = append(info,
+			fmt.Sprintf("master_failover_state:%s", h.cfg.Failover().State),
+			fmt.Sprintf("master_replid:%s", h.cfg.ReplID()),
+			fmt.Sprintf("master_replid2:%s", h.cfg.ReplID2()),
+			fmt.Sprintf("master_repl_offset:%d", h.cfg.ReplOffset()),
+			fmt.Sprintf("second_repl_offset:%d", h.cfg.SecondReplOffset()),
+		)
+		h.writer.WriteString(command.NewBulkString(strings.Join(info, "\n")))
+	case command.Persistence:
+		lastBgsaveStatus := "ok"
+		if !h.db.LastBgsaveOK() {
+			lastBgsaveStatus = "err"
+		}
+		aofLastWriteStatus := "ok"
+		if !h.db.AOFLastWriteOK() {
+			aofLastWriteStatus = "err"
+		}
+		aofLastRewriteStatus := "ok"
+		if !h.db.AOFLastRewriteOK() {
+			aofLastRewriteStatus = "err"
+		}
 		info := strings.Join(
 			[]string{
-				fmt.Sprintf("role:%s", h.cfg.Role()),
-				fmt.Sprintf("master_replid:%s", h.cfg.ReplID()),
-				fmt.Sprintf("master_repl_offset:%d", h.cfg.ReplOffset()),
+				fmt.Sprintf("rdb_changes_since_last_save:%d", h.db.Dirty()),
+				fmt.Sprintf("rdb_bgsave_in_progress:%d", boolToInt(h.db.BgsaveInProgress())),
+				fmt.Sprintf("rdb_last_save_time:%d", h.db.LastSave().Unix()),
+				fmt.Sprintf("rdb_last_bgsave_status:%s", lastBgsaveStatus),
+				fmt.Sprintf("aof_enabled:%d", boolToInt(h.db.AOFEnabled())),
+				fmt.Sprintf("aof_rewrite_in_progress:%d", boolToInt(h.db.AOFRewriteInProgress())),
+				fmt.Sprintf("aof_rewrite_scheduled:%d", boolToInt(h.db.AOFRewriteScheduled())),
+				fmt.Sprintf("aof_last_bgrewrite_status:%s", aofLastRewriteStatus),
+				fmt.Sprintf("aof_last_write_status:%s", aofLastWriteStatus),
 			},
 			"\n",
 		)
-		h.writer.WriteString(command.NewBulkString(info))
+		if h.db.AOFEnabled() {
+			currentSize, baseSize := h.db.AOFSize()
+			info += fmt.Sprintf("\naof_current_size:%d\naof_base_size:%d", currentSize, baseSize)
+		}
+		h.WriteResponse(command.NewBulkString(info))
 	}
 
 	return nil
 }
 
 func handleConfig(h *Handler, userCommand *command.Command) error {
-	config := strings.ToLower(userCommand.Args[1])
-	switch config {
+	action := strings.ToLower(userCommand.Args[1])
+	switch action {
 	default:
-		return fmt.Errorf("%s is an invalid argument", strings.ToUpper(config))
+		return fmt.Errorf("%s is an invalid argument", strings.ToUpper(action))
 	case command.Get:
 		for _, arg := range userCommand.Args[2:] {
 			configOf := strings.ToLower(arg)
@@ -121,11 +226,213 @@ func handleConfig(h *Handler, userCommand *command.Command) error {
 				fileName := h.cfg.RDBFileName()
 				h.WriteResponse(command.NewArray([]string{configOf, fileName}))
 			}
+			if configOf == command.ClientOutputBufferLimit {
+				limits := h.cfg.ReplicaOutputLimits()
+				value := fmt.Sprintf("%s %d %d %d", command.Replica, limits.Hard, limits.Soft, limits.SoftSeconds)
+				h.WriteResponse(command.NewArray([]string{configOf, value}))
+			}
+			if configOf == command.ReplicaReadOnly {
+				h.WriteResponse(command.NewArray([]string{configOf, yesNo(h.cfg.ReplicaReadOnly())}))
+			}
+			if configOf == command.ReplicaServeStaleData {
+				h.WriteResponse(command.NewArray([]string{configOf, yesNo(h.cfg.ServeStaleData())}))
+			}
+			if configOf == command.Save {
+				h.WriteResponse(command.NewArray([]string{configOf, config.FormatSaveRules(h.cfg.SaveRules())}))
+			}
+			if configOf == command.ReplDisklessSync {
+				h.WriteResponse(command.NewArray([]string{configOf, yesNo(h.cfg.DisklessSync())}))
+			}
+			if configOf == command.ReplDisklessSyncDelay {
+				h.WriteResponse(command.NewArray([]string{configOf, strconv.Itoa(h.cfg.DisklessSyncDelay())}))
+			}
+			if configOf == command.MinReplicasToWrite {
+				h.WriteResponse(command.NewArray([]string{configOf, strconv.Itoa(h.cfg.MinReplicasToWrite())}))
+			}
+			if configOf == command.MinReplicasMaxLag {
+				h.WriteResponse(command.NewArray([]string{configOf, strconv.Itoa(h.cfg.MinReplicasMaxLag())}))
+			}
+			if configOf == command.Appendonly {
+				h.WriteResponse(command.NewArray([]string{configOf, yesNo(h.cfg.AppendOnly())}))
+			}
+			if configOf == command.Appendfilename {
+				h.WriteResponse(command.NewArray([]string{configOf, h.cfg.AppendFileName()}))
+			}
+			if configOf == command.Appendfsync {
+				h.WriteResponse(command.NewArray([]string{configOf, h.cfg.AppendFsync()}))
+			}
+			if configOf == command.AOFLoadTruncated {
+				h.WriteResponse(command.NewArray([]string{configOf, yesNo(h.cfg.AOFLoadTruncated())}))
+			}
+			if configOf == command.Appenddirname {
+				h.WriteResponse(command.NewArray([]string{configOf, h.cfg.AppendDirName()}))
+			}
+			if configOf == command.AOFUseRDBPreamble {
+				h.WriteResponse(command.NewArray([]string{configOf, yesNo(h.cfg.AOFRDBPreamble())}))
+			}
+			if configOf == command.AutoAOFRewritePercentage {
+				h.WriteResponse(command.NewArray([]string{configOf, strconv.Itoa(h.cfg.AOFRewritePercentage())}))
+			}
+			if configOf == command.AutoAOFRewriteMinSize {
+				h.WriteResponse(command.NewArray([]string{configOf, strconv.Itoa(h.cfg.AOFRewriteMinSize())}))
+			}
+		}
+	case command.Set:
+		if len(userCommand.Args) != 4 {
+			return fmt.Errorf("the number of argument for %s %s is incorrect",
+				strings.ToUpper(command.Config), strings.ToUpper(command.Set))
 		}
+		if err := setConfig(h, strings.ToLower(userCommand.Args[2]), userCommand.Args[3]); err != nil {
+			return err
+		}
+		h.WriteResponse(command.Ok)
 	}
 	return nil
 }
 
+func setConfig(h *Handler, configOf, value string) error {
+	switch configOf {
+	default:
+		return fmt.Errorf("unsupported CONFIG parameter: %s", configOf)
+	case command.ClientOutputBufferLimit:
+		fields := strings.Fields(value)
+		if len(fields) != 4 || (strings.ToLower(fields[0]) != command.Replica && strings.ToLower(fields[0]) != command.Slave) {
+			return fmt.Errorf("only the %s class of %s is supported", command.Replica, configOf)
+		}
+		limits, err := config.ParseOutputBufferLimits(fields[1], fields[2], fields[3])
+		if err != nil {
+			return err
+		}
+		h.cfg.SetReplicaOutputLimits(limits)
+	case command.ReplicaReadOnly:
+		readOnly, err := parseYesNo(value)
+		if err != nil {
+			return err
+		}
+		h.cfg.SetReplicaReadOnly(readOnly)
+	case command.ReplicaServeStaleData:
+		serve, err := parseYesNo(value)
+		if err != nil {
+			return err
+		}
+		h.cfg.SetServeStaleData(serve)
+	case command.Save:
+		rules, err := config.ParseSaveRules(value)
+		if err != nil {
+			return err
+		}
+		h.cfg.SetSaveRules(rules)
+	case command.ReplDisklessSync:
+		diskless, err := parseYesNo(value)
+		if err != nil {
+			return err
+		}
+		h.cfg.SetDisklessSync(diskless)
+	case command.ReplDisklessSyncDelay:
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			return fmt.Errorf("invalid %s: %s", configOf, value)
+		}
+		h.cfg.SetDisklessSyncDelay(seconds)
+	case command.MinReplicasToWrite:
+		replicas, err := strconv.Atoi(value)
+		if err != nil || replicas < 0 {
+			return fmt.Errorf("invalid %s: %s", configOf, value)
+		}
+		h.cfg.SetMinReplicasToWrite(replicas)
+	case command.MinReplicasMaxLag:
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			return fmt.Errorf("invalid %s: %s", configOf, value)
+		}
+		h.cfg.SetMinReplicasMaxLag(seconds)
+	case command.Appendfsync:
+		fsync := strings.ToLower(value)
+		if fsync != storage.FsyncAlways && fsync != storage.FsyncEverysec && fsync != storage.FsyncNo {
+			return fmt.Errorf("invalid %s: %s", configOf, value)
+		}
+		h.cfg.SetAppendFsync(fsync)
+		h.db.SetAOFFsync(fsync)
+	case command.AOFLoadTruncated:
+		allow, err := parseYesNo(value)
+		if err != nil {
+			return err
+		}
+		h.cfg.SetAOFLoadTruncated(allow)
+	case command.Appendonly:
+		appendOnly, err := parseYesNo(value)
+		if err != nil {
+			return err
+		}
+		return setAppendOnly(h, appendOnly)
+	case command.AOFUseRDBPreamble:
+		preamble, err := parseYesNo(value)
+		if err != nil {
+			return err
+		}
+		h.cfg.SetAOFRDBPreamble(preamble)
+	case command.AutoAOFRewritePercentage:
+		percentage, err := strconv.Atoi(value)
+		if err != nil || percentage < 0 {
+			return fmt.Errorf("invalid %s: %s", configOf, value)
+		}
+		h.cfg.SetAOFRewritePercentage(percentage)
+	case command.AutoAOFRewriteMinSize:
+		size, err := config.ParseMemory(value)
+		if err != nil {
+			return err
+		}
+		h.cfg.SetAOFRewriteMinSize(size)
+	}
+	return nil
+}
+
+// Turning the AOF on rewrites it from the current dataset, the existing
+// files miss the writes made while it was disabled
+func setAppendOnly(h *Handler, appendOnly bool) error {
+	if appendOnly == h.cfg.AppendOnly() {
+		return nil
+	}
+	if appendOnly {
+		err := StartAOF(h.db, h.cfg)
+		if err == nil {
+			err = h.db.RewriteAOF(h.cfg.AOFRDBPreamble())
+		}
+		if err != nil && !errors.Is(err, storage.ErrAOFRewriteInProgress) {
+			h.db.CloseAOF()
+			return err
+		}
+	} else if err := h.db.CloseAOF(); err != nil {
+		log.Printf("failed to sync the append only file: %s\n", err.Error())
+	}
+	h.cfg.SetAppendOnly(appendOnly)
+	return nil
+}
+
+func parseYesNo(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case command.Yes:
+		return true, nil
+	case command.No:
+		return false, nil
+	}
+	return false, fmt.Errorf("argument must be 'yes' or 'no', got %s", value)
+}
+
+func boolToInt(value bool) int {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+func yesNo(value bool) string {
+	if value {
+		return command.Yes
+	}
+	return command.No
+}
+
 func handleKeys(h *Handler, userCommand *command.Command) error {
 	if len(userCommand.Args) > 3 {
 		return fmt.Errorf("invalid arguments for the %s command", strings.ToUpper(command.Keys))
@@ -142,9 +449,9 @@ func handleReplconf(h *Handler, userCommand *command.Command) error {
 	default:
 		h.WriteResponse(command.Ok)
 	case command.GetAck:
-		if h.cfg.Role() == config.RoleMaster {
+		if !h.masterLink {
 			info := strings.ToUpper(strings.Join(userCommand.Args, " "))
-			return fmt.Errorf("the %s command is only available for salves", info)
+			return fmt.Errorf("the %s command is only available on the master link", info)
 		}
 
 		offSet := strconv.Itoa(h.cfg.ReplOffset())
@@ -156,34 +463,210 @@ func handleReplconf(h *Handler, userCommand *command.Command) error {
 		)
 		h.writer.WriteString(response)
 	case command.Ack:
+		// Replicas also receive ACKs from their own sub-replicas
+		if h.slave == nil {
+			return fmt.Errorf("%s received from a client that is not a replica", strings.ToUpper(command.Ack))
+		}
+		if len(userCommand.Args) != 3 {
+			return fmt.Errorf("the number of argument for %s is incorrect", userCommand.Args[0])
+		}
+
+		offset, err := strconv.Atoi(userCommand.Args[2])
+		if err != nil {
+			return fmt.Errorf("invalid %s offset: %s", strings.ToUpper(command.Ack), userCommand.Args[2])
+		}
+		h.slave.Ack(offset)
+		h.cfg.NotifyReplicaAck()
+	case command.Capa:
+		for i := 2; i < len(userCommand.Args); i += 2 {
+			if strings.ToLower(userCommand.Args[i]) == command.EOF {
+				h.replicaCapaEOF = true
+			}
+		}
+		h.WriteResponse(command.Ok)
+	case command.ListeningPort:
+		if len(userCommand.Args) != 3 {
+			return fmt.Errorf("the number of argument for %s is incorrect", userCommand.Args[0])
+		}
+		h.replicaPort = userCommand.Args[2]
+		h.WriteResponse(command.Ok)
+	}
+
+	return nil
+}
+
+func handlePsync(h *Handler, userCommand *command.Command) error {
+	failover := len(userCommand.Args) == 4 && strings.ToLower(userCommand.Args[3]) == command.Failover
+	if len(userCommand.Args) != 3 && !failover {
+		return fmt.Errorf("the number of argument for %s is incorrect", userCommand.Args[0])
+	}
+
+	// `PSYNC <replid> <offset> FAILOVER` comes from the master of this
+	// replica handing over its role, the replica is promoted before the
+	// master continues as its replica
+	if failover {
+		if userCommand.Args[1] != h.cfg.ReplID() {
+			h.WriteResponse(command.NewError("ERR PSYNC FAILOVER replid must match my replid."))
+			return nil
+		}
 		if h.cfg.Role() == config.RoleSlave {
-			info := strings.ToUpper(strings.Join(userCommand.Args, " "))
-			return fmt.Errorf("the %s command is only available for master", info)
+			h.repl.PromoteToMaster()
+			log.Println("PSYNC FAILOVER accepted; promoting to master")
+		}
+	}
+
+	// A replica can only serve sub-replicas with the stream of its master
+	if h.cfg.Role() == config.RoleSlave && !h.cfg.MasterLinkUp() {
+		h.WriteResponse(command.NewError("NOMASTERLINK Can't SYNC while not connected with my master"))
+		return nil
+	}
+
+	replID := userCommand.Args[1]
+	if psyncOffset, err := strconv.Atoi(userCommand.Args[2]); err == nil {
+		if partialResync(h, replID, psyncOffset) {
+			return nil
+		}
+	}
+
+	slave := h.newSlave()
+	if h.cfg.DisklessSync() && h.replicaCapaEOF {
+		if h.cfg.JoinDisklessSync(slave) {
+			go disklessSync(h.db, h.cfg)
+		}
+		return nil
+	}
+	return diskSync(h, slave)
+}
+
+// REPLICAOF host port | NO ONE
+func handleReplicaof(h *Handler, userCommand *command.Command) error {
+	if len(userCommand.Args) != 3 {
+		return fmt.Errorf("the number of argument for %s is incorrect", userCommand.Args[0])
+	}
+
+	// Replicas of a cluster follow the master assigned by CLUSTER REPLICATE
+	if h.cfg.Cluster() != nil {
+		h.WriteResponse(command.NewError("ERR REPLICAOF not allowed in cluster mode."))
+		return nil
+	}
+
+	host, port := userCommand.Args[1], userCommand.Args[2]
+	if strings.ToLower(host) == command.No && strings.ToLower(port) == command.One {
+		if h.cfg.Role() == config.RoleSlave {
+			h.repl.PromoteToMaster()
 		}
+		h.WriteResponse(command.Ok)
+		return nil
+	}
+
+	if _, err := strconv.Atoi(port); err != nil {
+		return fmt.Errorf("invalid master port: %s", port)
+	}
 
-		// Probably needed for validations latter
-		//offSet, _ := strconv.Atoi(userCommand.Args[2])
-		h.IncrementAckSlaves()
+	master := net.JoinHostPort(host, port)
+	if h.cfg.Role() == config.RoleSlave && h.cfg.ReplicaOf() == master {
+		h.WriteResponse(command.NewString("OK Already connected to specified master"))
+		return nil
 	}
 
+	if err := h.repl.ReplicaOf(master); err != nil {
+		return err
+	}
+	h.WriteResponse(command.Ok)
 	return nil
 }
 
-func handlePsync(h *Handler, _ *command.Command) error {
-	h.writer.WriteString(
-		command.NewString(
-			fmt.Sprintf("%s %s %d", command.Fullsync, "REPL_ID", 0),
-		),
-	)
+// FAILOVER [TO host port [FORCE]] [TIMEOUT ms] [ABORT]
+func handleFailover(h *Handler, userCommand *command.Command) error {
+	if h.cfg.Cluster() != nil {
+		h.WriteResponse(command.NewError("ERR FAILOVER not allowed in cluster mode."))
+		return nil
+	}
 
-	dbData, err := rdb.GetEmptyRDBContent()
+	target, timeout, force, abort := "", 0, false, false
+	args := userCommand.Args
+	for i := 1; i < len(args); i++ {
+		switch option := strings.ToLower(args[i]); {
+		case option == command.To && target == "" && i+2 < len(args):
+			if _, err := strconv.Atoi(args[i+2]); err != nil {
+				h.WriteResponse(command.NewError("ERR value is not an integer or out of range"))
+				return nil
+			}
+			target = net.JoinHostPort(args[i+1], args[i+2])
+			i += 2
+		case option == command.Timeout && timeout == 0 && i+1 < len(args):
+			ms, err := strconv.Atoi(args[i+1])
+			if err != nil || ms <= 0 {
+				h.WriteResponse(command.NewError("ERR FAILOVER timeout must be greater than 0"))
+				return nil
+			}
+			timeout = ms
+			i++
+		case option == command.Force && !force:
+			force = true
+		case option == command.Abort && !abort:
+			abort = true
+		default:
+			h.WriteResponse(command.NewError("ERR syntax error"))
+			return nil
+		}
+	}
+
+	if abort && (target != "" || timeout != 0 || force) {
+		h.WriteResponse(command.NewError("ERR FAILOVER abort cannot be used with other arguments"))
+		return nil
+	}
+
+	var err error
+	if abort {
+		err = h.repl.AbortFailover()
+	} else {
+		err = h.repl.Failover(target, time.Duration(timeout)*time.Millisecond, force)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to read rdb file, error: %w", err)
+		h.WriteResponse(command.NewError("ERR " + err.Error()))
+		return nil
+	}
+	h.WriteResponse(command.Ok)
+	return nil
+}
+
+// CLIENT PAUSE timeout [WRITE|ALL] | CLIENT UNPAUSE
+func handleClient(h *Handler, userCommand *command.Command) error {
+	if len(userCommand.Args) < 2 {
+		return fmt.Errorf("the number of argument for %s is incorrect", userCommand.Args[0])
 	}
-	h.WriteResponse(command.NewRDBFile(dbData))
 
-	slave := config.NewSlave(h.connection)
-	h.cfg.AddSlave(slave)
+	args := userCommand.Args
+	switch subcommand := strings.ToLower(args[1]); subcommand {
+	case command.Pause:
+		if len(args) != 3 && len(args) != 4 {
+			return fmt.Errorf("the number of argument for %s %s is incorrect", args[0], args[1])
+		}
+		ms, err := strconv.Atoi(args[2])
+		if err != nil || ms < 0 {
+			h.WriteResponse(command.NewError("ERR timeout is not an integer or out of range"))
+			return nil
+		}
+		all := true
+		if len(args) == 4 {
+			switch strings.ToLower(args[3]) {
+			case command.Write:
+				all = false
+			case command.All:
+			default:
+				h.WriteResponse(command.NewError("ERR syntax error"))
+				return nil
+			}
+		}
+		h.cfg.PauseClients(time.Now().Add(time.Duration(ms)*time.Millisecond), all)
+	case command.Unpause:
+		h.cfg.UnpauseClients()
+	default:
+		h.WriteResponse(command.NewError(fmt.Sprintf("ERR unknown subcommand '%s'. Try CLIENT HELP.", args[1])))
+		return nil
+	}
+	h.WriteResponse(command.Ok)
 	return nil
 }
 
@@ -213,28 +696,237 @@ func handleWait(h *Handler, userCommand *command.Command) error {
 		return err
 	}
 
-	h.SetAckSlaves(0)
+	target := h.lastWriteOffset
+	if acked := h.cfg.AckedReplicas(target); acked >= numReplicas {
+		h.WriteResponse(command.NewInteger(acked))
+		return nil
+	}
+
 	h.sendGetAckToSlaves()
 
+	// A timeout of 0 blocks until enough replicas acknowledged
+	var timeout <-chan time.Time
+	if waitTime > 0 {
+		timer := time.NewTimer(time.Duration(waitTime) * time.Millisecond)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
 	for {
+		acksChanged := h.cfg.ReplicaAcks()
+		acked := h.cfg.AckedReplicas(target)
+		if acked >= numReplicas {
+			h.WriteResponse(command.NewInteger(acked))
+			return nil
+		}
+
 		select {
-		case ackSlaves := <-h.acksChan:
-			// Cheating to prevent race conditions
-			// probably should look for a way to manage multiple REPLCONF ACK responses
-			if ackSlaves > h.AckSlaves() {
-				h.SetAckSlaves(ackSlaves)
-			}
-			if ackSlaves >= numReplicas {
-				h.WriteResponse(command.NewInteger(ackSlaves))
-				return nil
+		case <-acksChanged:
+		case <-timeout:
+			h.WriteResponse(command.NewInteger(h.cfg.AckedReplicas(target)))
+			return nil
+		}
+	}
+}
+
+func handleSave(h *Handler, _ *command.Command) error {
+	if err := h.db.Save(h.cfg.RDBFilePath()); err != nil {
+		h.WriteResponse(command.NewError("ERR " + err.Error()))
+		return nil
+	}
+	h.WriteResponse(command.Ok)
+	return nil
+}
+
+func handleBgsave(h *Handler, _ *command.Command) error {
+	if err := h.db.BackgroundSave(h.cfg.RDBFilePath()); err != nil {
+		h.WriteResponse(command.NewError("ERR " + err.Error()))
+		return nil
+	}
+	h.WriteResponse(command.NewString("Background saving started"))
+	return nil
+}
+
+func handleBgrewriteaof(h *Handler, _ *command.Command) error {
+	if err := h.db.RewriteAOF(h.cfg.AOFRDBPreamble()); err != nil {
+		h.WriteResponse(command.NewError(err.Error()))
+		return nil
+	}
+	h.WriteResponse(command.NewString("Background append only file rewriting started"))
+	return nil
+}
+
+// DEBUG EXPORT JSON|RESP [filename]
+// Without a filename the export is sent back as a bulk string. Files are
+// written in the dir of the config only, like the RDB and AOF files
+func handleDebug(h *Handler, userCommand *command.Command) error {
+	if len(userCommand.Args) < 3 || len(userCommand.Args) > 4 ||
+		strings.ToLower(userCommand.Args[1]) != command.Export {
+		return fmt.Errorf("invalid %s arguments, expected %s JSON|RESP [filename]",
+			strings.ToUpper(command.Debug), strings.ToUpper(command.Export))
+	}
+
+	format := strings.ToLower(userCommand.Args[2])
+	if len(userCommand.Args) == 4 {
+		filename := userCommand.Args[3]
+		if !filepath.IsLocal(filename) {
+			h.WriteResponse(command.NewError("ERR the export filename must be a relative path inside the dir, without '..'"))
+			return nil
+		}
+		if err := h.db.ExportFile(filepath.Join(h.cfg.Dir(), filename), format); err != nil {
+			h.WriteResponse(command.NewError("ERR " + err.Error()))
+			return nil
+		}
+		h.WriteResponse(command.Ok)
+		return nil
+	}
+
+	export := &strings.Builder{}
+	if err := storage.Export(export, h.db.Snapshot(), format); err != nil {
+		h.WriteResponse(command.NewError("ERR " + err.Error()))
+		return nil
+	}
+	h.WriteResponse(command.NewBulkString(export.String()))
+	return nil
+}
+
+func handleDel(h *Handler, userCommand *command.Command) error {
+	if len(userCommand.Args) < 2 {
+		return fmt.Errorf("%s command requires at least a key argument", strings.ToUpper(command.Del))
+	}
+
+	deleted := h.db.Delete(userCommand.Args[1:]...)
+	if deleted == 0 {
+		h.writeRejected = true
+	}
+	h.WriteResponse(command.NewInteger(deleted))
+	return nil
+}
+
+func handleDump(h *Handler, userCommand *command.Command) error {
+	if len(userCommand.Args) != 2 {
+		return fmt.Errorf("%s command requires a key argument", strings.ToUpper(command.Dump))
+	}
+
+	entry, exist := h.db.GetEntry(userCommand.Args[1])
+	if !exist {
+		h.WriteResponse(command.Null)
+		return nil
+	}
+	payload, err := rdb.Dump(entry.Value)
+	if err != nil {
+		h.WriteResponse(command.NewError("ERR " + err.Error()))
+		return nil
+	}
+	h.WriteResponse(command.NewBulkString(string(payload)))
+	return nil
+}
+
+// RESTORE key ttl payload [REPLACE] [ABSTTL] [IDLETIME seconds] [FREQ frequency]
+func handleRestore(h *Handler, userCommand *command.Command) error {
+	if len(userCommand.Args) < 4 {
+		return fmt.Errorf("%s command requires key, ttl and payload arguments", strings.ToUpper(command.Restore))
+	}
+
+	key, payload := userCommand.Args[1], userCommand.Args[3]
+	ttl, err := strconv.ParseInt(userCommand.Args[2], 10, 64)
+	if err != nil {
+		return h.rejectWrite("ERR value is not an integer or out of range")
+	}
+	if ttl < 0 {
+		return h.rejectWrite("ERR Invalid TTL value, must be >= 0")
+	}
+
+	// IDLETIME and FREQ only feed the LRU and LFU eviction policies, there is
+	// no eviction so they are validated and dropped like Redis does with noeviction
+	replace, absTTL := false, false
+	idle, freq := int64(-1), int64(-1)
+	for i := 4; i < len(userCommand.Args); i++ {
+		option := strings.ToLower(userCommand.Args[i])
+		switch {
+		case option == command.Replace:
+			replace = true
+		case option == command.Absttl:
+			absTTL = true
+		case option == command.Idletime && i+1 < len(userCommand.Args) && freq == -1:
+			i++
+			idle, err = strconv.ParseInt(userCommand.Args[i], 10, 64)
+			if err != nil {
+				return h.rejectWrite("ERR value is not an integer or out of range")
 			}
-		case <-time.After(time.Duration(waitTime) * time.Millisecond):
-			if h.AckSlaves() > 0 {
-				h.WriteResponse(command.NewInteger(h.AckSlaves()))
-			} else {
-				h.WriteResponse(command.NewInteger(len(h.cfg.Slaves())))
+			if idle < 0 {
+				return h.rejectWrite("ERR Invalid IDLETIME value, must be >= 0")
 			}
+		case option == command.Freq && i+1 < len(userCommand.Args) && idle == -1:
+			i++
+			freq, err = strconv.ParseInt(userCommand.Args[i], 10, 64)
+			if err != nil {
+				return h.rejectWrite("ERR value is not an integer or out of range")
+			}
+			if freq < 0 || freq > 255 {
+				return h.rejectWrite("ERR Invalid FREQ value, must be >= 0 and <= 255")
+			}
+		default:
+			return h.rejectWrite("ERR syntax error")
+		}
+	}
+
+	value, err := rdb.Restore([]byte(payload))
+	if err != nil {
+		return h.rejectWrite("ERR " + err.Error())
+	}
+
+	expireAt := ttl
+	if ttl > 0 && !absTTL {
+		expireAt = time.Now().UnixMilli() + ttl
+	}
+	if err := h.db.Restore(key, value, expireAt, replace); err != nil {
+		return h.rejectWrite(err.Error())
+	}
+
+	// Replicas and the AOF get the absolute expiration, so the key doesn't
+	// live longer when the command is applied later
+	if ttl > 0 && !absTTL {
+		userCommand.Args[2] = strconv.FormatInt(expireAt, 10)
+		userCommand.Args = append(userCommand.Args, strings.ToUpper(command.Absttl))
+	}
+	h.WriteResponse(command.Ok)
+	return nil
+}
+
+func handleLastsave(h *Handler, _ *command.Command) error {
+	h.WriteResponse(command.NewInteger(int(h.db.LastSave().Unix())))
+	return nil
+}
+
+// SHUTDOWN [NOSAVE|SAVE]
+func handleShutdown(h *Handler, userCommand *command.Command) error {
+	save := len(h.cfg.SaveRules()) > 0
+	if len(userCommand.Args) > 1 {
+		switch strings.ToLower(userCommand.Args[1]) {
+		case command.Nosave:
+			save = false
+		case command.Save:
+			save = true
+		default:
+			return fmt.Errorf("invalid %s argument: %s", strings.ToUpper(command.Shutdown), userCommand.Args[1])
+		}
+	}
+
+	// A background save in progress is waited for, then the final
+	// snapshot is written in the foreground
+	if save {
+		if err := h.db.SaveAfterBackgroundSave(h.cfg.RDBFilePath()); err != nil {
+			h.WriteResponse(command.NewError("ERR Errors trying to SHUTDOWN. Check logs."))
+			log.Printf("failed to save the RDB file on shutdown: %s\n", err.Error())
 			return nil
 		}
 	}
+
+	if err := h.db.CloseAOF(); err != nil {
+		log.Printf("failed to sync the append only file on shutdown: %s\n", err.Error())
+	}
+	log.Println("shutting down the server")
+	os.Exit(0)
+	return nil
 }
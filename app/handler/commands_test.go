@@ -0,0 +1,368 @@
+package handler
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/command"
+	"github.com/codecrafters-io/redis-starter-go/app/server/config"
+	"github.com/codecrafters-io/redis-starter-go/app/storage"
+	"github.com/codecrafters-io/redis-starter-go/rdb"
+)
+
+// A client connected to a handler serving a new empty dataset
+type testClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func newTestClient(t *testing.T) *testClient {
+	server, client := net.Pipe()
+	h := NewHandler(server, storage.NewStorage(), config.NewConfig(), nil)
+	go h.HandleClient()
+	t.Cleanup(func() { client.Close() })
+	return &testClient{conn: client, reader: bufio.NewReader(client)}
+}
+
+func (c *testClient) do(t *testing.T, args ...string) (string, error) {
+	if _, err := c.conn.Write([]byte(command.NewArray(args))); err != nil {
+		t.Fatal(err)
+	}
+	return command.ReadReply(c.reader)
+}
+
+// A DUMP payload of the current version around body, with a valid checksum
+func dumpPayload(body []byte) string {
+	payload := binary.LittleEndian.AppendUint16(append([]byte{}, body...), rdb.RDB_VERSION)
+	return string(binary.LittleEndian.AppendUint64(payload, rdb.CRC64(0, payload)))
+}
+
+func TestRestoreMalformedPayload(t *testing.T) {
+	huge := []byte{0x81, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	negative := []byte{0x81, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	tests := []struct {
+		name string
+		body []byte
+	}{
+		{"huge string length", append([]byte{rdb.TYPE_STRING}, huge...)},
+		{"huge list length", append([]byte{rdb.TYPE_LIST}, huge...)},
+		{"negative list length", append([]byte{rdb.TYPE_LIST}, negative...)},
+		{"negative intset length", []byte{rdb.TYPE_SET_INTSET, 0x08, 0x08, 0, 0, 0, 0xff, 0xff, 0xff, 0xff}},
+		{"huge lzf length", append(append([]byte{rdb.TYPE_STRING, 0xc3, 0x02}, huge...), 0x00, 'a')},
+		{"truncated ziplist", []byte{rdb.TYPE_LIST_ZIPLIST, 0x04, 0x0f, 0, 0, 0}},
+		{"trailing bytes", []byte{rdb.TYPE_STRING, 0x01, 'v', 'x'}},
+		{"unknown type", []byte{0x63, 0x01, 'v'}},
+	}
+
+	client := newTestClient(t)
+	for _, test := range tests {
+		_, err := client.do(t, command.Restore, "key", "0", dumpPayload(test.body))
+		var replyErr command.ReplyError
+		if !errors.As(err, &replyErr) || !strings.HasPrefix(string(replyErr), "ERR "+rdb.ErrBadData.Error()) {
+			t.Errorf("%s: got %v, want a bad data format error", test.name, err)
+		}
+	}
+
+	// The server is still serving, and nothing was restored
+	if reply, err := client.do(t, command.Get, "key"); err != nil || reply != "" {
+		t.Errorf("got %q, %v after the malformed payloads, want a null reply", reply, err)
+	}
+}
+
+func TestRestoreBadChecksum(t *testing.T) {
+	payload := []byte(dumpPayload([]byte{rdb.TYPE_STRING, 0x01, 'v'}))
+	payload[len(payload)-1] ^= 0xff
+
+	client := newTestClient(t)
+	_, err := client.do(t, command.Restore, "key", "0", string(payload))
+	if err == nil || err.Error() != "ERR "+rdb.ErrDumpPayload.Error() {
+		t.Errorf("got %v, want a payload checksum error", err)
+	}
+}
+
+func TestDumpAndRestore(t *testing.T) {
+	client := newTestClient(t)
+	if _, err := client.do(t, command.Set, "key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	payload, err := client.do(t, command.Dump, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.do(t, command.Restore, "copy", "0", payload); err != nil {
+		t.Fatal(err)
+	}
+	if reply, err := client.do(t, command.Get, "copy"); err != nil || reply != "value" {
+		t.Errorf("got %q, %v, want the restored value", reply, err)
+	}
+}
+
+func TestSetPropagatesAbsoluteExpiration(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	h := NewHandler(server, storage.NewStorage(), config.NewConfig(), nil)
+
+	before := time.Now().UnixMilli()
+	userCommand := &command.Command{Args: []string{"SET", "key", "value", "PX", "60000"}}
+	if err := h.handleCommand(userCommand); err != nil {
+		t.Fatal(err)
+	}
+
+	args := userCommand.Args
+	expireAt, err := strconv.ParseInt(args[4], 10, 64)
+	if err != nil || args[3] != "PXAT" || expireAt < before+60000 || expireAt > time.Now().UnixMilli()+60000 {
+		t.Errorf("got %q, want SET with PXAT in a minute", args)
+	}
+}
+
+// Serves a new empty dataset on a local port, like another instance
+func newTestTarget(t *testing.T) (string, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	db, cfg := storage.NewStorage(), config.NewConfig()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go NewHandler(conn, db, cfg, nil).HandleClient()
+		}
+	}()
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	return host, port
+}
+
+func dialTestTarget(t *testing.T, host, port string) *testClient {
+	conn, err := net.Dial("tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func TestMigrate(t *testing.T) {
+	tests := []struct {
+		name string
+		// Keys set on the source and on the target before MIGRATE
+		source, target []string
+		// Arguments after MIGRATE host port
+		args []string
+		want string
+		// Values of the keys on both sides afterwards, "" when missing
+		wantSource, wantTarget map[string]string
+	}{
+		{
+			name:       "missing key",
+			args:       []string{"a", "0", "1000"},
+			want:       "NOKEY",
+			wantTarget: map[string]string{"a": ""},
+		},
+		{
+			name:       "move",
+			source:     []string{"a"},
+			args:       []string{"a", "0", "1000"},
+			want:       "OK",
+			wantSource: map[string]string{"a": ""},
+			wantTarget: map[string]string{"a": "source"},
+		},
+		{
+			name:       "copy",
+			source:     []string{"a"},
+			args:       []string{"a", "0", "1000", "COPY"},
+			want:       "OK",
+			wantSource: map[string]string{"a": "source"},
+			wantTarget: map[string]string{"a": "source"},
+		},
+		{
+			name:       "existing key",
+			source:     []string{"a"},
+			target:     []string{"a"},
+			args:       []string{"a", "0", "1000"},
+			want:       "ERR Target instance replied with error: " + storage.ErrBusyKey.Error(),
+			wantSource: map[string]string{"a": "source"},
+			wantTarget: map[string]string{"a": "target"},
+		},
+		{
+			name:       "replace",
+			source:     []string{"a"},
+			target:     []string{"a"},
+			args:       []string{"a", "0", "1000", "REPLACE"},
+			want:       "OK",
+			wantSource: map[string]string{"a": ""},
+			wantTarget: map[string]string{"a": "source"},
+		},
+		{
+			name:       "keys",
+			source:     []string{"a", "b"},
+			args:       []string{"", "0", "1000", "KEYS", "a", "b", "c"},
+			want:       "OK",
+			wantSource: map[string]string{"a": "", "b": ""},
+			wantTarget: map[string]string{"a": "source", "b": "source", "c": ""},
+		},
+		{
+			// Only the keys the target accepted are deleted
+			name:       "keys with an existing key",
+			source:     []string{"a", "b"},
+			target:     []string{"b"},
+			args:       []string{"", "0", "1000", "KEYS", "a", "b"},
+			want:       "ERR Target instance replied with error: " + storage.ErrBusyKey.Error(),
+			wantSource: map[string]string{"a": "", "b": "source"},
+			wantTarget: map[string]string{"a": "source", "b": "target"},
+		},
+		{
+			name:       "other database",
+			source:     []string{"a"},
+			args:       []string{"a", "1", "1000"},
+			want:       "ERR Target instance replied with error: ERR DB index is out of range",
+			wantSource: map[string]string{"a": "source"},
+			wantTarget: map[string]string{"a": ""},
+		},
+		{
+			name:       "password",
+			source:     []string{"a"},
+			args:       []string{"a", "0", "1000", "AUTH", "secret"},
+			want:       "ERR Target instance replied with error: ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?",
+			wantSource: map[string]string{"a": "source"},
+			wantTarget: map[string]string{"a": ""},
+		},
+		{
+			name:       "default user",
+			source:     []string{"a"},
+			args:       []string{"a", "0", "1000", "AUTH2", "default", "secret"},
+			want:       "OK",
+			wantSource: map[string]string{"a": ""},
+			wantTarget: map[string]string{"a": "source"},
+		},
+	}
+
+	for _, test := range tests {
+		host, port := newTestTarget(t)
+		source, target := newTestClient(t), dialTestTarget(t, host, port)
+		for _, key := range test.source {
+			if _, err := source.do(t, command.Set, key, "source"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, key := range test.target {
+			if _, err := target.do(t, command.Set, key, "target"); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		reply, err := source.do(t, append([]string{command.Migrate, host, port}, test.args...)...)
+		if err != nil {
+			reply = err.Error()
+		}
+		if reply != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, reply, test.want)
+		}
+
+		for side, values := range map[*testClient]map[string]string{source: test.wantSource, target: test.wantTarget} {
+			for key, want := range values {
+				if got, err := side.do(t, command.Get, key); err != nil || got != want {
+					t.Errorf("%s: got %q, %v for %s, want %q", test.name, got, err, key, want)
+				}
+			}
+		}
+	}
+}
+
+// MIGRATE waits for the target outside the write section, saves are not
+// blocked meanwhile
+func TestMigrateDoesNotBlockFreeze(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	// The target accepts the connection but never replies
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	server, client := net.Pipe()
+	defer client.Close()
+	db := storage.NewStorage()
+	db.Set("a", "value", 0)
+	go NewHandler(server, db, config.NewConfig(), nil).HandleClient()
+
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	done := make(chan error, 1)
+	go func() {
+		source := &testClient{conn: client, reader: bufio.NewReader(client)}
+		_, err := source.do(t, command.Migrate, host, port, "a", "0", "500")
+		done <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	frozen := make(chan struct{})
+	go db.Freeze(func() { close(frozen) })
+	select {
+	case <-frozen:
+	case <-done:
+		t.Fatal("MIGRATE ended before the target replied")
+	case <-time.After(300 * time.Millisecond):
+		t.Fatal("Freeze blocked while MIGRATE waited for the target")
+	}
+	if err := <-done; err == nil || !strings.HasPrefix(err.Error(), "IOERR") {
+		t.Errorf("got %v, want an IOERR after the timeout", err)
+	}
+}
+
+func TestDebugExportFile(t *testing.T) {
+	dir := t.TempDir()
+	server, conn := net.Pipe()
+	go NewHandler(server, storage.NewStorage(), config.NewConfig(config.WithDir(dir)), nil).HandleClient()
+	defer conn.Close()
+	client := &testClient{conn: conn, reader: bufio.NewReader(conn)}
+
+	tests := []struct {
+		filename string
+		ok       bool
+	}{
+		{"export.json", true},
+		{"exports/../export.resp", true},
+		{filepath.Join(dir, "absolute.json"), false},
+		{"../outside.json", false},
+		{"exports/../../outside.json", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		_, err := client.do(t, command.Debug, command.Export, "JSON", test.filename)
+		if ok := err == nil; ok != test.ok {
+			t.Errorf("%q: got %v, want success %t", test.filename, err, test.ok)
+		}
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	if strings.Join(names, " ") != "export.json export.resp" {
+		t.Errorf("got files %q in the dir, want the two exports", names)
+	}
+}
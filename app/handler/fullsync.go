@@ -0,0 +1,206 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/command"
+	"github.com/codecrafters-io/redis-starter-go/app/server/config"
+	"github.com/codecrafters-io/redis-starter-go/app/storage"
+	"github.com/codecrafters-io/redis-starter-go/rdb"
+)
+
+const (
+	eofPrefix   = "$EOF:"
+	eofMarkSize = 40
+)
+
+// Serves `PSYNC <replid> <offset>` from the backlog when possible.
+// The replica is registered in the same step the backlog is read, so it
+// doesn't miss the writes that follow
+func partialResync(h *Handler, replID string, psyncOffset int) bool {
+	var backlog []byte
+	ok := false
+	h.db.Freeze(func() {
+		backlog, ok = h.cfg.CanPartialResync(replID, psyncOffset)
+		if ok {
+			h.cfg.AddSlave(h.newSlave())
+		}
+	})
+	if !ok {
+		return false
+	}
+
+	h.writer.WriteString(command.NewString(
+		fmt.Sprintf("%s %s", command.Continue, h.cfg.ReplID()),
+	))
+	h.writer.Write(backlog)
+	h.writer.Flush()
+	h.slave.SetState(config.SlaveOnline)
+	return true
+}
+
+// Full resync through the client connection, the snapshot is sent as a bulk
+// string whose length is known upfront
+func diskSync(h *Handler, slave *config.Slave) error {
+	offset, writeRDB := snapshotForReplicas(h.db, h.cfg, []*config.Slave{slave})
+
+	payload := &bytes.Buffer{}
+	if err := writeRDB(payload); err != nil {
+		slave.Close()
+		return fmt.Errorf("failed to create the RDB snapshot, error: %w", err)
+	}
+
+	slave.SetState(config.SlaveSendBulk)
+	h.writer.WriteString(command.NewString(
+		fmt.Sprintf("%s %s %d", command.Fullsync, h.cfg.ReplID(), offset),
+	))
+	h.writer.WriteString(command.NewRDBFile(payload.Bytes()))
+	if err := h.writer.Flush(); err != nil {
+		return err
+	}
+	slave.SetState(config.SlaveOnline)
+	return nil
+}
+
+// Streams one snapshot to every replica that joined within
+// repl-diskless-sync-delay, using the EOF mark framing since the size
+// isn't known in advance
+func disklessSync(db *storage.Storage, cfg *config.Config) {
+	time.Sleep(time.Duration(cfg.DisklessSyncDelay()) * time.Second)
+
+	slaves := cfg.TakeDisklessSync()
+	offset, writeRDB := snapshotForReplicas(db, cfg, slaves)
+
+	mark, err := newEOFMark()
+	if err != nil {
+		log.Printf("failed to create the EOF mark: %s\n", err.Error())
+		for _, slave := range slaves {
+			slave.Close()
+		}
+		return
+	}
+
+	out := newReplicasWriter(slaves)
+	for _, slave := range slaves {
+		slave.SetState(config.SlaveSendBulk)
+	}
+	fmt.Fprintf(out, "+%s %s %d\r\n%s%s\r\n", command.Fullsync, cfg.ReplID(), offset, eofPrefix, mark)
+	if err := writeRDB(out); err != nil {
+		log.Printf("diskless transfer failed: %s\n", err.Error())
+		out.closeAll()
+		return
+	}
+	out.Write(mark)
+	out.Flush()
+
+	for _, slave := range out.alive() {
+		slave.SetState(config.SlaveOnline)
+	}
+}
+
+// Registers the replicas at the replication offset of the snapshot, so the
+// writes after it are queued for them while the RDB is transferred
+func snapshotForReplicas(db *storage.Storage, cfg *config.Config, slaves []*config.Slave) (int, func(io.Writer) error) {
+	offset := 0
+	var entries []rdb.Entry
+	db.Freeze(func() {
+		offset = cfg.ReplOffset()
+		entries = db.Snapshot()
+		for _, slave := range slaves {
+			cfg.AddSlave(slave)
+		}
+	})
+
+	return offset, func(w io.Writer) error {
+		return storage.WriteRDB(w, entries)
+	}
+}
+
+func newEOFMark() ([]byte, error) {
+	random := make([]byte, eofMarkSize/2)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	mark := make([]byte, eofMarkSize)
+	hex.Encode(mark, random)
+	return mark, nil
+}
+
+// Reads the diskless payload up to the EOF mark, which is not included
+func readUntilMark(reader *bufio.Reader, mark []byte) ([]byte, error) {
+	payload := []byte{}
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		payload = append(payload, b)
+		if bytes.HasSuffix(payload, mark) {
+			return payload[:len(payload)-len(mark)], nil
+		}
+	}
+}
+
+// Writes the same stream to several replicas, dropping the ones that fail
+// so a single broken connection doesn't abort the whole transfer
+type replicasWriter struct {
+	slaves  []*config.Slave
+	writers []*bufio.Writer
+}
+
+func newReplicasWriter(slaves []*config.Slave) *replicasWriter {
+	w := &replicasWriter{slaves: slaves}
+	for _, slave := range slaves {
+		w.writers = append(w.writers, bufio.NewWriter(slave.Conn()))
+	}
+	return w
+}
+
+func (w *replicasWriter) Write(data []byte) (int, error) {
+	for i, writer := range w.writers {
+		if writer == nil {
+			continue
+		}
+		if _, err := writer.Write(data); err != nil {
+			log.Printf("diskless transfer to %s failed: %s\n", w.slaves[i].Addr(), err.Error())
+			w.slaves[i].Close()
+			w.writers[i] = nil
+		}
+	}
+	if len(w.alive()) == 0 {
+		return 0, fmt.Errorf("every replica disconnected")
+	}
+	return len(data), nil
+}
+
+func (w *replicasWriter) Flush() {
+	for i, writer := range w.writers {
+		if writer != nil && writer.Flush() != nil {
+			w.slaves[i].Close()
+			w.writers[i] = nil
+		}
+	}
+}
+
+func (w *replicasWriter) alive() []*config.Slave {
+	slaves := []*config.Slave{}
+	for i, writer := range w.writers {
+		if writer != nil {
+			slaves = append(slaves, w.slaves[i])
+		}
+	}
+	return slaves
+}
+
+func (w *replicasWriter) closeAll() {
+	for _, slave := range w.slaves {
+		slave.Close()
+	}
+}
@@ -2,57 +2,163 @@ package handler
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
+	"io"
+	"log"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/codecrafters-io/redis-starter-go/app/command"
 	"github.com/codecrafters-io/redis-starter-go/app/server/config"
 	"github.com/codecrafters-io/redis-starter-go/app/storage"
 )
 
+// Replication lets commands change the replication topology of the server
+type Replication interface {
+	ReplicaOf(master string) error
+	PromoteToMaster()
+	Failover(target string, timeout time.Duration, force bool) error
+	AbortFailover() error
+}
+
+const ackInterval = time.Second
+
 type Handler struct {
-	db           *storage.Storage
-	connection   net.Conn
-	cfg          *config.Config
-	reader       *bufio.Reader
-	writer       *bufio.Writer
-	slavesOffset int
-	ackSlaves    int
-	acksLock     *sync.RWMutex
-	acksChan     chan int
-}
-
-var commandHandlers = map[string]func(*Handler, *command.Command) error{
-	command.Ping:     handlePing,
-	command.Echo:     handleEcho,
-	command.Get:      handleGet,
-	command.Set:      handleSet,
-	command.Info:     handleInfo,
-	command.Replconf: handleReplconf,
-	command.Psync:    handlePsync,
-	command.Wait:     handleWait,
-	command.Config:   handleConfig,
-	command.Keys:     handleKeys,
-}
-
-func NewHandler(conn net.Conn, db *storage.Storage, cfg *config.Config, acksChan chan int, locker *sync.RWMutex) *Handler {
+	db         *storage.Storage
+	connection net.Conn
+	cfg        *config.Config
+	repl       Replication
+	masterLink bool
+	// Set once the client turns into a replica with PSYNC
+	slave          *config.Slave
+	replicaPort    string
+	replicaCapaEOF bool
+	// Replication offset right after the last write of this client, used by WAIT
+	lastWriteOffset int
+	// Set by write commands that were refused, they are not propagated
+	writeRejected bool
+	// Ends the write section of the current command, see beginWrite
+	writeEnd  func()
+	reader    *bufio.Reader
+	writer    *bufio.Writer
+	writeLock *sync.Mutex
+	// Set by ASKING for the next command only, it may then use the keys of
+	// a slot this node is importing
+	asking bool
+	// Channels the client is subscribed to, it can only run pubsub
+	// commands while it has any
+	subscriptions map[string]bool
+}
+
+type commandHandler struct {
+	handle func(*Handler, *command.Command) error
+	// Write commands change the dataset, once they succeed on a master
+	// they are propagated to the replicas and the backlog
+	write bool
+	// Stale commands are allowed on replicas that lost their master
+	// even with `replica-serve-stale-data no`
+	stale bool
+	// Positions of the keys in the arguments: the first key, the last one
+	// and the step between keys. A negative last key counts from the end,
+	// commands without keys have a first key of 0
+	firstKey int
+	lastKey  int
+	keyStep  int
+	// Finds the keys of commands whose keys have no fixed positions
+	getKeys func(args []string) []string
+	// Asking commands use the keys of a slot being imported without ASKING
+	asking bool
+	// Pubsub commands are allowed to subscribed clients
+	pubsub bool
+	// Network writes talk to other servers before changing the dataset,
+	// they enter the write section themselves with beginWrite once their
+	// I/O is done so they don't block Storage.Freeze meanwhile
+	network bool
+}
+
+var commandHandlers = map[string]commandHandler{
+	command.Ping:          {handle: handlePing, stale: true, pubsub: true},
+	command.Echo:          {handle: handleEcho, stale: true},
+	command.Select:        {handle: handleSelect, stale: true},
+	command.Auth:          {handle: handleAuth, stale: true},
+	command.Get:           {handle: handleGet, firstKey: 1, lastKey: 1, keyStep: 1},
+	command.Set:           {handle: handleSet, write: true, firstKey: 1, lastKey: 1, keyStep: 1},
+	command.Info:          {handle: handleInfo, stale: true},
+	command.Replconf:      {handle: handleReplconf, stale: true},
+	command.Psync:         {handle: handlePsync, stale: true},
+	command.Wait:          {handle: handleWait},
+	command.Config:        {handle: handleConfig, stale: true},
+	command.Keys:          {handle: handleKeys},
+	command.Replicaof:     {handle: handleReplicaof, stale: true},
+	command.Slaveof:       {handle: handleReplicaof, stale: true},
+	command.Save:          {handle: handleSave},
+	command.Bgsave:        {handle: handleBgsave},
+	command.Lastsave:      {handle: handleLastsave, stale: true},
+	command.Shutdown:      {handle: handleShutdown, stale: true},
+	command.Bgrewriteaof:  {handle: handleBgrewriteaof},
+	command.Debug:         {handle: handleDebug},
+	command.Del:           {handle: handleDel, write: true, firstKey: 1, lastKey: -1, keyStep: 1},
+	command.Dump:          {handle: handleDump, firstKey: 1, lastKey: 1, keyStep: 1},
+	command.Restore:       {handle: handleRestore, write: true, firstKey: 1, lastKey: 1, keyStep: 1},
+	command.Migrate:       {handle: handleMigrate, write: true, network: true, getKeys: migrateKeys},
+	command.Cluster:       {handle: handleCluster, stale: true},
+	command.Asking:        {handle: handleAsking, stale: true},
+	command.RestoreAsking: {handle: handleRestore, write: true, firstKey: 1, lastKey: 1, keyStep: 1, asking: true},
+	command.Subscribe:     {handle: handleSubscribe, stale: true, pubsub: true},
+	command.Unsubscribe:   {handle: handleUnsubscribe, stale: true, pubsub: true},
+	command.Publish:       {handle: handlePublish, stale: true},
+	command.Client:        {handle: handleClient, stale: true},
+	command.Failover:      {handle: handleFailover, stale: true},
+}
+
+// Keys of the arguments, the ones that are missing are ignored
+func (c commandHandler) keys(args []string) []string {
+	if c.getKeys != nil {
+		return c.getKeys(args)
+	}
+	if c.firstKey == 0 || c.firstKey >= len(args) {
+		return nil
+	}
+
+	last := c.lastKey
+	if last < 0 {
+		last += len(args)
+	}
+	last = min(last, len(args)-1)
+
+	keys := []string{}
+	for i := c.firstKey; i <= last; i += c.keyStep {
+		keys = append(keys, args[i])
+	}
+	return keys
+}
+
+func NewHandler(conn net.Conn, db *storage.Storage, cfg *config.Config, repl Replication) *Handler {
 	return &Handler{
-		db:           db,
-		connection:   conn,
-		cfg:          cfg,
-		reader:       bufio.NewReader(conn),
-		writer:       bufio.NewWriter(conn),
-		slavesOffset: 0,
-		ackSlaves:    0,
-		acksLock:     locker,
-		acksChan:     acksChan,
+		db:         db,
+		connection: conn,
+		cfg:        cfg,
+		repl:       repl,
+		reader:     bufio.NewReader(conn),
+		writer:     bufio.NewWriter(conn),
+		writeLock:  &sync.Mutex{},
 	}
 }
 
 func (h *Handler) HandleClient() error {
 	defer h.connection.Close()
+	defer h.removeSlave()
+	defer h.unsubscribeAll()
+
+	if h.masterLink {
+		stopAcks := make(chan struct{})
+		defer close(stopAcks)
+		go h.sendPeriodicAcks(stopAcks)
+	}
 
 	for {
 		userCommand, err := command.NewCommand(h.reader)
@@ -60,17 +166,20 @@ func (h *Handler) HandleClient() error {
 			return fmt.Errorf("failed to read command, error: %w", err)
 		}
 
+		h.writeLock.Lock()
 		err = h.handleCommand(userCommand)
 		if err != nil {
+			h.writeLock.Unlock()
 			return fmt.Errorf("error: %w", err)
 		}
-		// Check if this should only be update for slaves in the tests
-		h.cfg.UpdateOffset(userCommand.Size)
 		h.writer.Flush()
+		h.writeLock.Unlock()
 	}
 }
 
 func (h *Handler) Handshake() error {
+	h.masterLink = true
+
 	h.writer.WriteString(command.NewArray([]string{"PING"}))
 	h.writer.Flush()
 
@@ -81,7 +190,7 @@ func (h *Handler) Handshake() error {
 
 	h.writer.WriteString(command.NewArray([]string{
 		command.Replconf,
-		"listening-port",
+		command.ListeningPort,
 		h.cfg.Port(),
 	}))
 	h.writer.Flush()
@@ -93,7 +202,9 @@ func (h *Handler) Handshake() error {
 
 	h.writer.WriteString(command.NewArray([]string{
 		command.Replconf,
-		"capa",
+		command.Capa,
+		command.EOF,
+		command.Capa,
 		"psync2",
 	}))
 	h.writer.Flush()
@@ -103,75 +214,256 @@ func (h *Handler) Handshake() error {
 		return fmt.Errorf("incorrect master response")
 	}
 
-	h.writer.WriteString(command.NewArray([]string{
-		command.Psync,
-		"?",
-		"-1",
-	}))
+	// A server that already has replication history tries a partial resync.
+	// A master handing over its role with FAILOVER asks its replica to
+	// promote itself first
+	replID, offset := "?", "-1"
+	failover := h.cfg.Failover().State == config.FailoverInProgress
+	if h.cfg.ReplOffset() > 0 || failover {
+		replID, offset = h.cfg.ReplID(), strconv.Itoa(h.cfg.ReplOffset()+1)
+	}
+	psync := []string{command.Psync, replID, offset}
+	if failover {
+		psync = append(psync, command.Failover)
+	}
+	h.writer.WriteString(command.NewArray(psync))
 	h.writer.Flush()
 
 	response, err = h.reader.ReadString('\n')
-	responseCommand := strings.Split(response, " ")[0]
-	if err != nil || responseCommand != "+"+command.Fullsync {
+	if err != nil {
 		return fmt.Errorf("incorrect master response")
 	}
 
-	// Skip RDB file
-	_, err = h.reader.ReadBytes(162)
-	if err != nil {
-		return err
+	fields := strings.Fields(response)
+	switch {
+	case len(fields) == 3 && fields[0] == "+"+command.Fullsync:
+		masterOffset, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return fmt.Errorf("invalid %s offset: %s", command.Fullsync, fields[2])
+		}
+		payload, err := h.readRDBPayload()
+		if err != nil {
+			return err
+		}
+		if err := h.db.LoadRDB(bytes.NewReader(payload)); err != nil {
+			return fmt.Errorf("failed to load the master RDB, error: %w", err)
+		}
+		h.cfg.SetMasterReplication(fields[1], masterOffset)
+		// The dataset changed, sub-replicas have to resync with us and
+		// the AOF has to be rewritten from the new dataset
+		h.cfg.DisconnectSlaves()
+		h.db.ScheduleAOFRewrite()
+
+	case len(fields) >= 1 && fields[0] == "+"+command.Continue:
+		newReplID := ""
+		if len(fields) > 1 {
+			newReplID = fields[1]
+		}
+		if h.cfg.ContinueMasterReplication(newReplID) {
+			// Sub-replicas reconnect to learn the new replication ID
+			h.cfg.DisconnectSlaves()
+		}
+
+	default:
+		return fmt.Errorf("incorrect master response")
 	}
 
 	return nil
 }
 
-// Writes responses to commands send to the master server.
-// Slaves only give responses to `REPLCONF GETACK` commands
-func (h *Handler) WriteResponse(msg string) {
-	if h.cfg.Role() == config.RoleMaster {
-		h.writer.WriteString(msg)
+// Reads the RDB file sent by the master after a `+FULLRESYNC`.
+// The payload is sent as `$<length>\r\n<content>` without a trailing CRLF,
+// or as `$EOF:<mark>\r\n<content><mark>` by diskless masters
+func (h *Handler) readRDBPayload() ([]byte, error) {
+	line, err := h.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
 	}
+
+	if strings.HasPrefix(line, eofPrefix) {
+		mark := []byte(strings.TrimSpace(strings.TrimPrefix(line, eofPrefix)))
+		if len(mark) != eofMarkSize {
+			return nil, fmt.Errorf("invalid EOF mark: %q", mark)
+		}
+		return readUntilMark(h.reader, mark)
+	}
+
+	size := 0
+	if _, err := fmt.Sscanf(strings.TrimSpace(line), "$%d", &size); err != nil {
+		return nil, fmt.Errorf("invalid RDB payload header: %q", line)
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(h.reader, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
 }
 
-func (h *Handler) UpdaterSlavesOffset(commandBytes int) {
-	h.slavesOffset += commandBytes
+// Close closes the client connection, stopping HandleClient
+func (h *Handler) Close() error {
+	return h.connection.Close()
 }
 
-func (h *Handler) AckSlaves() int {
-	h.acksLock.RLock()
-	defer h.acksLock.RUnlock()
-	return h.ackSlaves
+// Writes responses to the client.
+// Commands that arrive through the master link are not answered,
+// replicas only give responses to `REPLCONF GETACK` commands.
+// Sub-replicas of a replica are ordinary clients here, they get their
+// PSYNC replies like the replicas of a master
+func (h *Handler) WriteResponse(msg string) {
+	if !h.masterLink {
+		h.writer.WriteString(msg)
+	}
 }
 
-func (h *Handler) IncrementAckSlaves() {
-	h.acksLock.Lock()
-	h.ackSlaves++
-	h.acksLock.Unlock()
-	h.acksChan <- h.ackSlaves
+// Turns the client connection into a replica. It only receives the
+// propagated commands once the resync payload was sent and it is online
+func (h *Handler) newSlave() *config.Slave {
+	h.slave = config.NewSlave(h.connection, h.replicaPort, h.cfg.ReplicaOutputLimits())
+	return h.slave
 }
 
-func (h *Handler) SetAckSlaves(val int) {
-	h.acksLock.Lock()
-	h.ackSlaves = val
-	h.acksLock.Unlock()
+// Forgets the replica once its connection is gone
+func (h *Handler) removeSlave() {
+	if h.slave == nil {
+		return
+	}
+	h.slave.Close()
+	h.cfg.RemoveSlave(h.slave)
+	log.Printf("replica %s disconnected\n", h.slave.Addr())
 }
 
 func (h *Handler) handleCommand(userCommand *command.Command) error {
+	asking := h.asking
+	h.asking = false
+
 	instruction := strings.ToLower(userCommand.Args[0])
 	handler, exist := commandHandlers[instruction]
 	if !exist {
 		return fmt.Errorf("unknown command: %s", strings.ToUpper(instruction))
 	}
-	return handler(h, userCommand)
+	if len(h.subscriptions) > 0 && !handler.pubsub {
+		h.WriteResponse(command.NewError(fmt.Sprintf(
+			"ERR Can't execute '%s': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context",
+			instruction)))
+		return nil
+	}
+
+	// Paused clients wait before running their commands, the replicas of
+	// this server are never paused
+	if !h.masterLink && h.slave == nil {
+		h.cfg.WaitPause(handler.write)
+	}
+
+	// In cluster mode clients are redirected to the node serving the keys,
+	// the master link only sends keys of the slots it serves. Writes wait
+	// for the end of a manual failover first, the keys may have moved
+	if !h.masterLink && h.cfg.Cluster() != nil {
+		if handler.write {
+			h.cfg.Cluster().WaitManualFailover()
+		}
+		if redirect := h.clusterRedirect(handler, userCommand.Args, asking || handler.asking); redirect != "" {
+			h.WriteResponse(command.NewError(redirect))
+			return nil
+		}
+	}
+
+	// Writes from the master link are always applied, ordinary clients of
+	// a replica are subject to replica-read-only and replica-serve-stale-data
+	if !h.masterLink && h.cfg.Role() == config.RoleSlave {
+		if handler.write && h.cfg.ReplicaReadOnly() {
+			h.WriteResponse(command.NewError(command.ReadOnlyError))
+			return nil
+		}
+		if !handler.stale && !h.cfg.ServeStaleData() && !h.cfg.MasterLinkUp() {
+			h.WriteResponse(command.NewError(command.MasterDownError))
+			return nil
+		}
+	}
+
+	// Refuse writes before touching the storage when too few replicas are
+	// in sync, bounding the data lost on failover
+	if handler.write && !h.masterLink && !h.cfg.CanWrite() {
+		h.WriteResponse(command.NewError(command.NoReplicasError))
+		return nil
+	}
+
+	if (handler.write && !handler.network) || h.masterLink {
+		h.beginWrite()
+	}
+	defer h.endWrite()
+
+	h.writeRejected = false
+	if err := handler.handle(h, userCommand); err != nil {
+		return err
+	}
+	h.propagate(userCommand, handler.write && !h.writeRejected)
+	return nil
+}
+
+// The single propagation point for write commands, they are appended to
+// the AOF and sent to the replicas.
+// The replication offset of a replica counts the bytes processed from its
+// master, they are forwarded verbatim to sub-replicas so every level of the
+// chain shares the same offsets
+func (h *Handler) propagate(userCommand *command.Command, write bool) {
+	if write {
+		h.db.AppendAOF(command.NewArray(userCommand.Args))
+	}
+	if h.masterLink {
+		h.cfg.Propagate(userCommand.Raw)
+		return
+	}
+	if !write || h.cfg.Role() != config.RoleMaster {
+		return
+	}
+	h.lastWriteOffset = h.cfg.Propagate(command.NewArray(userCommand.Args))
+}
+
+// Enters the write section, it lasts until the command was propagated
+func (h *Handler) beginWrite() {
+	if h.writeEnd == nil {
+		h.writeEnd = h.db.BeginWrite()
+	}
+}
+
+func (h *Handler) endWrite() {
+	if h.writeEnd != nil {
+		h.writeEnd()
+		h.writeEnd = nil
+	}
+}
+
+// Replies with an error to a write command, it is not propagated
+func (h *Handler) rejectWrite(message string) error {
+	h.writeRejected = true
+	h.WriteResponse(command.NewError(message))
+	return nil
 }
 
 func (h *Handler) sendGetAckToSlaves() {
-	wg := &sync.WaitGroup{}
-	command := command.NewArray([]string{"REPLCONF", "GETACK", "*"})
-	for _, slave := range h.cfg.Slaves() {
-		wg.Add(1)
-		go slave.PropagateCommand(command, wg)
-	}
-	wg.Wait()
-	h.UpdaterSlavesOffset(len([]byte(command)))
+	h.cfg.Propagate(command.NewArray([]string{"REPLCONF", "GETACK", "*"}))
+}
+
+// Replicas acknowledge their offset every second so the master can tell
+// how far behind they are, even without `REPLCONF GETACK`
+func (h *Handler) sendPeriodicAcks(stop chan struct{}) {
+	ticker := time.NewTicker(ackInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			h.writeLock.Lock()
+			h.writer.WriteString(command.NewArray([]string{
+				strings.ToUpper(command.Replconf),
+				strings.ToUpper(command.Ack),
+				strconv.Itoa(h.cfg.ReplOffset()),
+			}))
+			h.writer.Flush()
+			h.writeLock.Unlock()
+		}
+	}
 }
@@ -0,0 +1,337 @@
+package handler
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/command"
+	"github.com/codecrafters-io/redis-starter-go/rdb"
+)
+
+const (
+	// Cached connections unused for this long are closed by the cron
+	migrateIdleTimeout = 10 * time.Second
+	// Used when MIGRATE gets a timeout that is not positive
+	migrateDefaultTimeout = time.Second
+)
+
+// A cached connection to the target of MIGRATE. The lock is held while a
+// MIGRATE uses it, commands of two clients are never interleaved
+type migrateConn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	writer  *bufio.Writer
+	lastUse time.Time
+	// Database selected on the target, new connections start on 0
+	db   int
+	lock *sync.Mutex
+}
+
+var (
+	migrateConns     = map[string]*migrateConn{}
+	migrateConnsLock = &sync.Mutex{}
+)
+
+// Returns the cached connection to addr, connecting when there is none.
+// The connection is returned locked
+func getMigrateConn(addr string, timeout time.Duration) (*migrateConn, bool, error) {
+	migrateConnsLock.Lock()
+	cached, exist := migrateConns[addr]
+	migrateConnsLock.Unlock()
+	if exist {
+		cached.lock.Lock()
+		return cached, true, nil
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Another client may have connected to the same target meanwhile, its
+	// connection is kept and this one closed
+	migrateConnsLock.Lock()
+	if cached, exist := migrateConns[addr]; exist {
+		migrateConnsLock.Unlock()
+		conn.Close()
+		cached.lock.Lock()
+		return cached, true, nil
+	}
+	cached = &migrateConn{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		writer: bufio.NewWriter(conn),
+		lock:   &sync.Mutex{},
+	}
+	cached.lock.Lock()
+	migrateConns[addr] = cached
+	migrateConnsLock.Unlock()
+	return cached, false, nil
+}
+
+// Forgets the connection after an error, the next MIGRATE reconnects
+func closeMigrateConn(addr string, cached *migrateConn) {
+	migrateConnsLock.Lock()
+	if migrateConns[addr] == cached {
+		delete(migrateConns, addr)
+	}
+	migrateConnsLock.Unlock()
+	cached.conn.Close()
+}
+
+// CloseIdleMigrateConnections closes the cached MIGRATE connections that
+// were not used recently
+func CloseIdleMigrateConnections() {
+	migrateConnsLock.Lock()
+	defer migrateConnsLock.Unlock()
+
+	for addr, cached := range migrateConns {
+		if !cached.lock.TryLock() {
+			continue
+		}
+		if time.Since(cached.lastUse) > migrateIdleTimeout {
+			cached.conn.Close()
+			delete(migrateConns, addr)
+		}
+		cached.lock.Unlock()
+	}
+}
+
+// Keys of MIGRATE, the key argument or the ones after the KEYS option
+func migrateKeys(args []string) []string {
+	if len(args) < 6 {
+		return nil
+	}
+	for i := 6; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case command.Auth:
+			i++
+		case command.Auth2:
+			i += 2
+		case command.Keys:
+			return args[i+1:]
+		}
+	}
+	return []string{args[3]}
+}
+
+// MIGRATE host port key|"" destination-db timeout [COPY] [REPLACE]
+// [AUTH password] [AUTH2 username password] [KEYS key [key ...]]
+// The keys are sent with RESTORE and deleted locally once the target
+// accepted them, the command is propagated as a DEL of the moved keys
+func handleMigrate(h *Handler, userCommand *command.Command) error {
+	args := userCommand.Args
+	if len(args) < 6 {
+		return fmt.Errorf("%s command requires host, port, key, destination-db and timeout arguments",
+			strings.ToUpper(command.Migrate))
+	}
+
+	db, err := strconv.Atoi(args[4])
+	if err != nil {
+		return h.rejectWrite("ERR value is not an integer or out of range")
+	}
+	timeoutMs, err := strconv.Atoi(args[5])
+	if err != nil {
+		return h.rejectWrite("ERR value is not an integer or out of range")
+	}
+	timeout := migrateDefaultTimeout
+	if timeoutMs > 0 {
+		timeout = time.Duration(timeoutMs) * time.Millisecond
+	}
+
+	copyKeys, replace := false, false
+	auth := []string{}
+	keys := []string{args[3]}
+	for i := 6; i < len(args); i++ {
+		option := strings.ToLower(args[i])
+		switch {
+		case option == command.Copy:
+			copyKeys = true
+		case option == command.Replace:
+			replace = true
+		case option == command.Auth && i+1 < len(args):
+			auth = []string{strings.ToUpper(command.Auth), args[i+1]}
+			i++
+		case option == command.Auth2 && i+2 < len(args):
+			auth = []string{strings.ToUpper(command.Auth), args[i+1], args[i+2]}
+			i += 2
+		case option == command.Keys:
+			if args[3] != "" {
+				return h.rejectWrite("ERR When using MIGRATE KEYS option, the key argument must be set to the empty string")
+			}
+			keys = args[i+1:]
+			i = len(args)
+		default:
+			return h.rejectWrite("ERR syntax error")
+		}
+	}
+
+	// Keys that don't exist are skipped. The entries are read and sent
+	// outside the write section, it is only entered to delete the moved keys
+	entries := []rdb.Entry{}
+	for _, key := range keys {
+		if entry, exist := h.db.GetEntry(key); exist {
+			entries = append(entries, entry)
+		}
+	}
+	if len(entries) == 0 {
+		h.writeRejected = true
+		h.WriteResponse(command.NewString("NOKEY"))
+		return nil
+	}
+
+	addr := net.JoinHostPort(args[1], args[2])
+	accepted, err := migrateEntries(h, addr, db, timeout, auth, entries, replace)
+
+	// MIGRATE only changed the dataset when keys were moved
+	if len(accepted) > 0 && !copyKeys {
+		h.beginWrite()
+		h.db.Delete(accepted...)
+		userCommand.Args = append([]string{strings.ToUpper(command.Del)}, accepted...)
+	} else {
+		h.writeRejected = true
+	}
+
+	var replyErr command.ReplyError
+	switch {
+	case errors.As(err, &replyErr):
+		h.WriteResponse(command.NewError("ERR Target instance replied with error: " + replyErr.Error()))
+	case err != nil:
+		h.WriteResponse(command.NewError("IOERR error or timeout reading to target instance"))
+	default:
+		h.WriteResponse(command.Ok)
+	}
+	return nil
+}
+
+// Sends the entries to the target and returns the keys it accepted.
+// A cached connection may have been closed by the target meanwhile, so a
+// failure that is not a timeout is retried once on a new connection as long
+// as no key was accepted
+func migrateEntries(h *Handler, addr string, db int, timeout time.Duration, auth []string,
+	entries []rdb.Entry, replace bool) ([]string, error) {
+	for retry := true; ; retry = false {
+		cached, reused, err := getMigrateConn(addr, timeout)
+		if err != nil {
+			return nil, err
+		}
+
+		accepted, err := cached.migrate(h, db, timeout, auth, entries, replace)
+		cached.lastUse = time.Now()
+		cached.lock.Unlock()
+
+		var replyErr command.ReplyError
+		if err == nil || errors.As(err, &replyErr) {
+			return accepted, err
+		}
+		closeMigrateConn(addr, cached)
+		if !retry || !reused || len(accepted) > 0 || errors.Is(err, os.ErrDeadlineExceeded) {
+			return accepted, err
+		}
+	}
+}
+
+// AUTH and SELECT are sent first and the keys only once they succeeded,
+// then all the RESTORE commands are written before reading their replies.
+// The error is a ReplyError when the target refused a command, other
+// errors are I/O errors
+func (m *migrateConn) migrate(h *Handler, db int, timeout time.Duration, auth []string,
+	entries []rdb.Entry, replace bool) ([]string, error) {
+	m.conn.SetDeadline(time.Now().Add(timeout))
+	defer m.conn.SetDeadline(time.Time{})
+
+	setup := [][]string{}
+	if len(auth) > 0 {
+		setup = append(setup, auth)
+	}
+	if db != m.db {
+		setup = append(setup, []string{strings.ToUpper(command.Select), strconv.Itoa(db)})
+	}
+	if len(setup) > 0 {
+		if err := m.send(setup); err != nil {
+			return nil, err
+		}
+		for i := range setup {
+			if _, err := command.ReadReply(m.reader); err != nil {
+				return nil, drainReplies(m.reader, len(setup)-i-1, err)
+			}
+		}
+		m.db = db
+	}
+
+	// In cluster mode the target is importing the slot of the keys
+	restoreCommand := command.Restore
+	if h.cfg.Cluster() != nil {
+		restoreCommand = command.RestoreAsking
+	}
+
+	commands := [][]string{}
+	now := time.Now().UnixMilli()
+	for _, entry := range entries {
+		payload, err := rdb.Dump(entry.Value)
+		if err != nil {
+			return nil, err
+		}
+		// A TTL of 0 means the key doesn't expire
+		ttl := int64(0)
+		if entry.ExpireAt != 0 {
+			ttl = max(entry.ExpireAt-now, 1)
+		}
+
+		restore := []string{strings.ToUpper(restoreCommand), entry.Key, strconv.FormatInt(ttl, 10), string(payload)}
+		if replace {
+			restore = append(restore, strings.ToUpper(command.Replace))
+		}
+		commands = append(commands, restore)
+	}
+	if err := m.send(commands); err != nil {
+		return nil, err
+	}
+
+	// The first error of a RESTORE is reported once all the replies were read
+	accepted := []string{}
+	var firstErr error
+	for _, entry := range entries {
+		_, err := command.ReadReply(m.reader)
+		var replyErr command.ReplyError
+		if err != nil && !errors.As(err, &replyErr) {
+			return accepted, err
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		accepted = append(accepted, entry.Key)
+	}
+	return accepted, firstErr
+}
+
+func (m *migrateConn) send(commands [][]string) error {
+	for _, args := range commands {
+		m.writer.WriteString(command.NewArray(args))
+	}
+	return m.writer.Flush()
+}
+
+// Reads the replies left in the pipeline after a failure so the
+// connection can be used again, err is returned unless reading failed
+func drainReplies(reader *bufio.Reader, count int, err error) error {
+	for i := 0; i < count; i++ {
+		if _, readErr := command.ReadReply(reader); readErr != nil {
+			var replyErr command.ReplyError
+			if !errors.As(readErr, &replyErr) {
+				return readErr
+			}
+		}
+	}
+	return err
+}
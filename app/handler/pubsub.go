@@ -0,0 +1,121 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/codecrafters-io/redis-starter-go/app/command"
+)
+
+// Clients subscribed to every channel
+var (
+	channels     = map[string]map[*Handler]bool{}
+	channelsLock = &sync.Mutex{}
+)
+
+// SUBSCRIBE channel [channel ...]
+func handleSubscribe(h *Handler, userCommand *command.Command) error {
+	if len(userCommand.Args) < 2 {
+		return fmt.Errorf("%s command requires a channel", strings.ToUpper(command.Subscribe))
+	}
+
+	if h.subscriptions == nil {
+		h.subscriptions = map[string]bool{}
+	}
+
+	channelsLock.Lock()
+	defer channelsLock.Unlock()
+	for _, channel := range userCommand.Args[1:] {
+		if !h.subscriptions[channel] {
+			h.subscriptions[channel] = true
+			if channels[channel] == nil {
+				channels[channel] = map[*Handler]bool{}
+			}
+			channels[channel][h] = true
+		}
+		h.WriteResponse(pubsubReply(command.Subscribe, channel, len(h.subscriptions)))
+	}
+	return nil
+}
+
+// UNSUBSCRIBE [channel ...], without channels the client leaves all of them
+func handleUnsubscribe(h *Handler, userCommand *command.Command) error {
+	channelsLock.Lock()
+	defer channelsLock.Unlock()
+
+	unsubscribed := userCommand.Args[1:]
+	if len(unsubscribed) == 0 {
+		for channel := range h.subscriptions {
+			unsubscribed = append(unsubscribed, channel)
+		}
+		if len(unsubscribed) == 0 {
+			h.WriteResponse(command.NewNestedArray([]string{command.NewBulkString(command.Unsubscribe), command.Null, command.NewInteger(0)}))
+			return nil
+		}
+	}
+
+	for _, channel := range unsubscribed {
+		h.unsubscribe(channel)
+		h.WriteResponse(pubsubReply(command.Unsubscribe, channel, len(h.subscriptions)))
+	}
+	return nil
+}
+
+// PUBLISH channel message, replies with the number of clients that got it
+func handlePublish(h *Handler, userCommand *command.Command) error {
+	if len(userCommand.Args) != 3 {
+		return fmt.Errorf("%s command requires a channel and a message", strings.ToUpper(command.Publish))
+	}
+	channel, message := userCommand.Args[1], userCommand.Args[2]
+
+	// Subscribers are written to without channelsLock, they may be taking
+	// it while holding their own write lock
+	channelsLock.Lock()
+	subscribers := make([]*Handler, 0, len(channels[channel]))
+	for subscriber := range channels[channel] {
+		subscribers = append(subscribers, subscriber)
+	}
+	channelsLock.Unlock()
+
+	reply := command.NewArray([]string{command.Message, channel, message})
+	for _, subscriber := range subscribers {
+		subscriber.deliver(reply)
+	}
+	h.WriteResponse(command.NewInteger(len(subscribers)))
+	return nil
+}
+
+func pubsubReply(kind, channel string, subscriptions int) string {
+	return command.NewNestedArray([]string{
+		command.NewBulkString(kind),
+		command.NewBulkString(channel),
+		command.NewInteger(subscriptions),
+	})
+}
+
+// Removes the client from a channel. Requires channelsLock
+func (h *Handler) unsubscribe(channel string) {
+	delete(h.subscriptions, channel)
+	delete(channels[channel], h)
+	if len(channels[channel]) == 0 {
+		delete(channels, channel)
+	}
+}
+
+// Leaves all the channels once the client is gone
+func (h *Handler) unsubscribeAll() {
+	channelsLock.Lock()
+	defer channelsLock.Unlock()
+	for channel := range h.subscriptions {
+		h.unsubscribe(channel)
+	}
+}
+
+// Writes a published message to a subscribed client
+func (h *Handler) deliver(message string) {
+	h.writeLock.Lock()
+	defer h.writeLock.Unlock()
+	h.writer.WriteString(message)
+	h.writer.Flush()
+}
@@ -4,36 +4,81 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"regexp"
+	"strconv"
 	"strings"
+	"syscall"
 
+	"github.com/codecrafters-io/redis-starter-go/app/handler"
+	"github.com/codecrafters-io/redis-starter-go/app/sentinel"
 	"github.com/codecrafters-io/redis-starter-go/app/server"
 	"github.com/codecrafters-io/redis-starter-go/app/server/config"
 	"github.com/codecrafters-io/redis-starter-go/app/storage"
 )
 
 var (
-	portMatch        = regexp.MustCompile(`--port\s+\d+`)
-	replicaMatch     = regexp.MustCompile(`--replicaof\s+.+\s\d+`)
-	rdbFileDirMatch  = regexp.MustCompile(`--dir\s+[^\s]+`)
-	rdbFileNameMatch = regexp.MustCompile(`--dbfilename\s+[^\s]+`)
+	portMatch          = regexp.MustCompile(`--port\s+\d+`)
+	replicaMatch       = regexp.MustCompile(`--replicaof\s+.+\s\d+`)
+	rdbFileDirMatch    = regexp.MustCompile(`--dir\s+[^\s]+`)
+	rdbFileNameMatch   = regexp.MustCompile(`--dbfilename\s+[^\s]+`)
+	readOnlyMatch      = regexp.MustCompile(`--replica-read-only\s+(yes|no)`)
+	staleDataMatch     = regexp.MustCompile(`--replica-serve-stale-data\s+(yes|no)`)
+	minReplicasMatch   = regexp.MustCompile(`--min-replicas-to-write\s+(\d+)`)
+	maxLagMatch        = regexp.MustCompile(`--min-replicas-max-lag\s+(\d+)`)
+	saveRulesMatch     = regexp.MustCompile(`--save((?:\s+\d+\s+\d+)*)`)
+	disklessMatch      = regexp.MustCompile(`--repl-diskless-sync\s+(yes|no)`)
+	disklessDelayMatch = regexp.MustCompile(`--repl-diskless-sync-delay\s+(\d+)`)
+	replicaLimitMatch  = regexp.MustCompile(`--client-output-buffer-limit\s+(?:replica|slave)\s+\S+\s+\S+\s+\d+`)
+	appendOnlyMatch    = regexp.MustCompile(`--appendonly\s+(yes|no)`)
+	appendFileMatch    = regexp.MustCompile(`--appendfilename\s+([^\s]+)`)
+	appendFsyncMatch   = regexp.MustCompile(`--appendfsync\s+(always|everysec|no)`)
+	loadTruncatedMatch = regexp.MustCompile(`--aof-load-truncated\s+(yes|no)`)
+	appendDirMatch     = regexp.MustCompile(`--appenddirname\s+([^\s]+)`)
+	rdbPreambleMatch   = regexp.MustCompile(`--aof-use-rdb-preamble\s+(yes|no)`)
+	rewritePercMatch   = regexp.MustCompile(`--auto-aof-rewrite-percentage\s+(\d+)`)
+	rewriteMinMatch    = regexp.MustCompile(`--auto-aof-rewrite-min-size\s+(\S+)`)
+	clusterMatch       = regexp.MustCompile(`--cluster-enabled\s+(yes|no)`)
+	clusterFileMatch   = regexp.MustCompile(`--cluster-config-file\s+([^\s]+)`)
+	nodeTimeoutMatch   = regexp.MustCompile(`--cluster-node-timeout\s+(\d+)`)
+	sentinelMatch      = regexp.MustCompile(`--sentinel(\s|$)`)
+	monitorMatch       = regexp.MustCompile(`--sentinel\s+monitor\s+(\S+)\s+(\S+)\s+(\d+)\s+(\d+)`)
+	sentinelSetMatch   = regexp.MustCompile(`--sentinel\s+(down-after-milliseconds|failover-timeout)\s+(\S+)\s+(\d+)`)
 )
 
 func main() {
 	log.Println("Logs from your program will appear here!")
 
+	if sentinelMatch.MatchString(strings.Join(os.Args[1:], " ")) {
+		startSentinel()
+		return
+	}
+
 	cmdOptions := setServerOptions()
 
 	cfg := config.NewConfig(cmdOptions...)
 	db := storage.NewStorage()
 
-	log.Println("searching for rdb file to load data...")
-	err := db.ReadRDBFile(cfg.RDBFilePath())
-	if err != nil {
-		log.Printf("Error: %s\n failed to read rdb file, starting the server with empty data...\n", err.Error())
+	if cfg.Cluster() != nil {
+		if err := cfg.Cluster().LoadConfig(); err != nil {
+			log.Printf("failed to load the cluster config: %s\n", err.Error())
+			os.Exit(1)
+		}
+		db.IndexSlots()
+	}
+
+	if cfg.AppendOnly() {
+		loadAppendOnlyFile(cfg, db)
+	} else {
+		log.Println("searching for rdb file to load data...")
+		err := db.ReadRDBFile(cfg.RDBFilePath())
+		if err != nil {
+			log.Printf("Error: %s\n failed to read rdb file, starting the server with empty data...\n", err.Error())
+		}
 	}
 
 	server := server.NewServer(cfg, db)
+	go saveOnShutdown(cfg, db)
 
 	if cfg.Role() == config.RoleSlave {
 		if err := server.Handshake(); err != nil {
@@ -48,6 +93,73 @@ func main() {
 	}
 }
 
+// Runs the binary as a sentinel monitoring the masters given with
+// `--sentinel monitor <name> <ip> <port> <quorum>`, it doesn't hold any data
+func startSentinel() {
+	cmdOptions := strings.Join(os.Args[1:], " ")
+	port := sentinel.DefaultPort
+	if params := portMatch.FindStringSubmatch(cmdOptions); len(params) == 1 {
+		port = strings.Split(params[0], " ")[1]
+	}
+	s := sentinel.NewSentinel(port)
+
+	for _, params := range monitorMatch.FindAllStringSubmatch(cmdOptions, -1) {
+		masterPort, _ := strconv.Atoi(params[3])
+		quorum, _ := strconv.Atoi(params[4])
+		if err := s.Monitor(params[1], params[2], masterPort, quorum); err != nil {
+			log.Printf("failed to monitor %s: %s\n", params[1], err.Error())
+			os.Exit(1)
+		}
+	}
+
+	for _, params := range sentinelSetMatch.FindAllStringSubmatch(cmdOptions, -1) {
+		if err := s.Set(params[2], params[1], params[3]); err != nil {
+			log.Printf("invalid sentinel %s: %s\n", params[1], err.Error())
+			os.Exit(1)
+		}
+	}
+
+	if err := s.Start(); err != nil {
+		log.Printf("failed to start the sentinel: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+// The AOF has the most recent data, so it's loaded instead of the RDB file.
+// Unlike a missing RDB file, a corrupted AOF stops the server
+func loadAppendOnlyFile(cfg *config.Config, db *storage.Storage) {
+	log.Println("loading the append only file...")
+	if err := handler.LoadAOF(db, cfg); err != nil {
+		log.Printf("failed to load the append only file: %s\n", err.Error())
+		os.Exit(1)
+	}
+	if err := handler.StartAOF(db, cfg); err != nil {
+		log.Printf("failed to open the append only file: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+// Saves the dataset before exiting on SIGINT or SIGTERM, if snapshotting is enabled
+func saveOnShutdown(cfg *config.Config, db *storage.Storage) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+
+	if err := db.CloseAOF(); err != nil {
+		log.Printf("failed to sync the append only file: %s\n", err.Error())
+	}
+	if len(cfg.SaveRules()) == 0 {
+		os.Exit(0)
+	}
+
+	log.Println("received shutdown signal, saving the dataset...")
+	if err := db.SaveAfterBackgroundSave(cfg.RDBFilePath()); err != nil {
+		log.Printf("failed to save the RDB file: %s\n", err.Error())
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
 // Looks for cmdOptions passed by the user to start the server
 func setServerOptions() []config.Option {
 	var options []config.Option
@@ -74,5 +186,98 @@ func setServerOptions() []config.Option {
 		options = append(options, config.WithRDBFileName(rdbFileName))
 	}
 
+	if params := readOnlyMatch.FindStringSubmatch(cmdOptions); len(params) == 2 {
+		options = append(options, config.WithReplicaReadOnly(params[1] == "yes"))
+	}
+
+	if params := staleDataMatch.FindStringSubmatch(cmdOptions); len(params) == 2 {
+		options = append(options, config.WithServeStaleData(params[1] == "yes"))
+	}
+
+	if params := minReplicasMatch.FindStringSubmatch(cmdOptions); len(params) == 2 {
+		replicas, _ := strconv.Atoi(params[1])
+		options = append(options, config.WithMinReplicasToWrite(replicas))
+	}
+
+	if params := maxLagMatch.FindStringSubmatch(cmdOptions); len(params) == 2 {
+		seconds, _ := strconv.Atoi(params[1])
+		options = append(options, config.WithMinReplicasMaxLag(seconds))
+	}
+
+	if params := saveRulesMatch.FindStringSubmatch(cmdOptions); len(params) == 2 {
+		rules, _ := config.ParseSaveRules(params[1])
+		options = append(options, config.WithSaveRules(rules))
+	}
+
+	if params := disklessMatch.FindStringSubmatch(cmdOptions); len(params) == 2 {
+		options = append(options, config.WithDisklessSync(params[1] == "yes"))
+	}
+
+	if params := disklessDelayMatch.FindStringSubmatch(cmdOptions); len(params) == 2 {
+		seconds, _ := strconv.Atoi(params[1])
+		options = append(options, config.WithDisklessSyncDelay(seconds))
+	}
+
+	if params := replicaLimitMatch.FindStringSubmatch(cmdOptions); len(params) == 1 {
+		data := strings.Fields(params[0])[2:]
+		limits, err := config.ParseOutputBufferLimits(data[0], data[1], data[2])
+		if err != nil {
+			log.Printf("invalid client-output-buffer-limit: %s\n", err.Error())
+		} else {
+			options = append(options, config.WithReplicaOutputLimits(limits))
+		}
+	}
+
+	if params := appendOnlyMatch.FindStringSubmatch(cmdOptions); len(params) == 2 {
+		options = append(options, config.WithAppendOnly(params[1] == "yes"))
+	}
+
+	if params := appendFileMatch.FindStringSubmatch(cmdOptions); len(params) == 2 {
+		options = append(options, config.WithAppendFileName(params[1]))
+	}
+
+	if params := appendFsyncMatch.FindStringSubmatch(cmdOptions); len(params) == 2 {
+		options = append(options, config.WithAppendFsync(params[1]))
+	}
+
+	if params := loadTruncatedMatch.FindStringSubmatch(cmdOptions); len(params) == 2 {
+		options = append(options, config.WithAOFLoadTruncated(params[1] == "yes"))
+	}
+
+	if params := appendDirMatch.FindStringSubmatch(cmdOptions); len(params) == 2 {
+		options = append(options, config.WithAppendDirName(params[1]))
+	}
+
+	if params := rdbPreambleMatch.FindStringSubmatch(cmdOptions); len(params) == 2 {
+		options = append(options, config.WithAOFRDBPreamble(params[1] == "yes"))
+	}
+
+	if params := rewritePercMatch.FindStringSubmatch(cmdOptions); len(params) == 2 {
+		percentage, _ := strconv.Atoi(params[1])
+		options = append(options, config.WithAOFRewritePercentage(percentage))
+	}
+
+	if params := rewriteMinMatch.FindStringSubmatch(cmdOptions); len(params) == 2 {
+		size, err := config.ParseMemory(params[1])
+		if err != nil {
+			log.Printf("invalid auto-aof-rewrite-min-size: %s\n", err.Error())
+		} else {
+			options = append(options, config.WithAOFRewriteMinSize(size))
+		}
+	}
+
+	if params := clusterMatch.FindStringSubmatch(cmdOptions); len(params) == 2 {
+		options = append(options, config.WithClusterEnabled(params[1] == "yes"))
+	}
+
+	if params := clusterFileMatch.FindStringSubmatch(cmdOptions); len(params) == 2 {
+		options = append(options, config.WithClusterConfigFile(params[1]))
+	}
+
+	if params := nodeTimeoutMatch.FindStringSubmatch(cmdOptions); len(params) == 2 {
+		timeout, _ := strconv.Atoi(params[1])
+		options = append(options, config.WithClusterNodeTimeout(timeout))
+	}
+
 	return options
 }
@@ -0,0 +1,323 @@
+package sentinel
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/command"
+)
+
+const (
+	nullArray         = "*-1\r\n"
+	noSuchMasterError = "ERR No such master with that name"
+)
+
+// Serves the clients looking for the masters and the other sentinels
+func (s *Sentinel) serveClient(conn net.Conn) {
+	defer conn.Close()
+	reader, writer := bufio.NewReader(conn), bufio.NewWriter(conn)
+
+	for {
+		userCommand, err := command.NewCommand(reader)
+		if err != nil {
+			return
+		}
+		if len(userCommand.Args) == 0 {
+			continue
+		}
+		writer.WriteString(s.handleCommand(userCommand.Args))
+		writer.Flush()
+	}
+}
+
+func (s *Sentinel) handleCommand(args []string) string {
+	switch strings.ToLower(args[0]) {
+	case command.Ping:
+		return command.Pong
+	case command.Info:
+		return command.NewBulkString(s.info())
+	case command.Sentinel:
+		if len(args) < 2 {
+			return wrongArity(args[0])
+		}
+		return s.handleSentinel(strings.ToLower(args[1]), args[2:])
+	}
+	return command.NewError(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+}
+
+func (s *Sentinel) handleSentinel(subcommand string, args []string) string {
+	switch subcommand {
+	case command.Myid:
+		return command.NewBulkString(s.runID)
+	case command.Masters:
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		replies := []string{}
+		for _, name := range s.masterNames() {
+			replies = append(replies, command.NewArray(s.describeMaster(s.masters[name])))
+		}
+		return command.NewNestedArray(replies)
+	case command.Monitor:
+		if len(args) != 4 {
+			return wrongArity(command.Sentinel + " " + subcommand)
+		}
+		port, err := strconv.Atoi(args[2])
+		if err != nil {
+			return command.NewError("ERR Invalid port number")
+		}
+		quorum, err := strconv.Atoi(args[3])
+		if err != nil {
+			return command.NewError("ERR Invalid quorum")
+		}
+		if err := s.Monitor(args[0], args[1], port, quorum); err != nil {
+			return command.NewError("ERR " + err.Error())
+		}
+		return command.Ok
+	case command.Set:
+		if len(args) < 3 || len(args)%2 == 0 {
+			return wrongArity(command.Sentinel + " " + subcommand)
+		}
+		for i := 1; i < len(args); i += 2 {
+			if err := s.Set(args[0], strings.ToLower(args[i]), args[i+1]); err != nil {
+				return command.NewError("ERR " + err.Error())
+			}
+		}
+		return command.Ok
+	case command.Remove:
+		if len(args) != 1 {
+			return wrongArity(command.Sentinel + " " + subcommand)
+		}
+		if err := s.Remove(args[0]); err != nil {
+			return command.NewError("ERR " + err.Error())
+		}
+		return command.Ok
+	case command.IsMasterDownByAddr:
+		if len(args) != 4 {
+			return wrongArity(command.Sentinel + " " + subcommand)
+		}
+		return s.isMasterDownByAddr(args)
+	}
+
+	// The other subcommands are about a single master
+	if len(args) != 1 {
+		return wrongArity(command.Sentinel + " " + subcommand)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	m := s.masters[args[0]]
+
+	switch subcommand {
+	case command.GetMasterAddrByName:
+		if m == nil {
+			return nullArray
+		}
+		host, port := m.currentAddr()
+		return command.NewArray([]string{host, strconv.Itoa(port)})
+	case command.Master, command.Replicas, command.Slaves, command.Sentinels, command.Failover:
+		if m == nil {
+			return command.NewError(noSuchMasterError)
+		}
+	default:
+		return command.NewError(fmt.Sprintf("ERR Unknown sentinel subcommand '%s'", subcommand))
+	}
+
+	switch subcommand {
+	case command.Master:
+		return command.NewArray(s.describeMaster(m))
+	case command.Replicas, command.Slaves:
+		replies := []string{}
+		for _, addr := range sortedKeys(m.replicas) {
+			replies = append(replies, command.NewArray(describeReplica(m.replicas[addr])))
+		}
+		return command.NewNestedArray(replies)
+	case command.Sentinels:
+		replies := []string{}
+		for _, runID := range sortedKeys(m.sentinels) {
+			replies = append(replies, command.NewArray(describeSentinel(m.sentinels[runID])))
+		}
+		return command.NewNestedArray(replies)
+	default:
+		return s.forceFailover(m)
+	}
+}
+
+// Replies `<down> <leader> <leader_epoch>` about the master at an address.
+// A run ID instead of `*` asks this sentinel to vote for that sentinel
+func (s *Sentinel) isMasterDownByAddr(args []string) string {
+	port, err := strconv.Atoi(args[1])
+	if err != nil {
+		return command.NewError("ERR Invalid port number")
+	}
+	epoch, err := strconv.ParseUint(args[2], 10, 64)
+	if err != nil {
+		return command.NewError("ERR Invalid epoch")
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var m *master
+	for _, candidate := range s.masters {
+		if candidate.host == args[0] && candidate.port == port {
+			m = candidate
+		}
+	}
+	down, leader, leaderEpoch := 0, "*", uint64(0)
+	if m != nil && !m.sdownSince.IsZero() {
+		down = 1
+	}
+	if m != nil && args[3] != "*" {
+		leader = s.voteLeader(m, epoch, args[3], time.Now())
+		leaderEpoch = m.leaderEpoch
+	}
+	return command.NewNestedArray([]string{
+		command.NewInteger(down),
+		command.NewBulkString(leader),
+		command.NewInteger(int(leaderEpoch)),
+	})
+}
+
+// Starts a failover as if the master was down, without the agreement of
+// the other sentinels
+func (s *Sentinel) forceFailover(m *master) string {
+	now := time.Now()
+	if m.failoverState != failoverNone {
+		return command.NewError("INPROG Failover already in progress")
+	}
+	if s.selectReplica(m, now) == nil {
+		return command.NewError("NOGOODSLAVE No suitable replica to promote")
+	}
+	m.forceFailover = true
+	s.startFailover(m, now)
+	return command.Ok
+}
+
+func (s *Sentinel) masterNames() []string {
+	names := []string{}
+	for name := range s.masters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Field and value pairs of SENTINEL MASTER
+func (s *Sentinel) describeMaster(m *master) []string {
+	flags := []string{kindMaster}
+	if !m.sdownSince.IsZero() {
+		flags = append(flags, "s_down")
+	}
+	if !m.odownSince.IsZero() {
+		flags = append(flags, "o_down")
+	}
+	if m.failoverState != failoverNone {
+		flags = append(flags, "failover_in_progress")
+	}
+	return append(describeInstance(m.instance, m.name, flags),
+		"config-epoch", strconv.FormatUint(m.configEpoch, 10),
+		"num-slaves", strconv.Itoa(len(m.replicas)),
+		"num-other-sentinels", strconv.Itoa(len(m.sentinels)),
+		"quorum", strconv.Itoa(m.quorum),
+		"down-after-milliseconds", strconv.FormatInt(m.downAfter.Milliseconds(), 10),
+		"failover-timeout", strconv.FormatInt(m.failoverTimeout.Milliseconds(), 10),
+		"failover-state", failoverStateNames[m.failoverState],
+	)
+}
+
+func describeReplica(replica *instance) []string {
+	flags := []string{kindSlave}
+	if !replica.sdownSince.IsZero() {
+		flags = append(flags, "s_down")
+	}
+	linkStatus := "err"
+	if replica.masterLinkUp {
+		linkStatus = "ok"
+	}
+	return append(describeInstance(replica, replica.addr(), flags),
+		"master-link-status", linkStatus,
+		"master-host", replica.masterHost,
+		"master-port", strconv.Itoa(replica.masterPort),
+		"slave-repl-offset", strconv.Itoa(replica.replOffset),
+	)
+}
+
+func describeSentinel(peer *instance) []string {
+	flags := []string{kindSentinel}
+	if !peer.sdownSince.IsZero() {
+		flags = append(flags, "s_down")
+	}
+	return append(describeInstance(peer, peer.runID, flags),
+		"voted-leader", cmp.Or(peer.leader, "?"),
+		"voted-leader-epoch", strconv.FormatUint(peer.leaderEpoch, 10),
+	)
+}
+
+func describeInstance(inst *instance, name string, flags []string) []string {
+	return []string{
+		"name", name,
+		"ip", inst.host,
+		"port", strconv.Itoa(inst.port),
+		"runid", inst.runID,
+		"flags", strings.Join(flags, ","),
+		"last-ok-ping-reply", strconv.FormatInt(time.Since(inst.lastAvailable).Milliseconds(), 10),
+		"info-refresh", strconv.FormatInt(millisSince(inst.infoRefresh), 10),
+		"role-reported", cmp.Or(inst.role, inst.kind),
+	}
+}
+
+// The sentinel section of INFO
+func (s *Sentinel) info() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	info := []string{
+		"# Server",
+		"redis_mode:sentinel",
+		fmt.Sprintf("run_id:%s", s.runID),
+		fmt.Sprintf("tcp_port:%s", s.port),
+		"",
+		"# Sentinel",
+		fmt.Sprintf("sentinel_masters:%d", len(s.masters)),
+		fmt.Sprintf("sentinel_current_epoch:%d", s.currentEpoch),
+	}
+	for i, name := range s.masterNames() {
+		m := s.masters[name]
+		status := "ok"
+		if !m.odownSince.IsZero() {
+			status = "odown"
+		} else if !m.sdownSince.IsZero() {
+			status = "sdown"
+		}
+		host, port := m.currentAddr()
+		info = append(info, fmt.Sprintf("master%d:name=%s,status=%s,address=%s,slaves=%d,sentinels=%d",
+			i, name, status, net.JoinHostPort(host, strconv.Itoa(port)), len(m.replicas), len(m.sentinels)+1))
+	}
+	return strings.Join(info, "\n")
+}
+
+func wrongArity(name string) string {
+	return command.NewError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+}
+
+// Milliseconds since a time, -1 when it's zero
+func millisSince(t time.Time) int64 {
+	if t.IsZero() {
+		return -1
+	}
+	return time.Since(t).Milliseconds()
+}
+
+func sortedKeys(instances map[string]*instance) []string {
+	keys := []string{}
+	for key := range instances {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
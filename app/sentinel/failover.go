@@ -0,0 +1,308 @@
+package sentinel
+
+import (
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/command"
+)
+
+// States of a failover, in their order
+const (
+	failoverNone = iota
+	failoverWaitStart
+	failoverSelectSlave
+	failoverSendSlaveofNoOne
+	failoverWaitPromotion
+	failoverReconfSlaves
+)
+
+var failoverStateNames = []string{
+	"none",
+	"wait-start",
+	"select-slave",
+	"send-slaveof-noone",
+	"wait-promotion",
+	"reconf-slaves",
+}
+
+// An instance is subjectively down for this sentinel when it didn't reply
+// to the pings for down-after-milliseconds
+func (s *Sentinel) checkSubjectivelyDown(m *master, inst *instance, now time.Time) {
+	if now.Sub(inst.lastAvailable) > m.downAfter {
+		if inst.sdownSince.IsZero() {
+			inst.sdownSince = now
+			s.event("+sdown", m, inst, "")
+		}
+	} else if !inst.sdownSince.IsZero() {
+		inst.sdownSince = time.Time{}
+		s.event("-sdown", m, inst, "")
+	}
+}
+
+// A master is objectively down when the quorum of sentinels, this one
+// included, see it subjectively down
+func (s *Sentinel) checkObjectivelyDown(m *master, now time.Time) {
+	votes := 0
+	if !m.sdownSince.IsZero() {
+		votes++
+		for _, peer := range m.sentinels {
+			if peer.masterDown && now.Sub(peer.masterDownReply) < downReplyValidity {
+				votes++
+			}
+		}
+	}
+
+	if votes >= m.quorum && votes > 0 {
+		if m.odownSince.IsZero() {
+			m.odownSince = now
+			s.event("+odown", m, m.instance, "#quorum %d/%d", votes, m.quorum)
+		}
+	} else if !m.odownSince.IsZero() {
+		m.odownSince = time.Time{}
+		s.event("-odown", m, m.instance, "")
+	}
+}
+
+// Asks another sentinel whether it sees the master down. During a
+// failover the request is also a vote request for this sentinel
+func (s *Sentinel) askMasterState(m *master, peer *instance) request {
+	runID := "*"
+	if m.failoverState != failoverNone {
+		runID = s.runID
+	}
+	return request{
+		args: []string{
+			command.Sentinel, command.IsMasterDownByAddr,
+			m.host, strconv.Itoa(m.port), strconv.FormatUint(s.currentEpoch, 10), runID,
+		},
+		array: true,
+		done: func(replies []string, err error) {
+			if err != nil || len(replies) != 3 {
+				return
+			}
+			peer.masterDown = replies[0] == "1"
+			peer.masterDownReply = time.Now()
+			if replies[1] == "*" {
+				return
+			}
+			epoch, _ := strconv.ParseUint(replies[2], 10, 64)
+			if peer.leader != replies[1] || peer.leaderEpoch != epoch {
+				s.event("+vote-for-leader", m, peer, "%s %d", replies[1], epoch)
+			}
+			peer.leader, peer.leaderEpoch = replies[1], epoch
+		},
+	}
+}
+
+func (s *Sentinel) startFailoverIfNeeded(m *master, now time.Time) {
+	if m.odownSince.IsZero() || m.failoverState != failoverNone {
+		return
+	}
+	// Gives the time to finish to a failover voted for, or tried, recently
+	if now.Sub(m.failoverStart) < 2*m.failoverTimeout {
+		return
+	}
+	s.startFailover(m, now)
+}
+
+func (s *Sentinel) startFailover(m *master, now time.Time) {
+	s.currentEpoch++
+	m.failoverEpoch = s.currentEpoch
+	m.failoverStart = now.Add(randomDuration(maxDesync))
+	s.event("+new-epoch", nil, nil, "%d", s.currentEpoch)
+	s.event("+try-failover", m, m.instance, "")
+	s.setFailoverState(m, failoverWaitStart, now)
+	// The vote requests go out with the next cron run
+	for _, peer := range m.sentinels {
+		peer.lastAsk = time.Time{}
+	}
+}
+
+func (s *Sentinel) setFailoverState(m *master, state int, now time.Time) {
+	m.failoverState, m.failoverStateChange = state, now
+	if state != failoverNone {
+		s.event("+failover-state-"+failoverStateNames[state], m, m.instance, "")
+	}
+}
+
+func (s *Sentinel) abortFailover(m *master, now time.Time) {
+	m.forceFailover = false
+	m.promoted = nil
+	for _, replica := range m.replicas {
+		replica.reconfSent, replica.reconfDone = false, false
+	}
+	s.setFailoverState(m, failoverNone, now)
+}
+
+/*
+A failover goes through these states:
+  - wait-start: the sentinel waits to be elected leader for the epoch of
+    the failover, it gives up after the election timeout
+  - select-slave: it picks the replica to promote
+  - send-slaveof-noone: it sends REPLICAOF NO ONE to the replica
+  - wait-promotion: it waits for INFO to report the replica as a master
+  - reconf-slaves: it points the other replicas to the new master, then
+    switches to the new master and spreads its config with the hellos
+*/
+func (s *Sentinel) handleFailover(m *master, now time.Time) {
+	switch m.failoverState {
+	case failoverWaitStart:
+		leader := s.getLeader(m, m.failoverEpoch, now)
+		if leader != s.runID && !m.forceFailover {
+			if now.Sub(m.failoverStart) > min(electionTimeout, m.failoverTimeout) {
+				s.event("-failover-abort-not-elected", m, m.instance, "")
+				s.abortFailover(m, now)
+			}
+			return
+		}
+		s.event("+elected-leader", m, m.instance, "")
+		s.setFailoverState(m, failoverSelectSlave, now)
+	case failoverSelectSlave:
+		replica := s.selectReplica(m, now)
+		if replica == nil {
+			s.event("-failover-abort-no-good-slave", m, m.instance, "")
+			s.abortFailover(m, now)
+			return
+		}
+		s.event("+selected-slave", m, replica, "")
+		m.promoted = replica
+		s.setFailoverState(m, failoverSendSlaveofNoOne, now)
+	case failoverSendSlaveofNoOne:
+		if !m.promoted.sdownSince.IsZero() {
+			if now.Sub(m.failoverStateChange) > m.failoverTimeout {
+				s.event("-failover-abort-slave-timeout", m, m.instance, "")
+				s.abortFailover(m, now)
+			}
+			return
+		}
+		s.replicaOf(m, m.promoted, "", 0, nil)
+		s.setFailoverState(m, failoverWaitPromotion, now)
+	case failoverWaitPromotion:
+		if now.Sub(m.failoverStateChange) > m.failoverTimeout {
+			s.event("-failover-abort-slave-timeout", m, m.instance, "")
+			s.abortFailover(m, now)
+		}
+	case failoverReconfSlaves:
+		s.reconfigureReplicas(m, now)
+	}
+}
+
+// Counts the votes of the sentinels for the leader of the failover of an
+// epoch, this one voting for the most voted sentinel or for itself. The
+// leader needs the votes of the majority of the sentinels and the quorum
+func (s *Sentinel) getLeader(m *master, epoch uint64, now time.Time) string {
+	votes := map[string]int{}
+	for _, peer := range m.sentinels {
+		if peer.leader != "" && peer.leaderEpoch == epoch {
+			votes[peer.leader]++
+		}
+	}
+
+	candidate := mostVoted(votes)
+	if candidate == "" {
+		candidate = s.runID
+	}
+	if leader := s.voteLeader(m, epoch, candidate, now); leader != "" && m.leaderEpoch == epoch {
+		votes[leader]++
+	}
+
+	winner := mostVoted(votes)
+	voters := len(m.sentinels) + 1
+	if votes[winner] < max(voters/2+1, m.quorum) {
+		return ""
+	}
+	return winner
+}
+
+func mostVoted(votes map[string]int) string {
+	winner := ""
+	for runID, count := range votes {
+		if count > votes[winner] || count == votes[winner] && runID > winner {
+			winner = runID
+		}
+	}
+	return winner
+}
+
+// Votes for the leader of the failover of an epoch, a single time per
+// epoch. Returns the sentinel voted for
+func (s *Sentinel) voteLeader(m *master, epoch uint64, runID string, now time.Time) string {
+	if epoch > s.currentEpoch {
+		s.currentEpoch = epoch
+		s.event("+new-epoch", nil, nil, "%d", epoch)
+	}
+	if m.leaderEpoch < epoch && s.currentEpoch <= epoch {
+		m.leader, m.leaderEpoch = runID, s.currentEpoch
+		s.event("+vote-for-leader", nil, nil, "%s %d", runID, epoch)
+		// This sentinel won't start its own failover while the one it
+		// voted for is running
+		if runID != s.runID {
+			m.failoverStart = now.Add(randomDuration(maxDesync))
+		}
+	}
+	return m.leader
+}
+
+// Picks the replica to promote: the one with the largest replication
+// offset among the available replicas that replied to INFO recently
+func (s *Sentinel) selectReplica(m *master, now time.Time) *instance {
+	infoValidity := 3 * infoPeriod
+	if !m.sdownSince.IsZero() {
+		infoValidity = 5 * pingPeriod
+	}
+
+	var best *instance
+	for _, replica := range m.replicas {
+		if !replica.sdownSince.IsZero() || replica.role != kindSlave ||
+			now.Sub(replica.infoRefresh) > infoValidity || now.Sub(replica.lastAvailable) > 5*pingPeriod {
+			continue
+		}
+		if best == nil || replica.replOffset > best.replOffset ||
+			replica.replOffset == best.replOffset && replica.addr() < best.addr() {
+			best = replica
+		}
+	}
+	return best
+}
+
+// Points the other replicas to the promoted one, then switches to it once
+// they all accepted or the failover timed out. Replicas that are down are
+// fixed when they come back
+func (s *Sentinel) reconfigureReplicas(m *master, now time.Time) {
+	done := true
+	for _, replica := range m.replicas {
+		if replica == m.promoted || replica.reconfDone || !replica.sdownSince.IsZero() {
+			continue
+		}
+		done = false
+		if replica.reconfSent {
+			continue
+		}
+
+		replica.reconfSent = true
+		s.event("+slave-reconf-sent", m, replica, "")
+		s.replicaOf(m, replica, m.promoted.host, m.promoted.port, func(err error) {
+			if err != nil {
+				replica.reconfSent = false
+				return
+			}
+			replica.reconfDone = true
+			s.event("+slave-reconf-done", m, replica, "")
+		})
+	}
+
+	if !done && now.Sub(m.failoverStateChange) <= m.failoverTimeout {
+		return
+	}
+	if !done {
+		s.event("+failover-end-for-timeout", m, m.instance, "")
+	}
+	s.event("+failover-end", m, m.instance, "")
+	s.switchMaster(m, m.promoted.host, m.promoted.port)
+}
+
+func randomDuration(limit time.Duration) time.Duration {
+	return time.Duration(rand.Int63n(int64(limit)))
+}
@@ -0,0 +1,386 @@
+package sentinel
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/command"
+)
+
+// A subscription without any hello for this long is reconnected
+const helloTimeout = 5 * helloPeriod
+
+// A command sent to an instance, done is called with the lock held
+type request struct {
+	args []string
+	// The reply is an array instead of a single value
+	array bool
+	done  func(replies []string, err error)
+}
+
+// Connection to an instance used for the requests of the sentinel
+type link struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dial(addr string) (*link, error) {
+	conn, err := net.DialTimeout("tcp", addr, requestTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &link{conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+func (l *link) call(req request) ([]string, error) {
+	l.conn.SetDeadline(time.Now().Add(requestTimeout))
+	if _, err := l.conn.Write([]byte(command.NewArray(req.args))); err != nil {
+		return nil, err
+	}
+	if req.array {
+		return command.ReadArrayReply(l.reader)
+	}
+	reply, err := command.ReadReply(l.reader)
+	return []string{reply}, err
+}
+
+// Closes the connections of an instance that is no longer monitored, the
+// ones in use are closed once their requests are done
+func (i *instance) release() {
+	i.removed = true
+	if !i.busy && i.link != nil {
+		i.link.conn.Close()
+		i.link = nil
+	}
+}
+
+// Sends the periodic requests and the queued ones to an instance
+func (s *Sentinel) handleInstance(m *master, inst *instance, now time.Time) {
+	if inst.kind != kindSentinel && !inst.subscribed {
+		inst.subscribed = true
+		go s.subscribe(inst, inst.addr())
+	}
+	s.checkSubjectivelyDown(m, inst, now)
+	if inst.busy {
+		return
+	}
+
+	requests := inst.pending
+	inst.pending = nil
+	if now.Sub(inst.lastPing) >= pingPeriod {
+		inst.lastPing = now
+		requests = append(requests, request{
+			args: []string{command.Ping},
+			done: func(_ []string, err error) { s.pingReply(inst, err) },
+		})
+	}
+
+	if inst.kind == kindSentinel {
+		if !m.sdownSince.IsZero() && now.Sub(inst.lastAsk) >= askPeriod {
+			inst.lastAsk = now
+			requests = append(requests, s.askMasterState(m, inst))
+		}
+	} else {
+		period := infoPeriod
+		// Replicas are followed closely while a failover may happen
+		if inst.kind == kindSlave && (!m.sdownSince.IsZero() || m.failoverState != failoverNone) {
+			period = time.Second
+		}
+		if now.Sub(inst.lastInfo) >= period {
+			inst.lastInfo = now
+			requests = append(requests, request{
+				args: []string{command.Info, command.Replication},
+				done: func(replies []string, err error) {
+					if err == nil {
+						s.refreshInfo(m, inst, replies[0], time.Now())
+					}
+				},
+			})
+		}
+		if s.announceHost != "" && now.Sub(inst.lastHello) >= helloPeriod {
+			inst.lastHello = now
+			requests = append(requests, request{
+				args: []string{command.Publish, helloChannel, s.hello(m)},
+				done: func([]string, error) {},
+			})
+		}
+	}
+
+	if len(requests) == 0 {
+		return
+	}
+	inst.busy = true
+	go s.run(inst, inst.addr(), requests)
+}
+
+// Runs requests on the link of an instance, dialing it if needed. Once
+// the connection fails the remaining requests fail with the same error
+func (s *Sentinel) run(inst *instance, addr string, requests []request) {
+	replies := make([][]string, len(requests))
+	errs := make([]error, len(requests))
+	var linkErr error
+	if inst.link == nil {
+		inst.link, linkErr = dial(addr)
+	}
+	for i, req := range requests {
+		if linkErr != nil {
+			errs[i] = linkErr
+			continue
+		}
+		replies[i], errs[i] = inst.link.call(req)
+		var replyErr command.ReplyError
+		if errs[i] != nil && !errors.As(errs[i], &replyErr) {
+			linkErr = errs[i]
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if inst.link != nil && s.announceHost == "" {
+		s.announceHost, _, _ = net.SplitHostPort(inst.link.conn.LocalAddr().String())
+	}
+	if inst.link != nil && (linkErr != nil || inst.removed) {
+		inst.link.conn.Close()
+		inst.link = nil
+	}
+	inst.busy = false
+	if inst.removed {
+		return
+	}
+	for i, req := range requests {
+		req.done(replies[i], errs[i])
+	}
+}
+
+// Replies other than PONG still show the instance is up
+func (s *Sentinel) pingReply(inst *instance, err error) {
+	if err == nil || strings.HasPrefix(err.Error(), "LOADING") || strings.HasPrefix(err.Error(), "MASTERDOWN") {
+		inst.lastAvailable = time.Now()
+	}
+}
+
+// Queues REPLICAOF on an instance, done is called with its result
+func (s *Sentinel) replicaOf(m *master, inst *instance, host string, port int, done func(err error)) {
+	args := []string{command.Replicaof, host, strconv.Itoa(port)}
+	if host == "" {
+		args = []string{command.Replicaof, command.No, command.One}
+	}
+	inst.pending = append(inst.pending, request{
+		args: args,
+		done: func(_ []string, err error) {
+			if err != nil {
+				s.event("-replicaof-failed", m, inst, "%s", err.Error())
+			}
+			if done != nil {
+				done(err)
+			}
+		},
+	})
+}
+
+// Keeps a connection subscribed to the hello channel of an instance, to
+// learn about the other sentinels and the configs they publish
+func (s *Sentinel) subscribe(inst *instance, addr string) {
+	if err := s.readHellos(inst, addr); err != nil {
+		// Subscribing again is left to the cron once the instance is back
+		time.Sleep(pingPeriod)
+	}
+	s.lock.Lock()
+	inst.subscribed = false
+	s.lock.Unlock()
+}
+
+func (s *Sentinel) readHellos(inst *instance, addr string) error {
+	l, err := dial(addr)
+	if err != nil {
+		return err
+	}
+	defer l.conn.Close()
+
+	if _, err := l.call(request{args: []string{command.Subscribe, helloChannel}, array: true}); err != nil {
+		return err
+	}
+	for {
+		l.conn.SetReadDeadline(time.Now().Add(helloTimeout))
+		msg, err := command.ReadArrayReply(l.reader)
+		if err != nil {
+			return err
+		}
+
+		s.lock.Lock()
+		removed := inst.removed
+		if !removed && len(msg) == 3 && msg[0] == command.Message {
+			s.processHello(msg[2], time.Now())
+		}
+		s.lock.Unlock()
+		if removed {
+			return nil
+		}
+	}
+}
+
+/*
+Hellos are published every helloPeriod on the hello channel of the
+masters and replicas, as comma separated fields:
+`<ip>,<port>,<runid>,<current_epoch>,<master_name>,<master_ip>,<master_port>,<master_config_epoch>`
+They make the sentinels monitoring a master find each other, and spread
+the address of the master chosen by the last failover.
+*/
+func (s *Sentinel) hello(m *master) string {
+	host, port := m.currentAddr()
+	return fmt.Sprintf("%s,%s,%s,%d,%s,%s,%d,%d",
+		s.announceHost, s.port, s.runID, s.currentEpoch, m.name, host, port, m.configEpoch)
+}
+
+func (s *Sentinel) processHello(payload string, now time.Time) {
+	fields := strings.Split(payload, ",")
+	if len(fields) != 8 || fields[2] == s.runID {
+		return
+	}
+	m := s.masters[fields[4]]
+	if m == nil {
+		return
+	}
+	port, err1 := strconv.Atoi(fields[1])
+	epoch, err2 := strconv.ParseUint(fields[3], 10, 64)
+	masterPort, err3 := strconv.Atoi(fields[6])
+	configEpoch, err4 := strconv.ParseUint(fields[7], 10, 64)
+	if err := errors.Join(err1, err2, err3, err4); err != nil {
+		log.Printf("invalid sentinel hello %q: %s\n", payload, err.Error())
+		return
+	}
+
+	host, runID := fields[0], fields[2]
+	if m.sentinels[runID] == nil {
+		// A restarted sentinel comes back with a new run ID
+		for id, peer := range m.sentinels {
+			if peer.host == host && peer.port == port {
+				s.event("-dup-sentinel", m, peer, "#duplicate of %s:%d or %s", host, port, runID)
+				peer.release()
+				delete(m.sentinels, id)
+			}
+		}
+		peer := newInstance(kindSentinel, host, port)
+		peer.runID = runID
+		m.sentinels[runID] = peer
+		s.event("+sentinel", m, peer, "")
+	}
+
+	if epoch > s.currentEpoch {
+		s.currentEpoch = epoch
+		s.event("+new-epoch", nil, nil, "%d", epoch)
+	}
+	// A newer failover picked another master
+	if configEpoch > m.configEpoch {
+		m.configEpoch = configEpoch
+		if m.host != fields[5] || m.port != masterPort {
+			s.event("+config-update-from", m, m.sentinels[runID], "")
+			s.switchMaster(m, fields[5], masterPort)
+		}
+	}
+}
+
+// Updates an instance with its INFO replication section. The master
+// gives its replicas, the replicas their master and their offset
+func (s *Sentinel) refreshInfo(m *master, inst *instance, info string, now time.Time) {
+	fields := map[string]string{}
+	for _, line := range strings.Split(info, "\n") {
+		key, value, found := strings.Cut(strings.TrimSpace(line), ":")
+		if found {
+			fields[key] = value
+		}
+	}
+
+	inst.infoRefresh = now
+	role := fields["role"]
+	if role != inst.role {
+		if inst.role != "" {
+			s.event("+role-change", m, inst, "new reported role is %s", role)
+		}
+		inst.role, inst.roleReported = role, now
+	}
+
+	switch role {
+	case kindMaster:
+		if inst == m.instance {
+			s.discoverReplicas(m, fields)
+		}
+	case kindSlave:
+		inst.masterHost = fields["master_host"]
+		inst.masterPort, _ = strconv.Atoi(fields["master_port"])
+		inst.masterLinkUp = fields["master_link_status"] == "up"
+		inst.replOffset, _ = strconv.Atoi(fields["master_repl_offset"])
+	}
+	if inst == m.instance {
+		return
+	}
+
+	if m.failoverState == failoverWaitPromotion && inst == m.promoted && role == kindMaster {
+		m.configEpoch = m.failoverEpoch
+		s.event("+promoted-slave", m, inst, "")
+		s.setFailoverState(m, failoverReconfSlaves, now)
+		return
+	}
+	s.reconfigureIfNeeded(m, inst, now)
+}
+
+// Adds the replicas listed as `slave<n>:ip=<ip>,port=<port>,...`
+func (s *Sentinel) discoverReplicas(m *master, fields map[string]string) {
+	for key, value := range fields {
+		if !strings.HasPrefix(key, "slave") {
+			continue
+		}
+		if _, err := strconv.Atoi(key[len("slave"):]); err != nil {
+			continue
+		}
+
+		params := map[string]string{}
+		for _, param := range strings.Split(value, ",") {
+			name, value, _ := strings.Cut(param, "=")
+			params[name] = value
+		}
+		port, err := strconv.Atoi(params["port"])
+		if err != nil || params["ip"] == "" {
+			continue
+		}
+		addr := net.JoinHostPort(params["ip"], params["port"])
+		if m.replicas[addr] == nil {
+			m.replicas[addr] = newInstance(kindSlave, params["ip"], port)
+			s.event("+slave", m, m.replicas[addr], "")
+		}
+	}
+}
+
+// Points back to the master the instances that report the wrong role or
+// the wrong master for a while, like an old master coming back after a
+// failover. It's only done while the master looks fine
+func (s *Sentinel) reconfigureIfNeeded(m *master, inst *instance, now time.Time) {
+	if m.failoverState != failoverNone || !s.masterLooksSane(m, now) {
+		return
+	}
+	if now.Sub(inst.roleReported) < roleGracePeriod || now.Sub(inst.lastReconf) < roleGracePeriod {
+		return
+	}
+
+	switch {
+	case inst.role == kindMaster:
+		s.event("+convert-to-slave", m, inst, "")
+	case inst.role == kindSlave && (inst.masterHost != m.host || inst.masterPort != m.port):
+		s.event("+fix-slave-config", m, inst, "")
+	default:
+		return
+	}
+	inst.lastReconf = now
+	s.replicaOf(m, inst, m.host, m.port, nil)
+}
+
+func (s *Sentinel) masterLooksSane(m *master, now time.Time) bool {
+	return m.sdownSince.IsZero() && m.role == kindMaster && now.Sub(m.infoRefresh) < 2*infoPeriod
+}
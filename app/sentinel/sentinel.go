@@ -0,0 +1,345 @@
+package sentinel
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultPort = "26379"
+	runIDSize   = 40
+	// Periods of the requests sent to the monitored instances and to the
+	// other sentinels
+	pingPeriod  = time.Second
+	infoPeriod  = 10 * time.Second
+	helloPeriod = 2 * time.Second
+	askPeriod   = time.Second
+	// The cron runs every cronPeriod plus a random part of it, so that the
+	// sentinels don't all try a failover at the same time
+	cronPeriod = 100 * time.Millisecond
+	// Replies to a request, or a dial, that take longer close the link
+	requestTimeout = time.Second
+	// The opinion of another sentinel about a master expires after this
+	downReplyValidity = 5 * time.Second
+	// Longest time waiting for the election of a failover leader
+	electionTimeout = 10 * time.Second
+	// Random delay added to the start of a failover, so that sentinels
+	// seeing the master down at the same time don't all try to be elected
+	maxDesync = time.Second
+	// Instances reporting the wrong role for longer are reconfigured
+	roleGracePeriod = 4 * helloPeriod
+
+	defaultDownAfter       = 30 * time.Second
+	defaultFailoverTimeout = 3 * time.Minute
+	helloChannel           = "__sentinel__:hello"
+)
+
+// Kinds of the instances
+const (
+	kindMaster   = "master"
+	kindSlave    = "slave"
+	kindSentinel = "sentinel"
+)
+
+// An instance is a monitored master, one of its replicas, or another
+// sentinel monitoring the same master. Instances are only accessed with
+// the lock of their Sentinel held, except for their link which belongs
+// to the goroutine running its requests
+type instance struct {
+	kind  string
+	host  string
+	port  int
+	runID string
+	link  *link
+	// Requests are running on the link
+	busy bool
+	// A connection is subscribed to the hello channel of the instance
+	subscribed bool
+	// The instance is no longer monitored, its connections are closed
+	removed bool
+	// Requests queued by the failover and the reconfiguration of the
+	// instances, sent with the next periodic ones
+	pending []request
+
+	lastPing      time.Time
+	lastInfo      time.Time
+	lastHello     time.Time
+	lastAsk       time.Time
+	lastAvailable time.Time
+	// Zero while the instance is replying to pings
+	sdownSince time.Time
+
+	// Reported by INFO
+	infoRefresh  time.Time
+	role         string
+	roleReported time.Time
+	masterHost   string
+	masterPort   int
+	masterLinkUp bool
+	replOffset   int
+	lastReconf   time.Time
+	// Sent REPLICAOF to the promoted replica during a failover
+	reconfSent bool
+	reconfDone bool
+
+	// Sentinels: their opinion about the master and their vote
+	masterDown      bool
+	masterDownReply time.Time
+	leader          string
+	leaderEpoch     uint64
+}
+
+func newInstance(kind, host string, port int) *instance {
+	return &instance{kind: kind, host: host, port: port, lastAvailable: time.Now()}
+}
+
+func (i *instance) addr() string {
+	return net.JoinHostPort(i.host, strconv.Itoa(i.port))
+}
+
+// A master monitored by this sentinel, along with the replicas and the
+// other sentinels found through it
+type master struct {
+	*instance
+	name            string
+	quorum          int
+	downAfter       time.Duration
+	failoverTimeout time.Duration
+	// Epoch of the failover that made the current master
+	configEpoch uint64
+	// Replicas by address and other sentinels by run ID
+	replicas   map[string]*instance
+	sentinels  map[string]*instance
+	odownSince time.Time
+	// Vote of this sentinel for the leader of a failover
+	leader      string
+	leaderEpoch uint64
+
+	failoverState       int
+	failoverEpoch       uint64
+	failoverStart       time.Time
+	failoverStateChange time.Time
+	// Started by SENTINEL FAILOVER, without agreement of other sentinels
+	forceFailover bool
+	promoted      *instance
+}
+
+// Sentinel monitors masters, their replicas and the other sentinels
+// monitoring them, and promotes a replica when a master is down
+type Sentinel struct {
+	port         string
+	runID        string
+	currentEpoch uint64
+	masters      map[string]*master
+	// Host the other sentinels reach this one at, learned from the local
+	// address of the links to the instances
+	announceHost string
+	lock         *sync.Mutex
+}
+
+func NewSentinel(port string) *Sentinel {
+	return &Sentinel{
+		port:    port,
+		runID:   generateRunID(),
+		masters: map[string]*master{},
+		lock:    &sync.Mutex{},
+	}
+}
+
+func generateRunID() string {
+	id := make([]byte, runIDSize/2)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Monitor starts monitoring a master under the given name
+func (s *Sentinel) Monitor(name, host string, port, quorum int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.masters[name] != nil {
+		return fmt.Errorf("Duplicated master name")
+	}
+	if quorum <= 0 {
+		return fmt.Errorf("Quorum must be 1 or greater.")
+	}
+	if port <= 0 || port > 65535 {
+		return fmt.Errorf("Invalid port number")
+	}
+	s.masters[name] = &master{
+		instance:        newInstance(kindMaster, host, port),
+		name:            name,
+		quorum:          quorum,
+		downAfter:       defaultDownAfter,
+		failoverTimeout: defaultFailoverTimeout,
+		replicas:        map[string]*instance{},
+		sentinels:       map[string]*instance{},
+	}
+	s.event("+monitor", s.masters[name], s.masters[name].instance, "quorum %d", quorum)
+	return nil
+}
+
+// Remove stops monitoring a master
+func (s *Sentinel) Remove(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	m := s.masters[name]
+	if m == nil {
+		return fmt.Errorf("No such master with that name")
+	}
+	s.event("-monitor", m, m.instance, "")
+	delete(s.masters, name)
+	m.release()
+	for _, peer := range m.sentinels {
+		peer.release()
+	}
+	return nil
+}
+
+// Set changes an option of a master: down-after-milliseconds,
+// failover-timeout or quorum
+func (s *Sentinel) Set(name, option, value string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	m := s.masters[name]
+	if m == nil {
+		return fmt.Errorf("No such master with that name")
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil || number <= 0 {
+		return fmt.Errorf("Invalid argument '%s' for SENTINEL SET '%s'", value, option)
+	}
+	switch option {
+	case "down-after-milliseconds":
+		m.downAfter = time.Duration(number) * time.Millisecond
+	case "failover-timeout":
+		m.failoverTimeout = time.Duration(number) * time.Millisecond
+	case "quorum":
+		m.quorum = number
+	default:
+		return fmt.Errorf("Invalid argument '%s' for SENTINEL SET '%s'", option, name)
+	}
+	return nil
+}
+
+// Start serves the clients and the other sentinels, and monitors the
+// masters in the cron
+func (s *Sentinel) Start() error {
+	l, err := net.Listen("tcp", "0.0.0.0:"+s.port)
+	if err != nil {
+		return fmt.Errorf("failed to bind to port %s: %w", s.port, err)
+	}
+	defer l.Close()
+	log.Printf("sentinel %s listening on port %s\n", s.runID, s.port)
+
+	go s.cron()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Printf("error accepting connection: %s\n", err.Error())
+			continue
+		}
+		go s.serveClient(conn)
+	}
+}
+
+func (s *Sentinel) cron() {
+	for {
+		time.Sleep(cronPeriod + randomDuration(cronPeriod))
+		s.lock.Lock()
+		now := time.Now()
+		for _, m := range s.masters {
+			s.handleInstance(m, m.instance, now)
+			for _, replica := range m.replicas {
+				s.handleInstance(m, replica, now)
+			}
+			for _, peer := range m.sentinels {
+				s.handleInstance(m, peer, now)
+			}
+			s.checkObjectivelyDown(m, now)
+			s.startFailoverIfNeeded(m, now)
+			s.handleFailover(m, now)
+		}
+		s.lock.Unlock()
+	}
+}
+
+// Releases the connections to the master and to its replicas
+func (m *master) release() {
+	m.instance.release()
+	for _, replica := range m.replicas {
+		replica.release()
+	}
+}
+
+// Address of the master, the one of the promoted replica once it's
+// being reconfigured as the new master
+func (m *master) currentAddr() (string, int) {
+	if m.promoted != nil && m.failoverState >= failoverReconfSlaves {
+		return m.promoted.host, m.promoted.port
+	}
+	return m.host, m.port
+}
+
+// Replaces the master by the one at host:port, the old master and the
+// other replicas become its replicas
+func (s *Sentinel) switchMaster(m *master, host string, port int) {
+	oldHost, oldPort := m.host, m.port
+	addrs := []string{}
+	for addr := range m.replicas {
+		addrs = append(addrs, addr)
+	}
+	if oldHost != host || oldPort != port {
+		addrs = append(addrs, m.addr())
+	}
+
+	m.release()
+	m.instance = newInstance(kindMaster, host, port)
+	m.replicas = map[string]*instance{}
+	for _, addr := range addrs {
+		replicaHost, replicaPort, _ := net.SplitHostPort(addr)
+		number, _ := strconv.Atoi(replicaPort)
+		if replicaHost == host && number == port {
+			continue
+		}
+		m.replicas[addr] = newInstance(kindSlave, replicaHost, number)
+	}
+	m.odownSince = time.Time{}
+	m.failoverState = failoverNone
+	m.forceFailover = false
+	m.promoted = nil
+	s.event("+switch-master", m, nil, "%s %d %s %d", oldHost, oldPort, host, port)
+}
+
+// Logs an event about an instance of a master, in the format of Redis
+// `<event> <kind> <name> <ip> <port> @ <master> <ip> <port> <details>`
+func (s *Sentinel) event(name string, m *master, inst *instance, format string, args ...any) {
+	msg := name
+	if inst != nil {
+		instName := inst.addr()
+		switch inst.kind {
+		case kindMaster:
+			instName = m.name
+		case kindSentinel:
+			instName = inst.runID
+		}
+		msg += fmt.Sprintf(" %s %s %s %d", inst.kind, instName, inst.host, inst.port)
+		if inst.kind != kindMaster {
+			msg += fmt.Sprintf(" @ %s %s %d", m.name, m.host, m.port)
+		}
+	} else if m != nil {
+		msg += " " + m.name
+	}
+	if format != "" {
+		msg += " " + fmt.Sprintf(format, args...)
+	}
+	log.Println(msg)
+}
@@ -0,0 +1,544 @@
+package cluster
+
+import (
+	"encoding/json"
+	"log"
+	"math/rand"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Types of the cluster bus messages
+const (
+	msgPing        = "ping"
+	msgPong        = "pong"
+	msgMeet        = "meet"
+	msgFail        = "fail"
+	msgUpdate      = "update"
+	msgAuthRequest = "auth-req"
+	msgAuthAck     = "auth-ack"
+	msgMFStart     = "mfstart"
+)
+
+const (
+	// Every node is pinged once its last pong is this old
+	pingInterval = time.Second
+	// Messages waiting to be written on a link, more are dropped
+	linkQueueSize = 64
+	// Minimum number of nodes described in the gossip section
+	minGossipNodes = 3
+)
+
+/*
+Messages of the cluster bus are JSON objects, one per line. Every message
+describes its sender: its ports, role, epochs and the slots it serves, the
+ones of its master for a replica, followed by a gossip section about other
+nodes the sender knows.
+  - PING is sent on the outgoing link to every node, which replies PONG
+  - MEET is a PING that makes the receiver add the sender to its nodes
+  - FAIL tells every node that a majority of masters think a node is failing
+  - UPDATE gives the newer config of a master to a node claiming its slots
+  - AUTH-REQ asks the masters to vote for a replica in a failover election,
+    AUTH-ACK is their vote
+  - MFSTART asks its master to pause its clients for a manual failover
+*/
+type message struct {
+	Type         string   `json:"type"`
+	Sender       string   `json:"sender"`
+	Port         int      `json:"port"`
+	BusPort      int      `json:"cport"`
+	Flags        int      `json:"flags"`
+	MasterID     string   `json:"master,omitempty"`
+	CurrentEpoch uint64   `json:"current_epoch"`
+	ConfigEpoch  uint64   `json:"config_epoch"`
+	ReplOffset   int      `json:"offset"`
+	Slots        []byte   `json:"slots"`
+	Gossip       []gossip `json:"gossip,omitempty"`
+	// Set by a master pausing its clients for a manual failover
+	Paused bool `json:"paused,omitempty"`
+	// Asks the masters to vote even though the master is not failing
+	ForceAck bool         `json:"force_ack,omitempty"`
+	Failing  string       `json:"failing,omitempty"`
+	Update   *slotsUpdate `json:"update,omitempty"`
+}
+
+// The config of a master sent by UPDATE
+type slotsUpdate struct {
+	ID          string `json:"id"`
+	ConfigEpoch uint64 `json:"config_epoch"`
+	Slots       []byte `json:"slots"`
+}
+
+// What the sender knows about another node
+type gossip struct {
+	ID           string `json:"id"`
+	Host         string `json:"ip"`
+	Port         int    `json:"port"`
+	BusPort      int    `json:"cport"`
+	Flags        int    `json:"flags"`
+	PingSent     int64  `json:"ping_sent"`
+	PongReceived int64  `json:"pong_received"`
+}
+
+// A connection of the cluster bus. Outgoing links belong to the node they
+// are connected to, incoming links have no node. Messages are queued and
+// written by a goroutine so the state lock is never held during network
+// writes. Links are only accessed with the state lock held
+type link struct {
+	conn      net.Conn
+	node      *Node
+	queue     chan *message
+	connected bool
+	closed    bool
+}
+
+func newLink(node *Node) *link {
+	return &link{node: node, queue: make(chan *message, linkQueueSize)}
+}
+
+func (l *link) send(msg *message) {
+	if l.closed {
+		return
+	}
+	select {
+	case l.queue <- msg:
+	default:
+	}
+}
+
+func (l *link) close() {
+	if l.closed {
+		return
+	}
+	l.closed = true
+	close(l.queue)
+	if l.conn != nil {
+		l.conn.Close()
+	}
+}
+
+func (l *link) writeLoop(timeout time.Duration) {
+	encoder := json.NewEncoder(l.conn)
+	for msg := range l.queue {
+		l.conn.SetWriteDeadline(time.Now().Add(timeout))
+		if err := encoder.Encode(msg); err != nil {
+			l.conn.Close()
+			return
+		}
+	}
+}
+
+// ListenBus accepts the connections of the other nodes on the bus port
+func (s *State) ListenBus() error {
+	s.lock.RLock()
+	busPort := s.myself.BusPort
+	s.lock.RUnlock()
+
+	listener, err := net.Listen("tcp", "0.0.0.0:"+strconv.Itoa(busPort))
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		defer listener.Close()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				log.Printf("error accepting cluster bus connection: %s\n", err.Error())
+				continue
+			}
+
+			l := newLink(nil)
+			l.conn, l.connected = conn, true
+			go l.writeLoop(s.nodeTimeout)
+			go s.readLoop(l)
+		}
+	}()
+	return nil
+}
+
+// Connects the outgoing link of a node and greets it with a PING, or with
+// a MEET so a node we were asked to meet adds us
+func (s *State) connect(node *Node) {
+	l := newLink(node)
+	node.link = l
+	addr := node.busAddr()
+
+	go func() {
+		conn, err := net.DialTimeout("tcp", addr, s.nodeTimeout)
+
+		s.lock.Lock()
+		if err != nil || l.closed {
+			if err == nil {
+				conn.Close()
+			}
+			// A node that can't be reached times out like one that doesn't answer
+			if err != nil && node.pingSent.IsZero() && node.flags&flagHandshake == 0 {
+				node.pingSent = time.Now()
+			}
+			if node.link == l {
+				node.link = nil
+			}
+			s.lock.Unlock()
+			return
+		}
+		l.conn, l.connected = conn, true
+		go l.writeLoop(s.nodeTimeout)
+		msgType := msgPing
+		if node.flags&flagMeet != 0 {
+			msgType = msgMeet
+		}
+		s.sendPing(node, msgType)
+		s.lock.Unlock()
+
+		s.readLoop(l)
+	}()
+}
+
+func (s *State) sendPing(node *Node, msgType string) {
+	if node.pingSent.IsZero() {
+		node.pingSent = time.Now()
+	}
+	s.send(node.link, s.buildMessage(msgType))
+}
+
+func (s *State) send(l *link, msg *message) {
+	if l == nil {
+		return
+	}
+	s.messagesSent[msg.Type]++
+	l.send(msg)
+}
+
+// Sends a message on the connected links of all the nodes
+func (s *State) broadcast(msg *message) {
+	for _, node := range s.nodes {
+		if node != s.myself && node.flags&flagHandshake == 0 && node.link != nil && node.link.connected {
+			s.send(node.link, msg)
+		}
+	}
+}
+
+// Processes the messages received on a link until it's closed
+func (s *State) readLoop(l *link) {
+	decoder := json.NewDecoder(l.conn)
+	remoteHost, _, _ := net.SplitHostPort(l.conn.RemoteAddr().String())
+	localHost, _, _ := net.SplitHostPort(l.conn.LocalAddr().String())
+
+	for {
+		msg := &message{}
+		if err := decoder.Decode(msg); err != nil {
+			break
+		}
+
+		s.lock.Lock()
+		s.process(msg, l, remoteHost, localHost)
+		s.lock.Unlock()
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	l.close()
+	if l.node != nil && l.node.link == l {
+		l.node.link = nil
+	}
+}
+
+func (s *State) buildMessage(msgType string) *message {
+	myself := s.myself
+	master := myself
+	if replicated := s.nodes[myself.MasterID]; replicated != nil && !myself.isMaster() {
+		master = replicated
+	}
+	// The slots are copied, the message is encoded after the lock is released
+	slots := master.slots
+	msg := &message{
+		Type:         msgType,
+		Sender:       myself.ID,
+		Port:         myself.Port,
+		BusPort:      myself.BusPort,
+		Flags:        myself.flags &^ flagMyself,
+		MasterID:     myself.MasterID,
+		CurrentEpoch: s.currentEpoch,
+		ConfigEpoch:  master.ConfigEpoch,
+		ReplOffset:   s.replOffset(),
+		Slots:        slots[:],
+		Paused:       s.mfReplica != nil,
+	}
+	if msgType != msgPing && msgType != msgPong && msgType != msgMeet {
+		return msg
+	}
+
+	// A tenth of the nodes are described, at least minGossipNodes, plus
+	// the ones possibly failing so the failure reports spread fast
+	candidates := []*Node{}
+	for _, node := range s.nodes {
+		if node != myself && node.flags&(flagHandshake|flagNoAddr) == 0 {
+			candidates = append(candidates, node)
+		}
+	}
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	wanted := min(max(len(s.nodes)/10, minGossipNodes), len(candidates))
+	described := candidates[:wanted]
+	for _, node := range candidates[wanted:] {
+		if node.flags&flagPFail != 0 {
+			described = append(described, node)
+		}
+	}
+	for _, node := range described {
+		msg.Gossip = append(msg.Gossip, gossip{
+			ID:           node.ID,
+			Host:         node.Host,
+			Port:         node.Port,
+			BusPort:      node.BusPort,
+			Flags:        node.flags,
+			PingSent:     unixMilli(node.pingSent),
+			PongReceived: unixMilli(node.pongReceived),
+		})
+	}
+	return msg
+}
+
+// Applies a message received on a link. remoteHost is the address of the
+// sender and localHost the address it used to reach this node
+func (s *State) process(msg *message, l *link, remoteHost, localHost string) {
+	s.messagesReceived[msg.Type]++
+	if msg.CurrentEpoch > s.currentEpoch {
+		s.currentEpoch = msg.CurrentEpoch
+		s.todoSave = true
+	}
+
+	// Nodes learn their own address from the address other nodes use to
+	// reach them, a MEET always updates it
+	if msg.Type == msgMeet || msg.Type == msgPing && s.myself.Host == "" {
+		if s.myself.Host != localHost {
+			s.myself.Host = localHost
+			s.todoSave = true
+		}
+	}
+
+	sender := s.nodes[msg.Sender]
+	if sender == nil && msg.Type == msgMeet {
+		sender = &Node{ID: msg.Sender, Host: remoteHost, created: time.Now()}
+		s.nodes[sender.ID] = sender
+		s.todoSave = true
+		log.Printf("node %s joined the cluster from %s\n", sender.ID, remoteHost)
+	}
+
+	// The pong of a node in handshake gives its real ID
+	if msg.Type == msgPong && l.node != nil && l.node.flags&flagHandshake != 0 {
+		if sender != nil {
+			s.deleteNode(l.node)
+			return
+		}
+		delete(s.nodes, l.node.ID)
+		l.node.ID = msg.Sender
+		l.node.flags &^= flagHandshake | flagMeet
+		s.nodes[l.node.ID] = l.node
+		sender = l.node
+		s.todoSave = true
+		log.Printf("handshake with node %s completed\n", sender.ID)
+	}
+
+	if msg.Type == msgPing || msg.Type == msgMeet {
+		s.send(l, s.buildMessage(msgPong))
+	}
+	if sender == nil {
+		return
+	}
+
+	if msg.Type == msgPong && l.node == sender {
+		sender.pingSent = time.Time{}
+		sender.pongReceived = time.Now()
+		s.clearFailureIfNeeded(sender)
+	}
+	s.updateNode(sender, msg, remoteHost)
+	if sender.isMaster() {
+		s.claimSlots(sender, msg.Slots, l)
+		s.handleEpochCollision(sender)
+	}
+
+	switch msg.Type {
+	case msgFail:
+		if failing := s.nodes[msg.Failing]; failing != nil && failing != s.myself && failing.flags&flagFail == 0 {
+			log.Printf("FAIL message received from %s about %s\n", sender.ID, failing.ID)
+			s.setFailing(failing)
+		}
+	case msgUpdate:
+		if msg.Update != nil {
+			s.processUpdate(msg.Update)
+		}
+	case msgAuthRequest:
+		s.voteFailover(sender, msg, l)
+	case msgAuthAck:
+		s.countVote(sender, msg)
+	case msgMFStart:
+		s.startManualFailover(sender, l)
+	}
+
+	// The replica doing a manual failover waits for the offset of its
+	// paused master
+	if msg.Paused && sender.ID == s.myself.MasterID && !s.mfEnd.IsZero() && s.mfMasterOffset < 0 {
+		s.mfMasterOffset = msg.ReplOffset
+		log.Printf("received replication offset %d for the paused master\n", msg.ReplOffset)
+	}
+	s.processGossip(sender, msg.Gossip)
+}
+
+// Updates the address, the role and the epoch of the sender
+func (s *State) updateNode(sender *Node, msg *message, remoteHost string) {
+	if sender.Host == "" && remoteHost != "" {
+		sender.Host = remoteHost
+		s.todoSave = true
+	}
+	if sender.Port != msg.Port || sender.BusPort != msg.BusPort {
+		sender.Port, sender.BusPort = msg.Port, msg.BusPort
+		s.todoSave = true
+	}
+
+	roleFlags := msg.Flags & (flagMaster | flagSlave)
+	if sender.flags&(flagMaster|flagSlave) != roleFlags || sender.MasterID != msg.MasterID {
+		sender.flags = sender.flags&^(flagMaster|flagSlave) | roleFlags
+		sender.MasterID = msg.MasterID
+		s.todoSave = true
+	}
+	if sender.ConfigEpoch != msg.ConfigEpoch {
+		sender.ConfigEpoch = msg.ConfigEpoch
+		s.todoSave = true
+	}
+	sender.ReplOffset = msg.ReplOffset
+}
+
+// A master claiming slots takes the ones that are unassigned or assigned
+// to a node with an older config epoch. Slots being imported are left to
+// the end of the import, and a slot this node loses is no longer migrating.
+// The sender of a claim that lost gets an UPDATE with the newer config on
+// the link l, when there is one.
+// A master losing all its slots, or a replica whose master does, becomes
+// a replica of the sender: it's usually the replica that failed it over
+func (s *State) claimSlots(sender *Node, claimed []byte, l *link) {
+	if len(claimed) != Slots/8 {
+		return
+	}
+
+	currentMaster := s.myself
+	if !currentMaster.isMaster() {
+		currentMaster = s.nodes[s.myself.MasterID]
+	}
+	changed, lostOurs := false, false
+	var newerOwner *Node
+	for slot := 0; slot < Slots; slot++ {
+		if claimed[slot/8]&(1<<(slot%8)) == 0 {
+			continue
+		}
+		owner := s.slots[slot]
+		if owner == sender || s.importing[slot] != nil {
+			continue
+		}
+		if owner == nil || owner.ConfigEpoch < sender.ConfigEpoch {
+			if owner == s.myself {
+				s.migrating[slot] = nil
+			}
+			if owner != nil && owner == currentMaster {
+				lostOurs = true
+			}
+			s.setSlot(slot, sender)
+			changed = true
+		} else if owner.ConfigEpoch > sender.ConfigEpoch {
+			newerOwner = owner
+		}
+	}
+	if newerOwner != nil && l != nil {
+		s.sendUpdate(l, newerOwner)
+	}
+	if !changed {
+		return
+	}
+
+	s.updateState()
+	s.todoSave = true
+	if lostOurs && currentMaster.numSlots == 0 && s.myself != sender {
+		log.Printf("lost all the slots to %s, reconfiguring as its replica\n", sender.ID)
+		s.setMaster(sender)
+	}
+}
+
+// Two masters can't share a config epoch, otherwise the slots they both
+// claim would have no winner. The node with the greater ID takes a new epoch
+func (s *State) handleEpochCollision(sender *Node) {
+	myself := s.myself
+	if sender.ConfigEpoch != myself.ConfigEpoch || !myself.isMaster() || sender.ID < myself.ID {
+		return
+	}
+	s.currentEpoch++
+	myself.ConfigEpoch = s.currentEpoch
+	s.todoSave = true
+	log.Printf("config epoch collision with node %s, config epoch set to %d\n", sender.ID, myself.ConfigEpoch)
+}
+
+// The gossip of masters reports failing nodes, unknown nodes found in the
+// gossip are contacted to join them
+func (s *State) processGossip(sender *Node, entries []gossip) {
+	for _, entry := range entries {
+		if node := s.nodes[entry.ID]; node != nil {
+			s.updateFailReport(sender, node, entry.Flags)
+			continue
+		}
+		if entry.Flags&(flagHandshake|flagNoAddr) != 0 || entry.Host == "" {
+			continue
+		}
+		s.startHandshake(entry.Host, entry.Port, entry.BusPort, false)
+	}
+}
+
+// Cron connects the links, pings the nodes, detects the failing ones, runs
+// the failovers and saves the config when it changed. It runs every 100
+// milliseconds
+func (s *State) Cron() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	handshakeTimeout := max(s.nodeTimeout, time.Second)
+	for _, node := range s.nodes {
+		if node == s.myself || node.flags&flagNoAddr != 0 {
+			continue
+		}
+		if node.flags&flagHandshake != 0 && now.Sub(node.created) > handshakeTimeout {
+			log.Printf("handshake with %s timed out\n", node.Addr())
+			s.deleteNode(node)
+			continue
+		}
+
+		s.checkNodeTimeout(node, now)
+		if node.link == nil {
+			s.connect(node)
+			continue
+		}
+		if !node.link.connected {
+			continue
+		}
+
+		// A link waiting too long for a pong may be stuck, reconnect it
+		if !node.pingSent.IsZero() && now.Sub(node.pingSent) > s.nodeTimeout/2 && now.Sub(node.pongReceived) > s.nodeTimeout/2 {
+			node.link.close()
+			node.link = nil
+			continue
+		}
+		if node.pingSent.IsZero() && now.Sub(node.pongReceived) >= pingInterval {
+			s.sendPing(node, msgPing)
+		}
+	}
+
+	s.handleManualFailover(now)
+	s.handleReplicaFailover(now)
+	s.updateState()
+	if s.todoSave {
+		if err := s.saveConfig(); err != nil {
+			log.Printf("failed to save the cluster config: %s\n", err.Error())
+		}
+	}
+}
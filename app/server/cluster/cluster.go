@@ -0,0 +1,729 @@
+package cluster
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	nodeIDSize = 40
+	// The cluster bus listens on the client port plus this offset
+	BusPortOffset = 10000
+)
+
+// Node flags, in the order CLUSTER NODES shows them
+const (
+	flagMyself = 1 << iota
+	flagMaster
+	flagSlave
+	flagPFail
+	flagFail
+	flagHandshake
+	flagNoAddr
+	// The next link to the node sends a MEET so it adds us
+	flagMeet
+)
+
+var flagNames = []struct {
+	flag int
+	name string
+}{
+	{flagMyself, "myself"},
+	{flagMaster, "master"},
+	{flagSlave, "slave"},
+	{flagPFail, "fail?"},
+	{flagFail, "fail"},
+	{flagHandshake, "handshake"},
+	{flagNoAddr, "noaddr"},
+}
+
+// Node is a member of the cluster, identified by a random 40 characters ID.
+// Nodes are only accessed with the lock of their State held
+type Node struct {
+	ID      string
+	Host    string
+	Port    int
+	BusPort int
+	flags   int
+	// Master of a replica
+	MasterID    string
+	ConfigEpoch uint64
+	ReplOffset  int
+	// Time of the ping waiting for a pong, zero when none is
+	pingSent     time.Time
+	pongReceived time.Time
+	created      time.Time
+	// Slots served by the node
+	slots    [Slots / 8]byte
+	numSlots int
+	// Outgoing link, nil while disconnected
+	link *link
+	// Masters whose gossip reports the node as failing, with the time of
+	// their last report
+	failReports map[string]time.Time
+	failTime    time.Time
+	// Time of the last vote for a replica of this master
+	votedTime time.Time
+}
+
+// Addr is the address clients use to reach the node
+func (n *Node) Addr() string {
+	return net.JoinHostPort(n.Host, strconv.Itoa(n.Port))
+}
+
+func (n *Node) busAddr() string {
+	return net.JoinHostPort(n.Host, strconv.Itoa(n.BusPort))
+}
+
+func (n *Node) hasSlot(slot int) bool {
+	return n.slots[slot/8]&(1<<(slot%8)) != 0
+}
+
+func (n *Node) isMaster() bool {
+	return n.flags&flagMaster != 0
+}
+
+func (n *Node) flagsString() string {
+	names := []string{}
+	for _, flag := range flagNames {
+		if n.flags&flag.flag != 0 {
+			names = append(names, flag.name)
+		}
+	}
+	if len(names) == 0 {
+		return "noflags"
+	}
+	return strings.Join(names, ",")
+}
+
+// State is the view this node has of the cluster: the known nodes, the
+// node serving every hash slot and the epochs. It's kept in the cluster
+// config file and exchanged with the other nodes over the cluster bus
+type State struct {
+	myself       *Node
+	nodes        map[string]*Node
+	slots        [Slots]*Node
+	currentEpoch uint64
+	// Epoch of the last vote given in a failover election
+	lastVoteEpoch uint64
+	// Slots of this node moving to another node, and slots this node is
+	// taking from another one
+	migrating [Slots]*Node
+	importing [Slots]*Node
+	// Every slot is served by a node that is not failing
+	ok          bool
+	configPath  string
+	nodeTimeout time.Duration
+	// Set when the config file has to be written by the next cron run
+	todoSave         bool
+	messagesSent     map[string]int
+	messagesReceived map[string]int
+	// Replication offset of this node
+	replOffset func() int
+	lock       *sync.RWMutex
+	// Set by the server, it changes the replication role of this node
+	replication Replication
+	// Election of this replica, once its master failed
+	failoverAuthTime  time.Time
+	failoverAuthSent  bool
+	failoverAuthRank  int
+	failoverAuthCount int
+	failoverAuthEpoch uint64
+	// Manual failover: its deadline, the replica of this master it's
+	// started by, and for the replica the offset of the paused master
+	mfEnd          time.Time
+	mfReplica      *Node
+	mfCanStart     bool
+	mfMasterOffset int
+}
+
+// NewState creates a cluster with this node alone, serving no slot. The
+// config file at configPath replaces it once loaded
+func NewState(port int, configPath string, nodeTimeout time.Duration) *State {
+	myself := &Node{
+		ID:      generateNodeID(),
+		Port:    port,
+		BusPort: port + BusPortOffset,
+		flags:   flagMyself | flagMaster,
+		created: time.Now(),
+	}
+	return &State{
+		myself:           myself,
+		nodes:            map[string]*Node{myself.ID: myself},
+		configPath:       configPath,
+		nodeTimeout:      nodeTimeout,
+		messagesSent:     map[string]int{},
+		messagesReceived: map[string]int{},
+		replOffset:       func() int { return 0 },
+		lock:             &sync.RWMutex{},
+		mfMasterOffset:   -1,
+	}
+}
+
+func generateNodeID() string {
+	id := make([]byte, nodeIDSize/2)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// SetReplOffset sets the function returning the replication offset of this
+// node, it's advertised to the other nodes
+func (s *State) SetReplOffset(replOffset func() int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.replOffset = replOffset
+}
+
+func (s *State) MyID() string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.myself.ID
+}
+
+// SlotOwner returns the ID and the address of the node serving slot,
+// the ID is empty when no node does
+func (s *State) SlotOwner(slot int) (string, string) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	owner := s.slots[slot]
+	if owner == nil {
+		return "", ""
+	}
+	return owner.ID, owner.Addr()
+}
+
+// OK tells if the cluster can serve queries, which requires every slot
+// to be served by a node that is not failing
+func (s *State) OK() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.ok
+}
+
+// Meet starts a handshake with the node at host and port, it joins the
+// cluster once it answered
+func (s *State) Meet(host string, port, busPort int) error {
+	ip := net.ParseIP(host)
+	if ip == nil || port <= 0 || port > 65535 || busPort <= 0 || busPort > 65535 {
+		return fmt.Errorf("Invalid node address specified: %s", net.JoinHostPort(host, strconv.Itoa(port)))
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.startHandshake(ip.String(), port, busPort, true)
+	return nil
+}
+
+func (s *State) startHandshake(host string, port, busPort int, meet bool) {
+	for _, node := range s.nodes {
+		if node.flags&flagHandshake != 0 && node.Host == host && node.Port == port {
+			return
+		}
+	}
+
+	flags := flagHandshake
+	if meet {
+		flags |= flagMeet
+	}
+	node := &Node{ID: generateNodeID(), Host: host, Port: port, BusPort: busPort, flags: flags, created: time.Now()}
+	s.nodes[node.ID] = node
+}
+
+func (s *State) deleteNode(node *Node) {
+	for slot, owner := range s.slots {
+		if owner == node {
+			s.slots[slot] = nil
+		}
+		if s.migrating[slot] == node {
+			s.migrating[slot] = nil
+		}
+		if s.importing[slot] == node {
+			s.importing[slot] = nil
+		}
+	}
+	if node.link != nil {
+		node.link.close()
+	}
+	delete(s.nodes, node.ID)
+	s.todoSave = true
+}
+
+// Parses a slot argument of the CLUSTER commands
+func ParseSlot(arg string) (int, error) {
+	slot, err := strconv.Atoi(arg)
+	if err != nil || slot < 0 || slot >= Slots {
+		return 0, fmt.Errorf("Invalid or out of range slot")
+	}
+	return slot, nil
+}
+
+// AddSlots assigns unassigned slots to this node
+func (s *State) AddSlots(slots []int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	seen := map[int]bool{}
+	for _, slot := range slots {
+		if s.slots[slot] != nil {
+			return fmt.Errorf("Slot %d is already busy", slot)
+		}
+		if seen[slot] {
+			return fmt.Errorf("Slot %d specified multiple times", slot)
+		}
+		seen[slot] = true
+	}
+
+	for _, slot := range slots {
+		s.setSlot(slot, s.myself)
+	}
+	s.updateState()
+	s.todoSave = true
+	return nil
+}
+
+// DelSlots forgets who serves the slots, the other nodes keep their own
+// view until another node claims them
+func (s *State) DelSlots(slots []int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	seen := map[int]bool{}
+	for _, slot := range slots {
+		if s.slots[slot] == nil {
+			return fmt.Errorf("Slot %d is already unassigned", slot)
+		}
+		if seen[slot] {
+			return fmt.Errorf("Slot %d specified multiple times", slot)
+		}
+		seen[slot] = true
+	}
+
+	for _, slot := range slots {
+		s.clearSlot(slot)
+	}
+	s.updateState()
+	s.todoSave = true
+	return nil
+}
+
+// SetSlotNode assigns a slot to a known master. This node ends the import
+// of a slot assigned to itself with a new config epoch, so its claim wins
+// over the node the slot was taken from
+func (s *State) SetSlotNode(slot int, id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	node, err := s.slotTarget(id)
+	if err != nil {
+		return err
+	}
+
+	if node != s.myself {
+		s.migrating[slot] = nil
+	}
+	if node == s.myself && s.importing[slot] != nil {
+		s.importing[slot] = nil
+		s.bumpEpoch()
+	}
+	s.setSlot(slot, node)
+	s.updateState()
+	s.todoSave = true
+	return nil
+}
+
+// SetSlotMigrating starts moving a slot of this node to another master,
+// clients asking for keys that were already moved are redirected to it
+func (s *State) SetSlotMigrating(slot int, id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.slots[slot] != s.myself {
+		return fmt.Errorf("I'm not the owner of hash slot %d", slot)
+	}
+	node, err := s.slotTarget(id)
+	if err != nil {
+		return err
+	}
+	if node == s.myself {
+		return fmt.Errorf("Target node can't be myself")
+	}
+
+	s.migrating[slot] = node
+	s.todoSave = true
+	return nil
+}
+
+// SetSlotImporting starts taking a slot from another master, this node
+// serves its keys to the clients sending ASKING first
+func (s *State) SetSlotImporting(slot int, id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.slots[slot] == s.myself {
+		return fmt.Errorf("I'm already the owner of hash slot %d", slot)
+	}
+	node, err := s.slotTarget(id)
+	if err != nil {
+		return err
+	}
+	if node == s.myself {
+		return fmt.Errorf("Source node can't be myself")
+	}
+
+	s.importing[slot] = node
+	s.todoSave = true
+	return nil
+}
+
+// SetSlotStable cancels the migration or the import of a slot
+func (s *State) SetSlotStable(slot int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.migrating[slot] = nil
+	s.importing[slot] = nil
+	s.todoSave = true
+}
+
+// MigratingTo returns the address of the node a slot of this node is
+// moving to, it's empty when the slot is not migrating
+func (s *State) MigratingTo(slot int) string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.migrating[slot] == nil {
+		return ""
+	}
+	return s.migrating[slot].Addr()
+}
+
+// Importing tells if this node is taking a slot from another node
+func (s *State) Importing(slot int) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.importing[slot] != nil
+}
+
+func (s *State) slotTarget(id string) (*Node, error) {
+	node := s.nodes[id]
+	if node == nil || node.flags&flagHandshake != 0 {
+		return nil, fmt.Errorf("I don't know about node %s", id)
+	}
+	if !node.isMaster() {
+		return nil, fmt.Errorf("Target node is not a master")
+	}
+	return node, nil
+}
+
+// Takes a new config epoch without the agreement of the other masters,
+// unless this node already has the greatest one
+func (s *State) bumpEpoch() {
+	maxEpoch := s.currentEpoch
+	for _, node := range s.nodes {
+		maxEpoch = max(maxEpoch, node.ConfigEpoch)
+	}
+	if s.myself.ConfigEpoch != 0 && s.myself.ConfigEpoch == maxEpoch {
+		return
+	}
+	s.currentEpoch = maxEpoch + 1
+	s.myself.ConfigEpoch = s.currentEpoch
+	log.Printf("config epoch set to %d\n", s.myself.ConfigEpoch)
+}
+
+func (s *State) setSlot(slot int, node *Node) {
+	if owner := s.slots[slot]; owner != nil {
+		s.clearSlot(slot)
+	}
+	s.slots[slot] = node
+	node.slots[slot/8] |= 1 << (slot % 8)
+	node.numSlots++
+}
+
+func (s *State) clearSlot(slot int) {
+	owner := s.slots[slot]
+	if owner == nil {
+		return
+	}
+	owner.slots[slot/8] &^= 1 << (slot % 8)
+	owner.numSlots--
+	s.slots[slot] = nil
+}
+
+// Recomputes the state of the cluster, it's down when a slot is not served
+func (s *State) updateState() {
+	ok := true
+	for _, owner := range s.slots {
+		if owner == nil || owner.flags&flagFail != 0 {
+			ok = false
+			break
+		}
+	}
+	if ok != s.ok {
+		state := "fail"
+		if ok {
+			state = "ok"
+		}
+		log.Printf("cluster state changed: %s\n", state)
+	}
+	s.ok = ok
+}
+
+// SlotRange is a range of slots served by a master, with the master and
+// its replicas
+type SlotRange struct {
+	Start int
+	End   int
+	Nodes []NodeInfo
+}
+
+// NodeInfo describes a node to the clients
+type NodeInfo struct {
+	ID         string
+	Host       string
+	Port       int
+	Master     bool
+	ReplOffset int
+	Failing    bool
+}
+
+func (s *State) nodeInfo(node *Node) NodeInfo {
+	offset := node.ReplOffset
+	if node == s.myself {
+		offset = s.replOffset()
+	}
+	return NodeInfo{
+		ID:         node.ID,
+		Host:       node.Host,
+		Port:       node.Port,
+		Master:     node.isMaster(),
+		ReplOffset: offset,
+		Failing:    node.flags&(flagFail|flagPFail) != 0,
+	}
+}
+
+// Replicas of a master, failing ones included. CLUSTER SHARDS lists them
+// with their health while CLUSTER SLOTS leaves them out, like Redis
+func (s *State) replicasOf(master *Node) []*Node {
+	replicas := []*Node{}
+	for _, node := range s.sortedNodes() {
+		if node.flags&flagSlave != 0 && node.MasterID == master.ID {
+			replicas = append(replicas, node)
+		}
+	}
+	return replicas
+}
+
+// Slots returns the ranges of assigned slots, as shown by CLUSTER SLOTS
+func (s *State) Slots() []SlotRange {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	ranges := []SlotRange{}
+	for start := 0; start < Slots; {
+		owner := s.slots[start]
+		end := start
+		for end+1 < Slots && s.slots[end+1] == owner {
+			end++
+		}
+		if owner != nil {
+			nodes := []NodeInfo{s.nodeInfo(owner)}
+			for _, replica := range s.replicasOf(owner) {
+				if replica.flags&(flagFail|flagPFail) == 0 {
+					nodes = append(nodes, s.nodeInfo(replica))
+				}
+			}
+			ranges = append(ranges, SlotRange{Start: start, End: end, Nodes: nodes})
+		}
+		start = end + 1
+	}
+	return ranges
+}
+
+// Shard is a master with its replicas and the ranges of slots it serves
+type Shard struct {
+	Slots [][2]int
+	Nodes []NodeInfo
+}
+
+// Shards returns a shard per master, as shown by CLUSTER SHARDS
+func (s *State) Shards() []Shard {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	shards := []Shard{}
+	for _, node := range s.sortedNodes() {
+		if !node.isMaster() || node.flags&flagHandshake != 0 {
+			continue
+		}
+		shard := Shard{Slots: slotRanges(node), Nodes: []NodeInfo{s.nodeInfo(node)}}
+		for _, replica := range s.replicasOf(node) {
+			shard.Nodes = append(shard.Nodes, s.nodeInfo(replica))
+		}
+		shards = append(shards, shard)
+	}
+	return shards
+}
+
+func slotRanges(node *Node) [][2]int {
+	ranges := [][2]int{}
+	for slot := 0; slot < Slots; slot++ {
+		if !node.hasSlot(slot) {
+			continue
+		}
+		start := slot
+		for slot+1 < Slots && node.hasSlot(slot+1) {
+			slot++
+		}
+		ranges = append(ranges, [2]int{start, slot})
+	}
+	return ranges
+}
+
+func (s *State) sortedNodes() []*Node {
+	nodes := make([]*Node, 0, len(s.nodes))
+	for _, node := range s.nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	return nodes
+}
+
+// Nodes describes every known node, in the format of CLUSTER NODES
+func (s *State) Nodes() string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.describeNodes()
+}
+
+func (s *State) describeNodes() string {
+	lines := []string{}
+	for _, node := range s.sortedNodes() {
+		lines = append(lines, s.describeNode(node))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// `<id> <ip:port@cport> <flags> <master> <ping-sent> <pong-recv> <config-epoch> <link-state> <slot> ...`
+func (s *State) describeNode(node *Node) string {
+	master := "-"
+	if node.MasterID != "" {
+		master = node.MasterID
+	}
+	linkState := "disconnected"
+	if node == s.myself || node.link != nil && node.link.connected {
+		linkState = "connected"
+	}
+
+	fields := []string{
+		node.ID,
+		fmt.Sprintf("%s@%d", node.Addr(), node.BusPort),
+		node.flagsString(),
+		master,
+		strconv.FormatInt(unixMilli(node.pingSent), 10),
+		strconv.FormatInt(unixMilli(node.pongReceived), 10),
+		strconv.FormatUint(node.ConfigEpoch, 10),
+		linkState,
+	}
+	for _, slots := range slotRanges(node) {
+		if slots[0] == slots[1] {
+			fields = append(fields, strconv.Itoa(slots[0]))
+		} else {
+			fields = append(fields, fmt.Sprintf("%d-%d", slots[0], slots[1]))
+		}
+	}
+	if node == s.myself {
+		for slot := 0; slot < Slots; slot++ {
+			if target := s.migrating[slot]; target != nil {
+				fields = append(fields, fmt.Sprintf("[%d->-%s]", slot, target.ID))
+			}
+			if source := s.importing[slot]; source != nil {
+				fields = append(fields, fmt.Sprintf("[%d-<-%s]", slot, source.ID))
+			}
+		}
+	}
+	return strings.Join(fields, " ")
+}
+
+func unixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+// Info returns the fields of CLUSTER INFO
+func (s *State) Info() []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	assigned, pfail, fail := 0, 0, 0
+	for _, owner := range s.slots {
+		if owner == nil {
+			continue
+		}
+		assigned++
+		if owner.flags&flagPFail != 0 {
+			pfail++
+		}
+		if owner.flags&flagFail != 0 {
+			fail++
+		}
+	}
+	state := "fail"
+	if s.ok {
+		state = "ok"
+	}
+
+	info := []string{
+		fmt.Sprintf("cluster_state:%s", state),
+		fmt.Sprintf("cluster_slots_assigned:%d", assigned),
+		fmt.Sprintf("cluster_slots_ok:%d", assigned-pfail-fail),
+		fmt.Sprintf("cluster_slots_pfail:%d", pfail),
+		fmt.Sprintf("cluster_slots_fail:%d", fail),
+		fmt.Sprintf("cluster_known_nodes:%d", len(s.nodes)),
+		fmt.Sprintf("cluster_size:%d", s.size()),
+		fmt.Sprintf("cluster_current_epoch:%d", s.currentEpoch),
+		fmt.Sprintf("cluster_my_epoch:%d", s.myEpoch()),
+	}
+
+	sent, received := 0, 0
+	for _, count := range s.messagesSent {
+		sent += count
+	}
+	for _, count := range s.messagesReceived {
+		received += count
+	}
+	info = append(info, fmt.Sprintf("cluster_stats_messages_sent:%d", sent))
+	for _, messageType := range sortedKeys(s.messagesSent) {
+		info = append(info, fmt.Sprintf("cluster_stats_messages_%s_sent:%d", messageType, s.messagesSent[messageType]))
+	}
+	info = append(info, fmt.Sprintf("cluster_stats_messages_received:%d", received))
+	for _, messageType := range sortedKeys(s.messagesReceived) {
+		info = append(info, fmt.Sprintf("cluster_stats_messages_%s_received:%d", messageType, s.messagesReceived[messageType]))
+	}
+	return info
+}
+
+// The config epoch of this node, or of its master for a replica
+func (s *State) myEpoch() uint64 {
+	if master := s.nodes[s.myself.MasterID]; master != nil {
+		return master.ConfigEpoch
+	}
+	return s.myself.ConfigEpoch
+}
+
+func sortedKeys(counts map[string]int) []string {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
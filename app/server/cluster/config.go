@@ -0,0 +1,212 @@
+package cluster
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LoadConfig restores the cluster from its config file, a missing file
+// leaves this node alone in a new cluster and creates the file
+func (s *State) LoadConfig() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	file, err := os.Open(s.configPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return s.saveConfig()
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	port, busPort := s.myself.Port, s.myself.BusPort
+	nodes := map[string]*Node{}
+	var myself *Node
+	var migrations []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "vars" {
+			if err := s.parseVars(fields[1:]); err != nil {
+				return err
+			}
+			continue
+		}
+
+		node, slots, nodeMigrations, err := parseNodeLine(fields)
+		if err != nil {
+			return fmt.Errorf("invalid cluster config file %s: %w", s.configPath, err)
+		}
+		if node.flags&flagHandshake != 0 {
+			continue
+		}
+		if node.flags&flagMyself != 0 {
+			myself, migrations = node, nodeMigrations
+		}
+		nodes[node.ID] = node
+		for _, slot := range slots {
+			s.slots[slot] = node
+			node.slots[slot/8] |= 1 << (slot % 8)
+			node.numSlots++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if myself == nil {
+		return fmt.Errorf("invalid cluster config file %s: myself node not found", s.configPath)
+	}
+	myself.pongReceived = time.Time{}
+
+	// The other node of a migration can be listed after this one
+	for _, migration := range migrations {
+		slot, importing, id, err := parseMigration(migration)
+		if err != nil || nodes[id] == nil {
+			return fmt.Errorf("invalid cluster config file %s: invalid slot migration %s", s.configPath, migration)
+		}
+		if importing {
+			s.importing[slot] = nodes[id]
+		} else {
+			s.migrating[slot] = nodes[id]
+		}
+	}
+
+	// The ports given at startup win over the ones of the file
+	myself.Port, myself.BusPort = port, busPort
+	s.myself, s.nodes = myself, nodes
+	s.updateState()
+	return nil
+}
+
+func (s *State) parseVars(fields []string) error {
+	for i := 0; i+1 < len(fields); i += 2 {
+		value, err := strconv.ParseUint(fields[i+1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid cluster config var %s: %s", fields[i], fields[i+1])
+		}
+		switch fields[i] {
+		case "currentEpoch":
+			s.currentEpoch = value
+		case "lastVoteEpoch":
+			s.lastVoteEpoch = value
+		}
+	}
+	return nil
+}
+
+// Parses a line written by describeNode, returning the node, its slots and
+// the slots it's migrating or importing
+func parseNodeLine(fields []string) (*Node, []int, []string, error) {
+	if len(fields) < 8 {
+		return nil, nil, nil, fmt.Errorf("not enough fields in line: %s", strings.Join(fields, " "))
+	}
+
+	node := &Node{ID: fields[0], created: time.Now(), pongReceived: time.Now()}
+	addr, _, _ := strings.Cut(fields[1], ",")
+	addr, busPort, found := strings.Cut(addr, "@")
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || !found {
+		return nil, nil, nil, fmt.Errorf("invalid node address %s", fields[1])
+	}
+	node.Host = host
+	if node.Port, err = strconv.Atoi(port); err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid node address %s", fields[1])
+	}
+	if node.BusPort, err = strconv.Atoi(busPort); err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid node address %s", fields[1])
+	}
+
+	for _, name := range strings.Split(fields[2], ",") {
+		for _, flag := range flagNames {
+			if flag.name == name {
+				node.flags |= flag.flag
+			}
+		}
+	}
+	if fields[3] != "-" {
+		node.MasterID = fields[3]
+	}
+	if node.ConfigEpoch, err = strconv.ParseUint(fields[6], 10, 64); err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid config epoch %s", fields[6])
+	}
+
+	slots, migrations := []int{}, []string{}
+	for _, field := range fields[8:] {
+		if strings.HasPrefix(field, "[") {
+			migrations = append(migrations, field)
+			continue
+		}
+		startArg, endArg, isRange := strings.Cut(field, "-")
+		start, err := ParseSlot(startArg)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("invalid slot %s", field)
+		}
+		end := start
+		if isRange {
+			if end, err = ParseSlot(endArg); err != nil {
+				return nil, nil, nil, fmt.Errorf("invalid slot %s", field)
+			}
+		}
+		for slot := start; slot <= end; slot++ {
+			slots = append(slots, slot)
+		}
+	}
+	return node, slots, migrations, nil
+}
+
+// Parses `[<slot>->-<id>]` for a slot migrating to a node and
+// `[<slot>-<-<id>]` for a slot imported from a node
+func parseMigration(field string) (int, bool, string, error) {
+	field = strings.TrimSuffix(strings.TrimPrefix(field, "["), "]")
+	slotArg, id, migrating := strings.Cut(field, "->-")
+	importing := false
+	if !migrating {
+		slotArg, id, importing = strings.Cut(field, "-<-")
+	}
+	if !migrating && !importing {
+		return 0, false, "", fmt.Errorf("invalid slot migration %s", field)
+	}
+	slot, err := ParseSlot(slotArg)
+	return slot, importing, id, err
+}
+
+// Writes the config file under a temporary name and renames it
+func (s *State) saveConfig() error {
+	content := s.describeNodes() +
+		fmt.Sprintf("vars currentEpoch %d lastVoteEpoch %d\n", s.currentEpoch, s.lastVoteEpoch)
+
+	if err := os.MkdirAll(filepath.Dir(s.configPath), 0o755); err != nil {
+		return err
+	}
+	tempPath := s.configPath + ".tmp"
+	file, err := os.Create(tempPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempPath)
+
+	if _, err := file.WriteString(content); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	s.todoSave = false
+	return os.Rename(tempPath, s.configPath)
+}
@@ -0,0 +1,436 @@
+package cluster
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+)
+
+const (
+	// Manual failovers are aborted once this old
+	manualFailoverTimeout = 5 * time.Second
+	// Clients paused by a manual failover check again after this delay
+	manualFailoverPollInterval = 10 * time.Millisecond
+)
+
+// Options of CLUSTER FAILOVER
+const (
+	FailoverDefault  = ""
+	FailoverForce    = "force"
+	FailoverTakeover = "takeover"
+)
+
+// Replication lets the cluster change the role of this node, replicas
+// replicate the master they were assigned and winning a failover election
+// promotes them
+type Replication interface {
+	ReplicaOf(master string) error
+	PromoteToMaster()
+}
+
+// SetReplication sets the replication of this node, it starts replicating
+// its master if the config file made it a replica
+func (s *State) SetReplication(replication Replication) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.replication = replication
+	if master := s.nodes[s.myself.MasterID]; master != nil && !s.myself.isMaster() {
+		s.replication.ReplicaOf(master.Addr())
+	}
+}
+
+// Replicate turns this node into a replica of a master. Only masters
+// without slots nor keys can become replicas
+func (s *State) Replicate(id string, empty bool) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	node := s.nodes[id]
+	if node == nil || node.flags&flagHandshake != 0 {
+		return fmt.Errorf("Unknown node %s", id)
+	}
+	if node == s.myself {
+		return fmt.Errorf("Can't replicate myself")
+	}
+	if !node.isMaster() {
+		return fmt.Errorf("I can only replicate a master, not a replica.")
+	}
+	if s.myself.isMaster() && (s.myself.numSlots != 0 || !empty) {
+		return fmt.Errorf("To set a master the node must be empty and without assigned slots.")
+	}
+
+	s.setMaster(node)
+	return nil
+}
+
+// Failover starts a manual failover of the master of this replica. By
+// default the master pauses its clients until the replica processed all
+// its writes, FORCE starts the election right away and TAKEOVER promotes
+// the replica without any election
+func (s *State) Failover(option string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	myself := s.myself
+	if myself.isMaster() {
+		return fmt.Errorf("You should send CLUSTER FAILOVER to a replica")
+	}
+	master := s.nodes[myself.MasterID]
+	if master == nil {
+		return fmt.Errorf("I'm a replica but my master is unknown to me")
+	}
+	if option == FailoverDefault && (master.flags&flagFail != 0 || master.link == nil || !master.link.connected) {
+		return fmt.Errorf("Master is down or failed, please use CLUSTER FAILOVER FORCE")
+	}
+
+	s.resetManualFailover()
+	switch option {
+	case FailoverTakeover:
+		log.Println("taking over the master (user request)")
+		s.bumpEpoch()
+		s.replaceMaster(master)
+	case FailoverForce:
+		log.Println("forced failover user request accepted")
+		s.mfEnd = time.Now().Add(manualFailoverTimeout)
+		s.mfCanStart = true
+	default:
+		log.Println("manual failover user request accepted")
+		s.mfEnd = time.Now().Add(manualFailoverTimeout)
+		s.send(master.link, s.buildMessage(msgMFStart))
+	}
+	return nil
+}
+
+// WaitManualFailover blocks while this master pauses the writes of its
+// clients for the manual failover of one of its replicas
+func (s *State) WaitManualFailover() {
+	for {
+		s.lock.RLock()
+		paused := s.mfReplica != nil && time.Now().Before(s.mfEnd)
+		s.lock.RUnlock()
+		if !paused {
+			return
+		}
+		time.Sleep(manualFailoverPollInterval)
+	}
+}
+
+// Number of masters serving slots, a majority of them is needed to mark a
+// node as failing or to win an election
+func (s *State) size() int {
+	size := 0
+	for _, node := range s.nodes {
+		if node.isMaster() && node.numSlots > 0 {
+			size++
+		}
+	}
+	return size
+}
+
+// Marks a node as possibly failing when its pong is late
+func (s *State) checkNodeTimeout(node *Node, now time.Time) {
+	if node.pingSent.IsZero() || now.Sub(node.pingSent) <= s.nodeTimeout || node.flags&(flagPFail|flagFail|flagHandshake) != 0 {
+		return
+	}
+	node.flags |= flagPFail
+	log.Printf("node %s possibly failing\n", node.ID)
+	s.markFailingIfNeeded(node)
+}
+
+// A node possibly failing is failing once a majority of the masters agree,
+// reports older than twice the node timeout are ignored
+func (s *State) markFailingIfNeeded(node *Node) {
+	if node.flags&flagPFail == 0 || node.flags&flagFail != 0 {
+		return
+	}
+
+	reports := 0
+	for reporter, reported := range node.failReports {
+		if time.Since(reported) > 2*s.nodeTimeout {
+			delete(node.failReports, reporter)
+			continue
+		}
+		reports++
+	}
+	if s.myself.isMaster() {
+		reports++
+	}
+	if reports < s.size()/2+1 {
+		return
+	}
+
+	log.Printf("marking node %s as failing (quorum reached)\n", node.ID)
+	s.setFailing(node)
+	msg := s.buildMessage(msgFail)
+	msg.Failing = node.ID
+	s.broadcast(msg)
+}
+
+func (s *State) setFailing(node *Node) {
+	node.flags = node.flags&^flagPFail | flagFail
+	node.failTime = time.Now()
+	s.updateState()
+	s.todoSave = true
+}
+
+// A master reporting in its gossip whether a node is failing
+func (s *State) updateFailReport(reporter, node *Node, flags int) {
+	if !reporter.isMaster() || node == s.myself {
+		return
+	}
+	if flags&(flagPFail|flagFail) == 0 {
+		delete(node.failReports, reporter.ID)
+		return
+	}
+	if node.failReports == nil {
+		node.failReports = map[string]time.Time{}
+	}
+	node.failReports[reporter.ID] = time.Now()
+	s.markFailingIfNeeded(node)
+}
+
+// Called when a node answers. A failing replica or master without slots
+// is back, a failing master keeps its slots unless nobody took them over
+// for twice the node timeout
+func (s *State) clearFailureIfNeeded(node *Node) {
+	node.flags &^= flagPFail
+	if node.flags&flagFail == 0 {
+		return
+	}
+	if !node.isMaster() || node.numSlots == 0 || time.Since(node.failTime) > 2*s.nodeTimeout {
+		log.Printf("clear FAIL state for node %s: it is reachable again\n", node.ID)
+		node.flags &^= flagFail
+		s.updateState()
+		s.todoSave = true
+	}
+}
+
+// Runs the election of a replica whose master is failing, or whose manual
+// failover can start. The election starts after a delay growing with the
+// rank of the replica so the one with the most data usually wins, then it
+// asks the masters for their votes and is promoted once a majority agreed
+func (s *State) handleReplicaFailover(now time.Time) {
+	myself := s.myself
+	master := s.nodes[myself.MasterID]
+	manual := !s.mfEnd.IsZero() && s.mfCanStart
+	if myself.isMaster() || master == nil || master.numSlots == 0 || master.flags&flagFail == 0 && !manual {
+		return
+	}
+
+	authTimeout := max(2*s.nodeTimeout, 2*time.Second)
+	authAge := now.Sub(s.failoverAuthTime)
+	if authAge > 2*authTimeout {
+		s.failoverAuthTime = now.Add(500*time.Millisecond + time.Duration(rand.Intn(500))*time.Millisecond)
+		s.failoverAuthCount = 0
+		s.failoverAuthSent = false
+		s.failoverAuthRank = s.replicaRank(master)
+		s.failoverAuthTime = s.failoverAuthTime.Add(time.Duration(s.failoverAuthRank) * time.Second)
+		if manual {
+			s.failoverAuthTime = now
+			s.failoverAuthRank = 0
+		}
+		log.Printf("start of election delayed for %dms (rank #%d, offset %d)\n",
+			s.failoverAuthTime.Sub(now).Milliseconds(), s.failoverAuthRank, s.replOffset())
+		return
+	}
+
+	// Replicas that got more data since the election was scheduled go first
+	if !s.failoverAuthSent && !manual {
+		if rank := s.replicaRank(master); rank > s.failoverAuthRank {
+			delay := time.Duration(rank-s.failoverAuthRank) * time.Second
+			s.failoverAuthTime = s.failoverAuthTime.Add(delay)
+			s.failoverAuthRank = rank
+			log.Printf("replica rank updated to #%d, added %dms of delay\n", rank, delay.Milliseconds())
+		}
+	}
+	if now.Before(s.failoverAuthTime) || authAge > authTimeout {
+		return
+	}
+
+	if !s.failoverAuthSent {
+		s.currentEpoch++
+		s.failoverAuthEpoch = s.currentEpoch
+		s.failoverAuthSent = true
+		s.todoSave = true
+		log.Printf("starting a failover election for epoch %d\n", s.currentEpoch)
+		msg := s.buildMessage(msgAuthRequest)
+		msg.ForceAck = manual
+		s.broadcast(msg)
+		return
+	}
+
+	if s.failoverAuthCount >= s.size()/2+1 {
+		log.Println("failover election won")
+		myself.ConfigEpoch = max(myself.ConfigEpoch, s.failoverAuthEpoch)
+		s.replaceMaster(master)
+	}
+}
+
+// Number of replicas of the same master with more replicated data
+func (s *State) replicaRank(master *Node) int {
+	offset, rank := s.replOffset(), 0
+	for _, replica := range s.replicasOf(master) {
+		if replica != s.myself && replica.flags&(flagPFail|flagFail) == 0 && replica.ReplOffset > offset {
+			rank++
+		}
+	}
+	return rank
+}
+
+// A master votes once per epoch for a replica of a failing master, unless
+// it voted for a replica of the same master recently or it knows a newer
+// config for the slots the replica claims
+func (s *State) voteFailover(sender *Node, msg *message, l *link) {
+	myself := s.myself
+	master := s.nodes[sender.MasterID]
+	if !myself.isMaster() || myself.numSlots == 0 {
+		return
+	}
+	if msg.CurrentEpoch < s.currentEpoch {
+		log.Printf("failover auth denied to %s: request epoch %d < current epoch %d\n", sender.ID, msg.CurrentEpoch, s.currentEpoch)
+		return
+	}
+	if s.lastVoteEpoch == s.currentEpoch {
+		log.Printf("failover auth denied to %s: already voted for epoch %d\n", sender.ID, s.currentEpoch)
+		return
+	}
+	if sender.isMaster() || master == nil {
+		return
+	}
+	if master.flags&flagFail == 0 && !msg.ForceAck {
+		log.Printf("failover auth denied to %s: its master is up\n", sender.ID)
+		return
+	}
+	if time.Since(master.votedTime) < 2*s.nodeTimeout {
+		log.Printf("failover auth denied to %s: can't vote for a replica of %s yet\n", sender.ID, master.ID)
+		return
+	}
+	if len(msg.Slots) == Slots/8 {
+		for slot := 0; slot < Slots; slot++ {
+			owner := s.slots[slot]
+			if msg.Slots[slot/8]&(1<<(slot%8)) == 0 || owner == nil || owner.ConfigEpoch <= msg.ConfigEpoch {
+				continue
+			}
+			log.Printf("failover auth denied to %s: slot %d epoch %d > request epoch %d\n", sender.ID, slot, owner.ConfigEpoch, msg.ConfigEpoch)
+			return
+		}
+	}
+
+	s.lastVoteEpoch = s.currentEpoch
+	master.votedTime = time.Now()
+	s.todoSave = true
+	s.send(l, s.buildMessage(msgAuthAck))
+	log.Printf("failover auth granted to %s for epoch %d\n", sender.ID, s.currentEpoch)
+}
+
+// Counts the votes of the masters for the current election
+func (s *State) countVote(sender *Node, msg *message) {
+	if sender.isMaster() && sender.numSlots > 0 && msg.CurrentEpoch >= s.failoverAuthEpoch {
+		s.failoverAuthCount++
+	}
+}
+
+// Promotes this replica in place of its master, taking all its slots
+func (s *State) replaceMaster(master *Node) {
+	myself := s.myself
+	myself.flags = myself.flags&^flagSlave | flagMaster
+	myself.MasterID = ""
+	for slot, owner := range s.slots {
+		if owner == master {
+			s.setSlot(slot, myself)
+		}
+	}
+	s.resetManualFailover()
+	s.updateState()
+	if err := s.saveConfig(); err != nil {
+		log.Printf("failed to save the cluster config: %s\n", err.Error())
+	}
+
+	// The other nodes learn the new config right away
+	s.broadcast(s.buildMessage(msgPong))
+	if s.replication != nil {
+		s.replication.PromoteToMaster()
+	}
+}
+
+// Turns this node into a replica of master and starts replicating it
+func (s *State) setMaster(master *Node) {
+	myself := s.myself
+	myself.flags = myself.flags&^flagMaster | flagSlave
+	myself.MasterID = master.ID
+	s.migrating = [Slots]*Node{}
+	s.importing = [Slots]*Node{}
+	s.resetManualFailover()
+	s.todoSave = true
+	log.Printf("configured as a replica of %s\n", master.ID)
+
+	if s.replication != nil {
+		s.replication.ReplicaOf(master.Addr())
+	}
+}
+
+// A master receiving MFSTART from one of its replicas pauses the writes
+// of its clients and sends it its replication offset
+func (s *State) startManualFailover(sender *Node, l *link) {
+	if !s.myself.isMaster() || sender.MasterID != s.myself.ID {
+		return
+	}
+	s.resetManualFailover()
+	s.mfEnd = time.Now().Add(manualFailoverTimeout)
+	s.mfReplica = sender
+	log.Printf("manual failover requested by replica %s\n", sender.ID)
+	s.send(l, s.buildMessage(msgPing))
+}
+
+// Ends the manual failover when it timed out. A replica can start the
+// election once it processed the offset of its paused master
+func (s *State) handleManualFailover(now time.Time) {
+	if s.mfEnd.IsZero() {
+		return
+	}
+	if now.After(s.mfEnd) {
+		log.Println("manual failover timed out")
+		s.resetManualFailover()
+		return
+	}
+	if s.myself.isMaster() || s.mfCanStart || s.mfMasterOffset < 0 {
+		return
+	}
+	if s.replOffset() >= s.mfMasterOffset {
+		s.mfCanStart = true
+		log.Println("all master replication stream processed, manual failover can start")
+	}
+}
+
+func (s *State) resetManualFailover() {
+	s.mfEnd = time.Time{}
+	s.mfReplica = nil
+	s.mfCanStart = false
+	s.mfMasterOffset = -1
+}
+
+// Sends to a master claiming slots the config of the node serving them
+// with a newer config epoch
+func (s *State) sendUpdate(l *link, owner *Node) {
+	msg := s.buildMessage(msgUpdate)
+	slots := owner.slots
+	msg.Update = &slotsUpdate{ID: owner.ID, ConfigEpoch: owner.ConfigEpoch, Slots: slots[:]}
+	s.send(l, msg)
+}
+
+// Applies the config of a master sent by UPDATE
+func (s *State) processUpdate(update *slotsUpdate) {
+	node := s.nodes[update.ID]
+	if node == nil || node.ConfigEpoch >= update.ConfigEpoch {
+		return
+	}
+	if !node.isMaster() {
+		node.flags = node.flags&^flagSlave | flagMaster
+		node.MasterID = ""
+	}
+	node.ConfigEpoch = update.ConfigEpoch
+	s.todoSave = true
+	s.claimSlots(node, update.Slots, nil)
+}
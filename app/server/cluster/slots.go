@@ -0,0 +1,45 @@
+package cluster
+
+import "strings"
+
+// Slots is the number of hash slots the keyspace is split into
+const Slots = 16384
+
+// CRC16 CCITT (XMODEM) table, the polynomial is 0x1021
+var crc16Table = makeCRC16Table()
+
+func makeCRC16Table() *[256]uint16 {
+	table := &[256]uint16{}
+	for i := range table {
+		crc := uint16(i) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}
+
+func crc16(data string) uint16 {
+	crc := uint16(0)
+	for i := 0; i < len(data); i++ {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^data[i]]
+	}
+	return crc
+}
+
+// KeySlot returns the hash slot of a key. When the key has a non empty
+// `{hashtag}` only the hashtag is hashed, so related keys can be kept in
+// the same slot
+func KeySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key) & (Slots - 1))
+}
@@ -0,0 +1,36 @@
+package cluster
+
+import "testing"
+
+func TestCRC16(t *testing.T) {
+	// Check value of the cluster specification
+	if got := crc16("123456789"); got != 0x31c3 {
+		t.Errorf("got %x, want 31c3", got)
+	}
+}
+
+func TestKeySlot(t *testing.T) {
+	tests := []struct {
+		key  string
+		want int
+	}{
+		{"foo", 12182},
+		{"bar", 5061},
+		{"hello", 866},
+		{"somekey", 11058},
+		{"foo{hash_tag}", 2515},
+		{"{user1000}.following", KeySlot("user1000")},
+		{"{user1000}.followers", KeySlot("user1000")},
+		// Only the first hashtag counts
+		{"foo{bar}{zap}", 5061},
+		{"foo{{bar}}zap", KeySlot("{bar")},
+		// Empty hashtags hash the whole key
+		{"foo{}{bar}", int(crc16("foo{}{bar}") & (Slots - 1))},
+		{"{}", int(crc16("{}") & (Slots - 1))},
+	}
+	for _, test := range tests {
+		if got := KeySlot(test.key); got != test.want {
+			t.Errorf("KeySlot(%q) = %d, want %d", test.key, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package config
+
+// Backlog keeps the tail of the replication stream so replicas that briefly
+// lost the connection can continue with a partial resynchronization.
+// It is a ring buffer of fixed size like the Redis backlog, appending never
+// moves the history already written.
+// It is guarded by the Config lock.
+type Backlog struct {
+	buf []byte
+	// Position in buf where the next byte is written
+	idx int
+	// Number of bytes of history, at most len(buf)
+	histlen int
+	// Replication offset of the first byte of the history
+	start int
+}
+
+func NewBacklog(size int) *Backlog {
+	return &Backlog{buf: make([]byte, size)}
+}
+
+// Append adds data written at the replication offset `offset`
+func (b *Backlog) Append(data []byte, offset int) {
+	if b.histlen == 0 {
+		b.start = offset
+	}
+	for len(data) > 0 {
+		n := copy(b.buf[b.idx:], data)
+		data = data[n:]
+		b.idx = (b.idx + n) % len(b.buf)
+		b.histlen += n
+	}
+	if extra := b.histlen - len(b.buf); extra > 0 {
+		b.histlen = len(b.buf)
+		b.start += extra
+	}
+}
+
+// Reset discards the history, the next byte appended will be at offset
+func (b *Backlog) Reset(offset int) {
+	b.idx = 0
+	b.histlen = 0
+	b.start = offset
+}
+
+// ReadFrom returns the bytes from offset up to end, the current replication
+// offset. PSYNC offsets point to the next byte the replica expects, so a
+// replica that is fully synced asks for end itself and gets no data.
+func (b *Backlog) ReadFrom(offset, end int) ([]byte, bool) {
+	if offset == end {
+		return []byte{}, true
+	}
+	if offset < b.start || offset > b.start+b.histlen {
+		return nil, false
+	}
+
+	// The history ends right before idx, the bytes asked for may wrap
+	// around the end of the buffer
+	data := make([]byte, b.start+b.histlen-offset)
+	from := (b.idx - len(data) + len(b.buf)) % len(b.buf)
+	copied := copy(data, b.buf[from:])
+	copy(data[copied:], b.buf)
+	return data, true
+}
@@ -0,0 +1,57 @@
+package config
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBacklog(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+		// First offset still in the history
+		start int
+	}{
+		{"empty", nil, 0},
+		{"partly filled", []string{"abc", "de"}, 0},
+		{"exactly full", []string{"abcd", "efgh"}, 0},
+		{"wrapped", []string{"abcde", "fgh", "ij"}, 2},
+		{"write larger than the backlog", []string{"ab", "cdefghijklm"}, 5},
+		{"many small writes", []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j", "k"}, 3},
+	}
+	for _, test := range tests {
+		backlog := NewBacklog(8)
+		stream := []byte{}
+		for _, data := range test.writes {
+			backlog.Append([]byte(data), len(stream))
+			stream = append(stream, data...)
+		}
+		end := len(stream)
+
+		for offset := 0; offset <= end+1; offset++ {
+			data, ok := backlog.ReadFrom(offset, end)
+			wantOK := offset == end || (offset >= test.start && offset <= end)
+			if ok != wantOK {
+				t.Errorf("%s: offset %d available %t, want %t", test.name, offset, ok, wantOK)
+				continue
+			}
+			if ok && !bytes.Equal(data, stream[offset:]) {
+				t.Errorf("%s: got %q from offset %d, want %q", test.name, data, offset, stream[offset:])
+			}
+		}
+	}
+}
+
+func TestBacklogReset(t *testing.T) {
+	backlog := NewBacklog(8)
+	backlog.Append([]byte("abcdef"), 0)
+	backlog.Reset(100)
+	backlog.Append([]byte("xyz"), 100)
+
+	if _, ok := backlog.ReadFrom(3, 103); ok {
+		t.Error("history from before the reset is still available")
+	}
+	if data, ok := backlog.ReadFrom(101, 103); !ok || string(data) != "yz" {
+		t.Errorf("got %q, %t, want \"yz\"", data, ok)
+	}
+}
@@ -1,55 +1,161 @@
 package config
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
-	"math/rand"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/server/cluster"
 )
 
 const (
-	charset        = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-	replIDSize     = 40
-	defaultPort    = "6379"
-	defaultDir     = "/tmp/redis-files"
-	defaultRDBFile = "dump.rdb"
+	replIDSize            = 40
+	defaultPort           = "6379"
+	defaultDir            = "/tmp/redis-files"
+	defaultRDBFile        = "dump.rdb"
+	defaultBacklog        = 1024 * 1024
+	defaultMinReplicasLag = 10
+	defaultDisklessDelay  = 5
+	defaultAOFFile        = "appendonly.aof"
+	defaultAOFDir         = "appendonlydir"
+	defaultAppendFsync    = "everysec"
+	// auto-aof-rewrite-percentage 100 and auto-aof-rewrite-min-size 64mb
+	defaultAOFRewritePercentage = 100
+	defaultAOFRewriteMinSize    = 64 * 1024 * 1024
+	defaultClusterConfigFile    = "nodes.conf"
+	defaultClusterNodeTimeout   = 15000
 )
 
+// Same as the `client-output-buffer-limit replica 256mb 64mb 60` default of Redis
+var defaultReplicaLimits = OutputBufferLimits{
+	Hard:        256 * 1024 * 1024,
+	Soft:        64 * 1024 * 1024,
+	SoftSeconds: 60,
+}
+
+// SaveRule triggers a BGSAVE once Changes writes happened and Seconds passed since the last save
+type SaveRule struct {
+	Seconds int
+	Changes int
+}
+
+// Same as the `save 3600 1 300 100 60 10000` default of Redis
+var defaultSaveRules = []SaveRule{
+	{Seconds: 3600, Changes: 1},
+	{Seconds: 300, Changes: 100},
+	{Seconds: 60, Changes: 10000},
+}
+
 const (
 	RoleMaster = "master"
 	RoleSlave  = "slave"
 )
 
-var seededRand *rand.Rand = rand.New(
-	rand.NewSource(time.Now().UnixNano()))
-
 type Config struct {
-	port        string
-	role        string
-	replicaOf   string
-	replID      string
-	replOffset  int
-	slaves      []*Slave
-	dir         string
-	rdbFileName string
+	port             string
+	role             string
+	replicaOf        string
+	replID           string
+	replID2          string
+	replOffset       int
+	secondReplOffset int
+	backlog          *Backlog
+	slaves           []*Slave
+	replicaLimits    OutputBufferLimits
+	masterLinkUp     bool
+	replicaReadOnly  bool
+	serveStaleData   bool
+	// min-replicas-to-write / min-replicas-max-lag (seconds)
+	minReplicasToWrite int
+	minReplicasMaxLag  int
+	saveRules          []SaveRule
+	disklessSync       bool
+	disklessSyncDelay  int
+	// Replicas waiting for the next diskless transfer
+	disklessPending []*Slave
+	dir             string
+	rdbFileName     string
+	// Append only file settings
+	appendOnly       bool
+	appendFileName   string
+	appendDirName    string
+	appendFsync      string
+	aofLoadTruncated bool
+	aofRDBPreamble   bool
+	// Automatic rewrites once the AOF grew by the percentage since the last
+	// rewrite, if it's at least min size bytes
+	aofRewritePercentage int
+	aofRewriteMinSize    int
+	// Cluster state, nil unless cluster-enabled is set
+	clusterEnabled     bool
+	clusterConfigFile  string
+	clusterNodeTimeout int
+	cluster            *cluster.State
+	lock               *sync.RWMutex
+	// Closed and replaced every time a replica acknowledges an offset
+	ackNotify chan struct{}
+	// CLIENT PAUSE holds the writes of the clients, or all their commands,
+	// until pauseEnd
+	pauseEnd time.Time
+	pauseAll bool
+	// FAILOVER in progress, it pauses the writes until it ends
+	failover Failover
 }
 
 type Option func(c *Config)
 
 func NewConfig(options ...Option) *Config {
 	config := &Config{
-		port:        defaultPort,
-		role:        RoleMaster,
-		replID:      generateReplicationID(),
-		replOffset:  0,
-		slaves:      []*Slave{},
-		dir:         defaultDir,
-		rdbFileName: defaultRDBFile,
+		port:                 defaultPort,
+		role:                 RoleMaster,
+		replID:               generateReplicationID(),
+		replID2:              emptyReplID(),
+		replOffset:           0,
+		secondReplOffset:     -1,
+		backlog:              NewBacklog(defaultBacklog),
+		slaves:               []*Slave{},
+		replicaLimits:        defaultReplicaLimits,
+		replicaReadOnly:      true,
+		serveStaleData:       true,
+		minReplicasMaxLag:    defaultMinReplicasLag,
+		disklessSyncDelay:    defaultDisklessDelay,
+		saveRules:            defaultSaveRules,
+		dir:                  defaultDir,
+		rdbFileName:          defaultRDBFile,
+		appendFileName:       defaultAOFFile,
+		appendDirName:        defaultAOFDir,
+		aofRDBPreamble:       true,
+		aofRewritePercentage: defaultAOFRewritePercentage,
+		aofRewriteMinSize:    defaultAOFRewriteMinSize,
+		appendFsync:          defaultAppendFsync,
+		aofLoadTruncated:     true,
+		clusterConfigFile:    defaultClusterConfigFile,
+		clusterNodeTimeout:   defaultClusterNodeTimeout,
+		lock:                 &sync.RWMutex{},
+		ackNotify:            make(chan struct{}),
+		failover:             Failover{State: FailoverNone},
 	}
 
 	for _, opt := range options {
 		opt(config)
 	}
 
+	if config.clusterEnabled {
+		port, _ := strconv.Atoi(config.port)
+		configPath := config.clusterConfigFile
+		if !filepath.IsAbs(configPath) {
+			configPath = filepath.Join(config.dir, configPath)
+		}
+		timeout := time.Duration(config.clusterNodeTimeout) * time.Millisecond
+		config.cluster = cluster.NewState(port, configPath, timeout)
+		config.cluster.SetReplOffset(config.ReplOffset)
+	}
+
 	return config
 }
 
@@ -58,18 +164,41 @@ func (c *Config) Port() string {
 }
 
 func (c *Config) Role() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
 	return c.role
 }
 
 func (c *Config) ReplID() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
 	return c.replID
 }
 
+// ReplID2 is the replication ID this server had before its last promotion,
+// kept so replicas of the previous master can still partially resync.
+func (c *Config) ReplID2() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.replID2
+}
+
 func (c *Config) ReplOffset() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
 	return c.replOffset
 }
 
+// SecondReplOffset is the last offset (plus one) accepted for ReplID2, or -1
+func (c *Config) SecondReplOffset() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.secondReplOffset
+}
+
 func (c *Config) ReplicaOf() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
 	return c.replicaOf
 }
 
@@ -81,22 +210,408 @@ func (c *Config) RDBFileName() string {
 	return c.rdbFileName
 }
 
+// Slaves returns a snapshot of the connected replicas
 func (c *Config) Slaves() []*Slave {
-	return c.slaves
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	slaves := make([]*Slave, len(c.slaves))
+	copy(slaves, c.slaves)
+	return slaves
 }
 
 func (c *Config) AddSlave(slave *Slave) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	c.slaves = append(c.slaves, slave)
 }
 
-func (c *Config) UpdateOffset(bytes int) {
-	c.replOffset += bytes
+// DisconnectSlaves closes the connection of every replica, forcing them to
+// PSYNC again. Their handlers remove them once the connection is gone
+func (c *Config) DisconnectSlaves() {
+	for _, slave := range c.Slaves() {
+		slave.Close()
+	}
+}
+
+// CheckReplicaOutputLimits disconnects the replicas that stayed over the
+// soft limit of their output buffer, called from the server cron
+func (c *Config) CheckReplicaOutputLimits() {
+	for _, slave := range c.Slaves() {
+		slave.CheckOutputLimits()
+	}
+}
+
+// RemoveSlave drops a disconnected replica
+func (c *Config) RemoveSlave(slave *Slave) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for i, sl := range c.slaves {
+		if sl == slave {
+			c.slaves = append(c.slaves[:i], c.slaves[i+1:]...)
+			return
+		}
+	}
+}
+
+func (c *Config) ReplicaOutputLimits() OutputBufferLimits {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.replicaLimits
+}
+
+// SetReplicaOutputLimits changes the output buffer limits of new and connected replicas
+func (c *Config) SetReplicaOutputLimits(limits OutputBufferLimits) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.replicaLimits = limits
+	for _, slave := range c.slaves {
+		slave.SetOutputLimits(limits)
+	}
+}
+
+// Propagate appends data to the replication stream, moving the replication
+// offset forward, keeping the bytes in the backlog and queueing them for every
+// replica. Both happen under the same lock, so replicas receive the commands
+// in the same order as the backlog records them.
+// It returns the replication offset right after data.
+func (c *Config) Propagate(data string) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.backlog.Append([]byte(data), c.replOffset)
+	c.replOffset += len(data)
+	for _, slave := range c.slaves {
+		slave.PropagateCommand(data)
+	}
+	return c.replOffset
+}
+
+// SetReplicaOf turns the server into a replica of master.
+// The replication ID and offset are kept so that the first PSYNC to the new
+// master can try a partial resynchronization.
+func (c *Config) SetReplicaOf(master string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.role = RoleSlave
+	c.replicaOf = master
+	c.masterLinkUp = false
+}
+
+// PromoteToMaster turns a replica into a master. Like PSYNC2 the current
+// replication ID becomes the secondary one, valid up to the current offset,
+// and a fresh ID is generated for the new history.
+func (c *Config) PromoteToMaster() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.role = RoleMaster
+	c.replicaOf = ""
+	c.masterLinkUp = false
+	c.shiftReplicationID(generateReplicationID())
+}
+
+// SetMasterReplication stores the replication ID and offset announced by the
+// master in a `+FULLRESYNC` reply.
+func (c *Config) SetMasterReplication(replID string, offset int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.replID = replID
+	c.replID2 = emptyReplID()
+	c.secondReplOffset = -1
+	c.replOffset = offset
+	c.backlog.Reset(offset)
+}
+
+// ContinueMasterReplication handles a `+CONTINUE <replid>` reply, switching
+// to the master replication ID if it changed. It reports if the ID changed.
+func (c *Config) ContinueMasterReplication(replID string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if replID == "" || replID == c.replID {
+		return false
+	}
+	c.shiftReplicationID(replID)
+	return true
+}
+
+// CanPartialResync reports if a replica asking for `PSYNC replID offset`
+// can be served from the backlog, returning the missing bytes.
+// As in Redis, the PSYNC offset is the replica offset plus one.
+func (c *Config) CanPartialResync(replID string, psyncOffset int) ([]byte, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if replID != c.replID && (replID != c.replID2 || psyncOffset > c.secondReplOffset) {
+		return nil, false
+	}
+	if psyncOffset < 1 || psyncOffset-1 > c.replOffset {
+		return nil, false
+	}
+	return c.backlog.ReadFrom(psyncOffset-1, c.replOffset)
+}
+
+// MasterLinkUp reports if a replica is connected and synced with its master
+func (c *Config) MasterLinkUp() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.masterLinkUp
+}
+
+func (c *Config) SetMasterLinkUp(up bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.masterLinkUp = up
+}
+
+func (c *Config) ReplicaReadOnly() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.replicaReadOnly
+}
+
+func (c *Config) SetReplicaReadOnly(readOnly bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.replicaReadOnly = readOnly
+}
+
+func (c *Config) ServeStaleData() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.serveStaleData
+}
+
+func (c *Config) SetServeStaleData(serve bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.serveStaleData = serve
+}
+
+func (c *Config) MinReplicasToWrite() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.minReplicasToWrite
+}
+
+func (c *Config) SetMinReplicasToWrite(replicas int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.minReplicasToWrite = replicas
+}
+
+func (c *Config) MinReplicasMaxLag() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.minReplicasMaxLag
+}
+
+func (c *Config) SetMinReplicasMaxLag(seconds int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.minReplicasMaxLag = seconds
+}
+
+func (c *Config) SaveRules() []SaveRule {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.saveRules
+}
+
+func (c *Config) SetSaveRules(rules []SaveRule) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.saveRules = rules
+}
+
+func (c *Config) DisklessSync() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.disklessSync
+}
+
+func (c *Config) SetDisklessSync(diskless bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.disklessSync = diskless
+}
+
+// DisklessSyncDelay is the time in seconds to wait for more replicas
+// before starting a diskless transfer
+func (c *Config) DisklessSyncDelay() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.disklessSyncDelay
+}
+
+func (c *Config) SetDisklessSyncDelay(seconds int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.disklessSyncDelay = seconds
+}
+
+// JoinDisklessSync queues a replica for the next diskless transfer.
+// It reports if the replica is the first one, the caller must then start
+// the transfer after the delay
+func (c *Config) JoinDisklessSync(slave *Slave) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.disklessPending = append(c.disklessPending, slave)
+	return len(c.disklessPending) == 1
+}
+
+// TakeDisklessSync returns the replicas that will share the transfer
+func (c *Config) TakeDisklessSync() []*Slave {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	slaves := c.disklessPending
+	c.disklessPending = nil
+	return slaves
+}
+
+// GoodReplicas counts the online replicas that acknowledged within
+// min-replicas-max-lag, replicas still in their full resync don't count
+func (c *Config) GoodReplicas() int {
+	maxLag := time.Duration(c.MinReplicasMaxLag()) * time.Second
+	good := 0
+	for _, slave := range c.Slaves() {
+		if slave.State() == SlaveOnline && slave.Lag() <= maxLag {
+			good++
+		}
+	}
+	return good
+}
+
+// CanWrite reports if enough replicas are in good shape to accept writes.
+// Only masters with min-replicas-to-write set are restricted
+func (c *Config) CanWrite() bool {
+	minReplicas := c.MinReplicasToWrite()
+	if minReplicas == 0 || c.Role() != RoleMaster {
+		return true
+	}
+	return c.GoodReplicas() >= minReplicas
+}
+
+// AckedReplicas counts the replicas that acknowledged at least offset
+func (c *Config) AckedReplicas(offset int) int {
+	acked := 0
+	for _, slave := range c.Slaves() {
+		if slave.AckOffset() >= offset {
+			acked++
+		}
+	}
+	return acked
+}
+
+// ReplicaAcks returns a channel that is closed on the next replica ACK
+func (c *Config) ReplicaAcks() <-chan struct{} {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.ackNotify
+}
+
+// NotifyReplicaAck wakes up everyone waiting on ReplicaAcks
+func (c *Config) NotifyReplicaAck() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	close(c.ackNotify)
+	c.ackNotify = make(chan struct{})
 }
 
 func (c *Config) RDBFilePath() string {
 	return fmt.Sprintf("%s/%s", c.dir, c.rdbFileName)
 }
 
+func (c *Config) AppendOnly() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.appendOnly
+}
+
+func (c *Config) SetAppendOnly(appendOnly bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.appendOnly = appendOnly
+}
+
+func (c *Config) AppendFileName() string {
+	return c.appendFileName
+}
+
+func (c *Config) AppendDirName() string {
+	return c.appendDirName
+}
+
+// AOFDirPath is the directory holding the files of the AOF and its manifest
+func (c *Config) AOFDirPath() string {
+	return fmt.Sprintf("%s/%s", c.dir, c.appendDirName)
+}
+
+// AOFRDBPreamble tells if rewrites write the base file in RDB format
+func (c *Config) AOFRDBPreamble() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.aofRDBPreamble
+}
+
+func (c *Config) SetAOFRDBPreamble(preamble bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.aofRDBPreamble = preamble
+}
+
+func (c *Config) AOFRewritePercentage() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.aofRewritePercentage
+}
+
+func (c *Config) SetAOFRewritePercentage(percentage int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.aofRewritePercentage = percentage
+}
+
+func (c *Config) AOFRewriteMinSize() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.aofRewriteMinSize
+}
+
+func (c *Config) SetAOFRewriteMinSize(size int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.aofRewriteMinSize = size
+}
+
+// AppendFsync is the appendfsync policy: always, everysec or no
+func (c *Config) AppendFsync() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.appendFsync
+}
+
+func (c *Config) SetAppendFsync(fsync string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.appendFsync = fsync
+}
+
+// AOFLoadTruncated allows loading an AOF whose last command is incomplete
+func (c *Config) AOFLoadTruncated() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.aofLoadTruncated
+}
+
+func (c *Config) SetAOFLoadTruncated(allow bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.aofLoadTruncated = allow
+}
+
+// Cluster returns the cluster state, nil when cluster mode is disabled
+func (c *Config) Cluster() *cluster.State {
+	return c.cluster
+}
+
 func WithPort(port string) Option {
 	return func(c *Config) {
 		c.port = port
@@ -122,10 +637,221 @@ func WithRDBFileName(fileName string) Option {
 	}
 }
 
-func generateReplicationID() string {
+// Requires the lock to be held
+func (c *Config) shiftReplicationID(newID string) {
+	c.replID2 = c.replID
+	c.secondReplOffset = c.replOffset + 1
+	c.replID = newID
+}
+
+func emptyReplID() string {
 	b := make([]byte, replIDSize)
 	for i := range b {
-		b[i] = charset[seededRand.Intn(len(charset))]
+		b[i] = '0'
 	}
 	return string(b)
 }
+
+func WithReplicaReadOnly(readOnly bool) Option {
+	return func(c *Config) {
+		c.replicaReadOnly = readOnly
+	}
+}
+
+func WithServeStaleData(serve bool) Option {
+	return func(c *Config) {
+		c.serveStaleData = serve
+	}
+}
+
+func WithMinReplicasToWrite(replicas int) Option {
+	return func(c *Config) {
+		c.minReplicasToWrite = replicas
+	}
+}
+
+func WithMinReplicasMaxLag(seconds int) Option {
+	return func(c *Config) {
+		c.minReplicasMaxLag = seconds
+	}
+}
+
+func WithSaveRules(rules []SaveRule) Option {
+	return func(c *Config) {
+		c.saveRules = rules
+	}
+}
+
+func WithDisklessSync(diskless bool) Option {
+	return func(c *Config) {
+		c.disklessSync = diskless
+	}
+}
+
+func WithDisklessSyncDelay(seconds int) Option {
+	return func(c *Config) {
+		c.disklessSyncDelay = seconds
+	}
+}
+
+func WithReplicaOutputLimits(limits OutputBufferLimits) Option {
+	return func(c *Config) {
+		c.replicaLimits = limits
+	}
+}
+
+func WithAppendOnly(appendOnly bool) Option {
+	return func(c *Config) {
+		c.appendOnly = appendOnly
+	}
+}
+
+func WithAppendFileName(fileName string) Option {
+	return func(c *Config) {
+		c.appendFileName = fileName
+	}
+}
+
+func WithAppendDirName(dirName string) Option {
+	return func(c *Config) {
+		c.appendDirName = dirName
+	}
+}
+
+func WithAOFRDBPreamble(preamble bool) Option {
+	return func(c *Config) {
+		c.aofRDBPreamble = preamble
+	}
+}
+
+func WithAOFRewritePercentage(percentage int) Option {
+	return func(c *Config) {
+		c.aofRewritePercentage = percentage
+	}
+}
+
+func WithAOFRewriteMinSize(size int) Option {
+	return func(c *Config) {
+		c.aofRewriteMinSize = size
+	}
+}
+
+func WithAppendFsync(fsync string) Option {
+	return func(c *Config) {
+		c.appendFsync = fsync
+	}
+}
+
+func WithAOFLoadTruncated(allow bool) Option {
+	return func(c *Config) {
+		c.aofLoadTruncated = allow
+	}
+}
+
+func WithClusterEnabled(enabled bool) Option {
+	return func(c *Config) {
+		c.clusterEnabled = enabled
+	}
+}
+
+func WithClusterConfigFile(fileName string) Option {
+	return func(c *Config) {
+		c.clusterConfigFile = fileName
+	}
+}
+
+// WithClusterNodeTimeout sets the milliseconds after which a node that
+// doesn't answer is considered failing
+func WithClusterNodeTimeout(timeout int) Option {
+	return func(c *Config) {
+		c.clusterNodeTimeout = timeout
+	}
+}
+
+// ParseMemory parses sizes like `64mb`, `1gb` or `1024` into bytes
+func ParseMemory(size string) (int, error) {
+	units := []struct {
+		suffix string
+		bytes  int
+	}{
+		{"kb", 1024}, {"mb", 1024 * 1024}, {"gb", 1024 * 1024 * 1024},
+		{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000},
+		{"b", 1},
+	}
+
+	size = strings.ToLower(size)
+	multiplier := 1
+	for _, unit := range units {
+		if strings.HasSuffix(size, unit.suffix) {
+			size = strings.TrimSuffix(size, unit.suffix)
+			multiplier = unit.bytes
+			break
+		}
+	}
+
+	value, err := strconv.Atoi(size)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid memory size: %s", size)
+	}
+	return value * multiplier, nil
+}
+
+// ParseOutputBufferLimits parses the `<hard> <soft> <seconds>` values of
+// `client-output-buffer-limit replica`
+func ParseOutputBufferLimits(hard, soft, seconds string) (OutputBufferLimits, error) {
+	hardBytes, err := ParseMemory(hard)
+	if err != nil {
+		return OutputBufferLimits{}, err
+	}
+	softBytes, err := ParseMemory(soft)
+	if err != nil {
+		return OutputBufferLimits{}, err
+	}
+	softSeconds, err := strconv.Atoi(seconds)
+	if err != nil || softSeconds < 0 {
+		return OutputBufferLimits{}, fmt.Errorf("invalid soft limit seconds: %s", seconds)
+	}
+
+	return OutputBufferLimits{
+		Hard:        hardBytes,
+		Soft:        softBytes,
+		SoftSeconds: softSeconds,
+	}, nil
+}
+
+// ParseSaveRules parses `<seconds> <changes>` pairs, an empty string disables snapshotting
+func ParseSaveRules(value string) ([]SaveRule, error) {
+	fields := strings.Fields(value)
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("invalid save rules: %q", value)
+	}
+
+	rules := []SaveRule{}
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err := strconv.Atoi(fields[i])
+		if err != nil || seconds < 0 {
+			return nil, fmt.Errorf("invalid save rules: %q", value)
+		}
+		changes, err := strconv.Atoi(fields[i+1])
+		if err != nil || changes < 0 {
+			return nil, fmt.Errorf("invalid save rules: %q", value)
+		}
+		rules = append(rules, SaveRule{Seconds: seconds, Changes: changes})
+	}
+	return rules, nil
+}
+
+// FormatSaveRules is the inverse of ParseSaveRules
+func FormatSaveRules(rules []SaveRule) string {
+	fields := []string{}
+	for _, rule := range rules {
+		fields = append(fields, strconv.Itoa(rule.Seconds), strconv.Itoa(rule.Changes))
+	}
+	return strings.Join(fields, " ")
+}
+
+func generateReplicationID() string {
+	id := make([]byte, replIDSize/2)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
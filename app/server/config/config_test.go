@@ -0,0 +1,33 @@
+package config
+
+import (
+	"net"
+	"testing"
+)
+
+func TestGoodReplicas(t *testing.T) {
+	tests := []struct {
+		name   string
+		states []string
+		want   int
+	}{
+		{"no replicas", nil, 0},
+		{"waiting for the snapshot", []string{SlaveWaitBgsave}, 0},
+		{"receiving the snapshot", []string{SlaveSendBulk}, 0},
+		{"online", []string{SlaveOnline}, 1},
+		{"mixed", []string{SlaveOnline, SlaveWaitBgsave, SlaveOnline, SlaveSendBulk}, 2},
+	}
+	for _, test := range tests {
+		cfg := NewConfig()
+		for _, state := range test.states {
+			conn, replica := net.Pipe()
+			defer replica.Close()
+			slave := NewSlave(conn, "6380", OutputBufferLimits{})
+			slave.SetState(state)
+			cfg.AddSlave(slave)
+		}
+		if got := cfg.GoodReplicas(); got != test.want {
+			t.Errorf("%s: got %d good replicas, want %d", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package config
+
+import (
+	"errors"
+	"time"
+)
+
+// Paused clients check again for the end of the pause this often
+const pausePollInterval = 10 * time.Millisecond
+
+// States of a FAILOVER as INFO replication reports them
+const (
+	FailoverNone       = "no-failover"
+	FailoverWaitSync   = "waiting-for-sync"
+	FailoverInProgress = "failover-in-progress"
+)
+
+// Failover is the FAILOVER of this master to one of its replicas. Target
+// is empty while any replica can be chosen, End is zero without a timeout
+type Failover struct {
+	State  string
+	Target string
+	End    time.Time
+	Force  bool
+}
+
+// PauseClients pauses the writes of the clients until end, or all their
+// commands with all set. A pause in progress is only extended
+func (c *Config) PauseClients(end time.Time, all bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if time.Now().After(c.pauseEnd) {
+		c.pauseAll = false
+	}
+	c.pauseAll = c.pauseAll || all
+	if end.After(c.pauseEnd) {
+		c.pauseEnd = end
+	}
+}
+
+// UnpauseClients ends the pause of CLIENT PAUSE, not the one of a FAILOVER
+func (c *Config) UnpauseClients() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.pauseEnd = time.Time{}
+	c.pauseAll = false
+}
+
+// WaitPause blocks the command of a client while the clients are paused,
+// write tells if the command is a write
+func (c *Config) WaitPause(write bool) {
+	for {
+		c.lock.RLock()
+		paused := time.Now().Before(c.pauseEnd) && (write || c.pauseAll) ||
+			write && c.failover.State != FailoverNone
+		c.lock.RUnlock()
+		if !paused {
+			return
+		}
+		time.Sleep(pausePollInterval)
+	}
+}
+
+// StartFailover pauses the writes and waits for a replica to catch up with
+// this master, the server cron then hands the master role over to it
+func (c *Config) StartFailover(target string, end time.Time, force bool) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.failover.State != FailoverNone {
+		return errors.New("FAILOVER already in progress")
+	}
+	c.failover = Failover{State: FailoverWaitSync, Target: target, End: end, Force: force}
+	return nil
+}
+
+// SetFailoverTarget records the replica chosen by a FAILOVER, this server
+// is now becoming its replica
+func (c *Config) SetFailoverTarget(target string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.failover.State = FailoverInProgress
+	c.failover.Target = target
+}
+
+// EndFailover resumes the writes once a FAILOVER succeeded or was aborted
+func (c *Config) EndFailover() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.failover = Failover{State: FailoverNone}
+}
+
+func (c *Config) Failover() Failover {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.failover
+}
@@ -2,28 +2,210 @@ package config
 
 import (
 	"bufio"
+	"log"
 	"net"
 	"sync"
+	"time"
+)
+
+// OutputBufferLimits mirrors `client-output-buffer-limit replica <hard> <soft> <seconds>`.
+// A replica is disconnected as soon as its pending output reaches Hard bytes,
+// or when it stays over Soft bytes for SoftSeconds. Zero disables a limit.
+type OutputBufferLimits struct {
+	Hard        int
+	Soft        int
+	SoftSeconds int
+}
+
+// Replica states as reported by INFO replication
+const (
+	SlaveWaitBgsave = "wait_bgsave"
+	SlaveSendBulk   = "send_bulk"
+	SlaveOnline     = "online"
 )
 
 type Slave struct {
-	conn  net.Conn
-	lock  *sync.Mutex
+	conn net.Conn
+	// Commands waiting to be written to the replica, drained by writeLoop
+	// so that slow replicas never hold up the clients
+	pending       []string
+	pendingBytes  int
+	pendingCond   *sync.Cond
+	limits        OutputBufferLimits
+	overSoftSince time.Time
+	// Commands are only written once the replica received the RDB snapshot
+	state         string
+	closed        bool
+	lock          *sync.Mutex
+	listeningPort string
+	ackOffset     int
+	lastAck       time.Time
+	ackLock       *sync.Mutex
+}
+
+func NewSlave(conn net.Conn, listeningPort string, limits OutputBufferLimits) *Slave {
+	lock := &sync.Mutex{}
+	slave := &Slave{
+		conn:          conn,
+		pendingCond:   sync.NewCond(lock),
+		limits:        limits,
+		state:         SlaveWaitBgsave,
+		lock:          lock,
+		listeningPort: listeningPort,
+		lastAck:       time.Now(),
+		ackLock:       &sync.Mutex{},
+	}
+	go slave.writeLoop()
+	return slave
+}
+
+// PropagateCommand queues a command for the replica without waiting for it to be written.
+// Replicas that fall too far behind are disconnected
+func (sl *Slave) PropagateCommand(command string) {
+	sl.lock.Lock()
+	defer sl.lock.Unlock()
+	if sl.closed {
+		return
+	}
+
+	sl.pending = append(sl.pending, command)
+	sl.pendingBytes += len(command)
+	if sl.overOutputLimits() {
+		log.Printf("replica %s exceeded its output buffer limits, closing the connection\n", sl.Addr())
+		sl.close()
+		return
+	}
+	sl.pendingCond.Signal()
+}
+
+// CheckOutputLimits disconnects the replica once it stayed over the soft
+// limit for too long, even when no new command is propagated to it
+func (sl *Slave) CheckOutputLimits() {
+	sl.lock.Lock()
+	defer sl.lock.Unlock()
+	if sl.closed || !sl.overOutputLimits() {
+		return
+	}
+	log.Printf("replica %s exceeded its output buffer limits, closing the connection\n", sl.Addr())
+	sl.close()
+}
+
+// Close disconnects the replica, its client handler notices it and removes it from the config
+func (sl *Slave) Close() {
+	sl.lock.Lock()
+	defer sl.lock.Unlock()
+	sl.close()
+}
+
+// Requires the lock to be held
+func (sl *Slave) close() {
+	if sl.closed {
+		return
+	}
+	sl.closed = true
+	sl.pending = nil
+	sl.conn.Close()
+	sl.pendingCond.Signal()
 }
 
-func NewSlave(conn net.Conn) *Slave {
-	return &Slave{
-		conn: conn,
-		lock: &sync.Mutex{},
+func (sl *Slave) SetOutputLimits(limits OutputBufferLimits) {
+	sl.lock.Lock()
+	defer sl.lock.Unlock()
+	sl.limits = limits
+}
+
+// Requires the lock to be held
+func (sl *Slave) overOutputLimits() bool {
+	if sl.limits.Hard > 0 && sl.pendingBytes >= sl.limits.Hard {
+		return true
 	}
+	if sl.limits.Soft == 0 || sl.pendingBytes < sl.limits.Soft {
+		sl.overSoftSince = time.Time{}
+		return false
+	}
+	if sl.overSoftSince.IsZero() {
+		sl.overSoftSince = time.Now()
+	}
+	return time.Since(sl.overSoftSince) >= time.Duration(sl.limits.SoftSeconds)*time.Second
 }
 
-func (sl *Slave) PropagateCommand(command string, wg *sync.WaitGroup) {
-	defer wg.Done()
+func (sl *Slave) State() string {
+	sl.lock.Lock()
+	defer sl.lock.Unlock()
+	return sl.state
+}
 
+// SetState moves the replica through the full resync, once it is online
+// the commands queued since the snapshot are written to it
+func (sl *Slave) SetState(state string) {
 	sl.lock.Lock()
+	defer sl.lock.Unlock()
+	sl.state = state
+	sl.pendingCond.Signal()
+}
+
+// Conn gives access to the replica connection to transfer the RDB snapshot
+func (sl *Slave) Conn() net.Conn {
+	return sl.conn
+}
+
+func (sl *Slave) writeLoop() {
 	writer := bufio.NewWriter(sl.conn)
-	writer.WriteString(command)
-	writer.Flush()
-	sl.lock.Unlock()
+	for {
+		sl.lock.Lock()
+		for (len(sl.pending) == 0 || sl.state != SlaveOnline) && !sl.closed {
+			sl.pendingCond.Wait()
+		}
+		if sl.closed {
+			sl.lock.Unlock()
+			return
+		}
+		commands := sl.pending
+		sl.pending = nil
+		sl.lock.Unlock()
+
+		written := 0
+		for _, command := range commands {
+			writer.WriteString(command)
+			written += len(command)
+		}
+		if err := writer.Flush(); err != nil {
+			log.Printf("failed to write to replica %s: %s\n", sl.Addr(), err.Error())
+			sl.Close()
+			return
+		}
+
+		sl.lock.Lock()
+		sl.pendingBytes -= written
+		sl.lock.Unlock()
+	}
+}
+
+// Addr is the address the replica announced with `REPLCONF listening-port`
+func (sl *Slave) Addr() string {
+	host, _, _ := net.SplitHostPort(sl.conn.RemoteAddr().String())
+	return net.JoinHostPort(host, sl.listeningPort)
+}
+
+// Ack records the offset sent by the replica in `REPLCONF ACK <offset>`
+func (sl *Slave) Ack(offset int) {
+	sl.ackLock.Lock()
+	defer sl.ackLock.Unlock()
+	if offset > sl.ackOffset {
+		sl.ackOffset = offset
+	}
+	sl.lastAck = time.Now()
+}
+
+func (sl *Slave) AckOffset() int {
+	sl.ackLock.Lock()
+	defer sl.ackLock.Unlock()
+	return sl.ackOffset
+}
+
+// Lag is the time since the last `REPLCONF ACK` of the replica
+func (sl *Slave) Lag() time.Duration {
+	sl.ackLock.Lock()
+	defer sl.ackLock.Unlock()
+	return time.Since(sl.lastAck)
 }
@@ -0,0 +1,46 @@
+package config
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSlaveSoftLimitWithoutTraffic(t *testing.T) {
+	conn, replica := net.Pipe()
+	defer replica.Close()
+	slave := NewSlave(conn, "6380", OutputBufferLimits{Soft: 10, SoftSeconds: 60})
+
+	// The replica is still waiting for its snapshot, commands are queued
+	slave.PropagateCommand("*1\r\n$4\r\nPING\r\n")
+	slave.CheckOutputLimits()
+	if isClosed(slave) {
+		t.Fatal("replica disconnected before the end of the soft limit period")
+	}
+
+	// The master is idle, only the cron notices the end of the period
+	slave.lock.Lock()
+	slave.overSoftSince = time.Now().Add(-time.Minute)
+	slave.lock.Unlock()
+	slave.CheckOutputLimits()
+	if !isClosed(slave) {
+		t.Error("replica still connected after the soft limit period")
+	}
+}
+
+func TestSlaveHardLimit(t *testing.T) {
+	conn, replica := net.Pipe()
+	defer replica.Close()
+	slave := NewSlave(conn, "6380", OutputBufferLimits{Hard: 10})
+
+	slave.PropagateCommand("*1\r\n$4\r\nPING\r\n")
+	if !isClosed(slave) {
+		t.Error("replica still connected over the hard limit")
+	}
+}
+
+func isClosed(sl *Slave) bool {
+	sl.lock.Lock()
+	defer sl.lock.Unlock()
+	return sl.closed
+}
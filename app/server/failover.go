@@ -0,0 +1,124 @@
+package server
+
+import (
+	"cmp"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/server/config"
+)
+
+// Failover starts a FAILOVER of this master to the replica at target, or to
+// the first replica that catches up when target is empty. A forced failover
+// hands the master role over to target at the timeout even if it didn't
+// catch up
+func (s *Server) Failover(target string, timeout time.Duration, force bool) error {
+	if s.cfg.Role() != config.RoleMaster {
+		return errors.New("FAILOVER is not valid when server is a replica")
+	}
+	slaves := s.cfg.Slaves()
+	if len(slaves) == 0 {
+		return errors.New("FAILOVER requires connected replicas")
+	}
+	if force && (timeout == 0 || target == "") {
+		return errors.New("FAILOVER with force option requires both a timeout and target HOST and IP")
+	}
+	if target != "" {
+		var replica *config.Slave
+		for _, slave := range slaves {
+			if slave.Addr() == target {
+				replica = slave
+			}
+		}
+		if replica == nil {
+			return errors.New("FAILOVER target HOST and PORT is not a replica")
+		}
+		if replica.State() != config.SlaveOnline {
+			return errors.New("FAILOVER target replica is not online")
+		}
+	}
+
+	end := time.Time{}
+	if timeout > 0 {
+		end = time.Now().Add(timeout)
+	}
+	if err := s.cfg.StartFailover(target, end, force); err != nil {
+		return err
+	}
+	log.Printf("FAILOVER requested to %s\n", cmp.Or(target, "any replica"))
+	return nil
+}
+
+// AbortFailover stops the FAILOVER in progress, this server stays a master
+func (s *Server) AbortFailover() error {
+	if s.cfg.Failover().State == config.FailoverNone {
+		return errors.New("No failover in progress")
+	}
+	s.abortFailover("Failover manually aborted")
+	return nil
+}
+
+func (s *Server) abortFailover(reason string) {
+	if s.cfg.Failover().State == config.FailoverInProgress {
+		s.PromoteToMaster()
+	}
+	s.cfg.EndFailover()
+	log.Printf("FAILOVER aborted: %s\n", reason)
+}
+
+// Moves a FAILOVER forward from the server cron. Once a replica acknowledged
+// the offset of this master, the server becomes its replica
+func (s *Server) updateFailover() {
+	failover := s.cfg.Failover()
+	if failover.State != config.FailoverWaitSync {
+		return
+	}
+
+	offset := s.cfg.ReplOffset()
+	target := ""
+	for _, slave := range s.cfg.Slaves() {
+		if (failover.Target == "" || slave.Addr() == failover.Target) &&
+			slave.State() == config.SlaveOnline && slave.AckOffset() == offset {
+			target = slave.Addr()
+			break
+		}
+	}
+	if target == "" {
+		if failover.End.IsZero() || time.Now().Before(failover.End) {
+			return
+		}
+		if !failover.Force {
+			s.abortFailover("Replica never caught up before timeout")
+			return
+		}
+		target = failover.Target
+	}
+
+	s.cfg.SetFailoverTarget(target)
+	log.Printf("FAILOVER to %s in progress\n", target)
+	go s.failoverTo(target)
+}
+
+// Turns the server into a replica of target with PSYNC FAILOVER, which
+// makes target promote itself before accepting this server as its replica
+func (s *Server) failoverTo(target string) {
+	s.linkLock.Lock()
+	s.cfg.SetReplicaOf(target)
+	gen := s.resetMasterLink()
+	s.linkLock.Unlock()
+	s.cfg.DisconnectSlaves()
+
+	connHandler, err := s.connectToMaster(gen)
+	if err != nil {
+		// Unless FAILOVER ABORT already gave the master role back
+		if s.isCurrentLink(gen) {
+			s.abortFailover(err.Error())
+		}
+		return
+	}
+
+	s.cfg.EndFailover()
+	log.Printf("FAILOVER to %s succeeded, it is now the master\n", target)
+	s.serveMaster(connHandler, gen)
+}
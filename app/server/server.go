@@ -5,21 +5,36 @@ import (
 	"log"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/codecrafters-io/redis-starter-go/app/handler"
 	"github.com/codecrafters-io/redis-starter-go/app/server/config"
 	"github.com/codecrafters-io/redis-starter-go/app/storage"
 )
 
+const (
+	masterRetryInterval = time.Second
+	cronInterval        = 100 * time.Millisecond
+	// Wait before retrying a failed automatic BGSAVE
+	bgsaveRetryDelay = 5 * time.Second
+)
+
 type Server struct {
 	cfg *config.Config
 	db  *storage.Storage
+	// Connection to the master when running as a replica.
+	// linkGen changes every time the replication topology does,
+	// so that stale master links stop reconnecting.
+	masterLink *handler.Handler
+	linkGen    int
+	linkLock   *sync.Mutex
 }
 
 func NewServer(cfg *config.Config, db *storage.Storage) *Server {
 	return &Server{
-		cfg: cfg,
-		db:  db,
+		cfg:      cfg,
+		db:       db,
+		linkLock: &sync.Mutex{},
 	}
 }
 
@@ -30,8 +45,15 @@ func (s *Server) Start() error {
 	}
 	defer l.Close()
 
-	acksChan := make(chan int, 10)
-	locker := &sync.RWMutex{}
+	if cluster := s.cfg.Cluster(); cluster != nil {
+		cluster.SetReplication(s)
+		if err := cluster.ListenBus(); err != nil {
+			return fmt.Errorf("failed to bind the cluster bus port, error: %w", err)
+		}
+	}
+
+	go s.serverCron()
+
 	// Waiting for a connection
 	for {
 		conn, err := l.Accept()
@@ -40,27 +62,178 @@ func (s *Server) Start() error {
 			continue
 		}
 
-		connHandler := handler.NewHandler(conn, s.db, s.cfg, acksChan, locker)
+		connHandler := handler.NewHandler(conn, s.db, s.cfg, s)
 
 		go s.serveConnection(connHandler)
 	}
 }
 
+// Handshake connects to the master set in the config and starts replicating it.
+// If the link drops later it is re-established in the background
 func (s *Server) Handshake() error {
+	s.linkLock.Lock()
+	gen := s.linkGen
+	s.linkLock.Unlock()
+
+	connHandler, err := s.connectToMaster(gen)
+	if err != nil {
+		return err
+	}
+
+	go s.serveMaster(connHandler, gen)
+	return nil
+}
+
+// ReplicaOf turns the server into a replica of master at runtime,
+// the connection is made in the background like `REPLICAOF` does in Redis
+func (s *Server) ReplicaOf(master string) error {
+	s.linkLock.Lock()
+	s.cfg.SetReplicaOf(master)
+	gen := s.resetMasterLink()
+	s.linkLock.Unlock()
+	s.cfg.DisconnectSlaves()
+
+	go s.serveMaster(nil, gen)
+	return nil
+}
+
+// PromoteToMaster stops replicating and turns the server into a master
+func (s *Server) PromoteToMaster() {
+	s.linkLock.Lock()
+	defer s.linkLock.Unlock()
+
+	s.cfg.PromoteToMaster()
+	s.resetMasterLink()
+	// Replicas reconnect and continue with the new replication ID
+	s.cfg.DisconnectSlaves()
+}
+
+// Closes the current master link and invalidates it. Requires linkLock
+func (s *Server) resetMasterLink() int {
+	if s.masterLink != nil {
+		s.masterLink.Close()
+		s.masterLink = nil
+	}
+	s.linkGen++
+	return s.linkGen
+}
+
+func (s *Server) connectToMaster(gen int) (*handler.Handler, error) {
 	conn, err := net.Dial("tcp", s.cfg.ReplicaOf())
 	if err != nil {
-		return fmt.Errorf("failed to dial with master error: %w", err)
+		return nil, fmt.Errorf("failed to dial with master error: %w", err)
 	}
 
-	acksChan := make(chan int, 10)
-	connHandler := handler.NewHandler(conn, s.db, s.cfg, acksChan, &sync.RWMutex{})
+	connHandler := handler.NewHandler(conn, s.db, s.cfg, s)
 	if err := connHandler.Handshake(); err != nil {
-		return fmt.Errorf("failed to handshake, error: %w", err)
+		conn.Close()
+		return nil, fmt.Errorf("failed to handshake, error: %w", err)
 	}
 
-	go s.serveConnection(connHandler)
+	s.linkLock.Lock()
+	defer s.linkLock.Unlock()
+	if gen != s.linkGen {
+		conn.Close()
+		return nil, fmt.Errorf("replication settings changed during the handshake")
+	}
+	s.masterLink = connHandler
+	s.cfg.SetMasterLinkUp(true)
+	return connHandler, nil
+}
 
-	return nil
+// Serves the master link, reconnecting while the server is still
+// a replica of the same master
+func (s *Server) serveMaster(connHandler *handler.Handler, gen int) {
+	for s.isCurrentLink(gen) {
+		if connHandler == nil {
+			var err error
+			connHandler, err = s.connectToMaster(gen)
+			if err != nil {
+				log.Printf("failed to connect to master %s: %s\n", s.cfg.ReplicaOf(), err.Error())
+				time.Sleep(masterRetryInterval)
+				continue
+			}
+		}
+
+		s.serveConnection(connHandler)
+		connHandler = nil
+		if s.isCurrentLink(gen) {
+			s.cfg.SetMasterLinkUp(false)
+		}
+	}
+}
+
+func (s *Server) isCurrentLink(gen int) bool {
+	s.linkLock.Lock()
+	defer s.linkLock.Unlock()
+	return gen == s.linkGen
+}
+
+// Runs the periodic tasks of the server
+func (s *Server) serverCron() {
+	ticker := time.NewTicker(cronInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.checkSaveRules()
+		s.checkAOFRewrite()
+		s.updateFailover()
+		s.cfg.CheckReplicaOutputLimits()
+		handler.CloseIdleMigrateConnections()
+		if cluster := s.cfg.Cluster(); cluster != nil {
+			cluster.Cron()
+		}
+	}
+}
+
+// Starts a scheduled AOF rewrite, or an automatic one once the AOF grew
+// by auto-aof-rewrite-percentage since the last rewrite
+func (s *Server) checkAOFRewrite() {
+	if !s.db.AOFEnabled() || s.db.AOFRewriteInProgress() {
+		return
+	}
+
+	if !s.db.AOFRewriteScheduled() {
+		percentage := s.cfg.AOFRewritePercentage()
+		currentSize, baseSize := s.db.AOFSize()
+		if percentage == 0 || currentSize < int64(s.cfg.AOFRewriteMinSize()) {
+			return
+		}
+		if baseSize == 0 {
+			baseSize = 1
+		}
+		growth := currentSize*100/baseSize - 100
+		if growth < int64(percentage) {
+			return
+		}
+		log.Printf("starting automatic rewriting of AOF on %d%% growth\n", growth)
+	}
+
+	if err := s.db.RewriteAOF(s.cfg.AOFRDBPreamble()); err != nil {
+		log.Printf("failed to start the AOF rewrite: %s\n", err.Error())
+	}
+}
+
+// Triggers a BGSAVE when any `save <seconds> <changes>` rule is met
+func (s *Server) checkSaveRules() {
+	if s.db.BgsaveInProgress() {
+		return
+	}
+	if !s.db.LastBgsaveOK() && time.Since(s.db.LastBgsaveTry()) < bgsaveRetryDelay {
+		return
+	}
+
+	dirty := s.db.Dirty()
+	sinceLastSave := time.Since(s.db.LastSave())
+	for _, rule := range s.cfg.SaveRules() {
+		if dirty >= rule.Changes && sinceLastSave >= time.Duration(rule.Seconds)*time.Second {
+			log.Printf("%d changes in %d seconds. Saving...\n", rule.Changes, rule.Seconds)
+			if err := s.db.BackgroundSave(s.cfg.RDBFilePath()); err != nil {
+				log.Printf("failed to start background saving: %s\n", err.Error())
+			}
+			return
+		}
+	}
 }
 
 func (s *Server) serveConnection(connHandler *handler.Handler) {
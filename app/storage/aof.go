@@ -0,0 +1,552 @@
+package storage
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/command"
+	"github.com/codecrafters-io/redis-starter-go/rdb"
+)
+
+// appendfsync policies
+const (
+	FsyncAlways   = "always"
+	FsyncEverysec = "everysec"
+	FsyncNo       = "no"
+)
+
+const aofFsyncInterval = time.Second
+
+// ErrAOFTruncated is returned when the AOF ends in the middle of a command
+// and truncated files are not allowed
+var ErrAOFTruncated = errors.New("AOF file is truncated")
+
+var (
+	ErrAOFDisabled          = errors.New("ERR Append only file is disabled")
+	ErrAOFRewriteInProgress = errors.New("ERR Background append only file rewriting already in progress")
+)
+
+// AOF is a multi-part append only file in its own directory. The commands
+// are appended to the last incremental file of the manifest, every command
+// is handed to the OS right away and fsync runs according to the policy
+type AOF struct {
+	dir      string
+	fileName string
+	manifest *Manifest
+	incr     *os.File
+	fsync    string
+	// Set when data was written since the last fsync
+	pending bool
+	lastErr error
+	// Size of the base and incremental files, and the size right after the
+	// last rewrite which the automatic rewrites compare the growth against
+	currentSize     int64
+	rewriteBaseSize int64
+	rewriting       bool
+	// Index of the first incremental file opened by the running rewrite
+	rewriteIncrs     int
+	rewriteScheduled bool
+	lastRewriteOK    bool
+	closed           bool
+	lock             *sync.Mutex
+	stop             chan struct{}
+}
+
+func newAOF(dir, fileName, fsync string, manifest *Manifest) *AOF {
+	aof := &AOF{
+		dir:           dir,
+		fileName:      fileName,
+		manifest:      manifest,
+		fsync:         fsync,
+		lastRewriteOK: true,
+		lock:          &sync.Mutex{},
+		stop:          make(chan struct{}),
+	}
+	go aof.fsyncLoop()
+	return aof
+}
+
+// Append writes a command in its RESP form
+func (a *AOF) Append(data string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.incr == nil {
+		return nil
+	}
+
+	n, err := a.incr.WriteString(data)
+	a.currentSize += int64(n)
+	if err != nil {
+		a.lastErr = err
+		return err
+	}
+	if a.fsync == FsyncAlways {
+		a.lastErr = a.incr.Sync()
+		return a.lastErr
+	}
+	a.pending = true
+	return nil
+}
+
+func (a *AOF) SetFsync(fsync string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.fsync = fsync
+}
+
+// Close syncs the pending data and closes the file, a running rewrite
+// is discarded once it finishes
+func (a *AOF) Close() error {
+	close(a.stop)
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.closed = true
+	if a.incr == nil {
+		return nil
+	}
+	if err := a.incr.Sync(); err != nil {
+		a.incr.Close()
+		return err
+	}
+	return a.incr.Close()
+}
+
+// With everysec at most one second of writes is lost on a crash,
+// with no the OS decides when the data reaches the disk
+func (a *AOF) fsyncLoop() {
+	ticker := time.NewTicker(aofFsyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.stop:
+			return
+		case <-ticker.C:
+			a.lock.Lock()
+			if a.fsync == FsyncEverysec && a.pending && a.incr != nil {
+				a.pending = false
+				if err := a.incr.Sync(); err != nil {
+					log.Printf("failed to fsync the AOF: %s\n", err.Error())
+					a.lastErr = err
+				}
+			}
+			a.lock.Unlock()
+		}
+	}
+}
+
+func (a *AOF) manifestPath() string {
+	return filepath.Join(a.dir, manifestName(a.fileName))
+}
+
+// Keeps appending to the last incremental file, or starts one when there
+// is none. Requires the lock to be held
+func (a *AOF) openLastIncr() error {
+	if len(a.manifest.Incrs) == 0 {
+		return a.openNewIncr()
+	}
+
+	info := a.manifest.Incrs[len(a.manifest.Incrs)-1]
+	file, err := os.OpenFile(filepath.Join(a.dir, info.Name), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	a.incr = file
+	return nil
+}
+
+// Switches the appends to a new incremental file. The manifest is only
+// persisted when it has a base, an AOF started at runtime has no valid
+// manifest until its first rewrite is done. Requires the lock to be held
+func (a *AOF) openNewIncr() error {
+	if err := os.MkdirAll(a.dir, 0o755); err != nil {
+		return err
+	}
+
+	info := a.manifest.nextIncr(a.fileName)
+	file, err := os.OpenFile(filepath.Join(a.dir, info.Name), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+
+	if a.incr != nil {
+		if err := a.incr.Sync(); err != nil {
+			log.Printf("failed to fsync the AOF: %s\n", err.Error())
+		}
+		a.incr.Close()
+	}
+	a.incr = file
+	a.pending = false
+	a.manifest.Incrs = append(a.manifest.Incrs, info)
+
+	if a.manifest.Base == nil {
+		return nil
+	}
+	return a.manifest.Write(a.manifestPath())
+}
+
+// Installs the base written by a rewrite, the files it replaces become
+// history and are deleted once the new manifest is in place
+func (a *AOF) finishRewrite(base AOFInfo, err error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.rewriting = false
+
+	if err == nil && a.closed {
+		err = fmt.Errorf("the AOF was disabled")
+	}
+	a.lastRewriteOK = err == nil
+	if err != nil {
+		log.Printf("background AOF rewrite failed: %s\n", err.Error())
+		os.Remove(filepath.Join(a.dir, base.Name))
+		return
+	}
+
+	if a.manifest.Base != nil {
+		old := *a.manifest.Base
+		old.Type = AOFTypeHistory
+		a.manifest.History = append(a.manifest.History, old)
+	}
+	for _, info := range a.manifest.Incrs[:a.rewriteIncrs] {
+		info.Type = AOFTypeHistory
+		a.manifest.History = append(a.manifest.History, info)
+	}
+	a.manifest.Base = &base
+	a.manifest.Incrs = a.manifest.Incrs[a.rewriteIncrs:]
+	if err := a.manifest.Write(a.manifestPath()); err != nil {
+		log.Printf("failed to write the AOF manifest: %s\n", err.Error())
+		a.lastRewriteOK = false
+		return
+	}
+
+	for _, info := range a.manifest.History {
+		os.Remove(filepath.Join(a.dir, info.Name))
+	}
+	a.manifest.History = nil
+	if err := a.manifest.Write(a.manifestPath()); err != nil {
+		log.Printf("failed to write the AOF manifest: %s\n", err.Error())
+	}
+
+	a.currentSize = a.filesSize()
+	a.rewriteBaseSize = a.currentSize
+	log.Println("background AOF rewrite terminated with success")
+}
+
+// Size of the base and incremental files. Requires the lock to be held
+func (a *AOF) filesSize() int64 {
+	size := int64(0)
+	for _, info := range a.manifest.Files() {
+		if stat, err := os.Stat(filepath.Join(a.dir, info.Name)); err == nil {
+			size += stat.Size()
+		}
+	}
+	return size
+}
+
+// OpenAOF starts appending the write commands to the AOF in dir. Without
+// a manifest the AOF is created with a rewrite of the current dataset
+func (s *Storage) OpenAOF(dir, fileName, fsync string, rdbPreamble bool) error {
+	manifest, err := ReadManifest(filepath.Join(dir, manifestName(fileName)))
+	if errors.Is(err, os.ErrNotExist) {
+		manifest = &Manifest{}
+	} else if err != nil {
+		return err
+	}
+
+	aof := newAOF(dir, fileName, fsync, manifest)
+	s.aofLock.Lock()
+	s.aof = aof
+	s.aofLock.Unlock()
+
+	if manifest.Base == nil && len(manifest.Incrs) == 0 {
+		return s.RewriteAOF(rdbPreamble)
+	}
+
+	aof.lock.Lock()
+	defer aof.lock.Unlock()
+	aof.currentSize = aof.filesSize()
+	aof.rewriteBaseSize = aof.currentSize
+	return aof.openLastIncr()
+}
+
+// RewriteAOF compacts the AOF into a new base file with a snapshot of the
+// dataset, like `BGREWRITEAOF`. The writes arriving while the base is
+// written go to a new incremental file, which the new manifest keeps
+func (s *Storage) RewriteAOF(rdbPreamble bool) error {
+	s.aofLock.Lock()
+	aof := s.aof
+	s.aofLock.Unlock()
+	if aof == nil {
+		return ErrAOFDisabled
+	}
+
+	aof.lock.Lock()
+	if aof.rewriting {
+		aof.lock.Unlock()
+		return ErrAOFRewriteInProgress
+	}
+	aof.rewriting = true
+	aof.rewriteScheduled = false
+	aof.lock.Unlock()
+
+	var entries []rdb.Entry
+	var base AOFInfo
+	var err error
+	s.Freeze(func() {
+		entries = s.Snapshot()
+
+		aof.lock.Lock()
+		defer aof.lock.Unlock()
+		base = aof.manifest.nextBase(aof.fileName, rdbPreamble)
+		err = aof.openNewIncr()
+		aof.rewriteIncrs = len(aof.manifest.Incrs) - 1
+	})
+	if err != nil {
+		aof.lock.Lock()
+		aof.rewriting = false
+		aof.lastRewriteOK = false
+		aof.lock.Unlock()
+		return err
+	}
+
+	go func() {
+		path := filepath.Join(aof.dir, base.Name)
+		tempName := fmt.Sprintf("temp-rewriteaof-bg-%d.aof", os.Getpid())
+		err := writeFileAtomically(path, tempName, func(w io.Writer) error {
+			if rdbPreamble {
+				return WriteRDB(w, entries)
+			}
+			return writeAOFBase(w, entries)
+		})
+		aof.finishRewrite(base, err)
+	}()
+	return nil
+}
+
+// ScheduleAOFRewrite asks for a rewrite on the next server cron, used when
+// the dataset was replaced and the current AOF no longer describes it
+func (s *Storage) ScheduleAOFRewrite() {
+	s.aofState(func(aof *AOF) bool {
+		aof.rewriteScheduled = true
+		return true
+	})
+}
+
+// AOFRewriteScheduled reports if a rewrite is waiting to start
+func (s *Storage) AOFRewriteScheduled() bool {
+	return s.aofState(func(aof *AOF) bool { return aof.rewriteScheduled })
+}
+
+func (s *Storage) AOFRewriteInProgress() bool {
+	return s.aofState(func(aof *AOF) bool { return aof.rewriting })
+}
+
+// AOFLastRewriteOK is false when the last rewrite failed
+func (s *Storage) AOFLastRewriteOK() bool {
+	return !s.aofState(func(aof *AOF) bool { return !aof.lastRewriteOK })
+}
+
+// AOFSize returns the current size of the AOF and its size after the last rewrite
+func (s *Storage) AOFSize() (int64, int64) {
+	var current, base int64
+	s.aofState(func(aof *AOF) bool {
+		current, base = aof.currentSize, aof.rewriteBaseSize
+		return true
+	})
+	return current, base
+}
+
+// Runs read under the lock of the AOF, false when the AOF is disabled
+func (s *Storage) aofState(read func(*AOF) bool) bool {
+	s.aofLock.Lock()
+	aof := s.aof
+	s.aofLock.Unlock()
+	if aof == nil {
+		return false
+	}
+
+	aof.lock.Lock()
+	defer aof.lock.Unlock()
+	return read(aof)
+}
+
+// A base in AOF format has a SET command per key, only strings can be
+// written this way, other values require the RDB preamble
+func writeAOFBase(w io.Writer, entries []rdb.Entry) error {
+	for _, entry := range entries {
+		value, isString := entry.Value.(rdb.String)
+		if !isString {
+			return fmt.Errorf("key %s holds a %s, enable aof-use-rdb-preamble to rewrite it", entry.Key, entry.Value.TypeName())
+		}
+
+		if _, err := io.WriteString(w, command.NewArray(setCommand(entry.Key, string(value), entry.ExpireAt))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SET with an absolute expiration so keys don't live longer once replayed
+func setCommand(key, value string, expireAt int64) []string {
+	args := []string{strings.ToUpper(command.Set), key, value}
+	if expireAt != 0 {
+		args = append(args, strings.ToUpper(command.Pxat), strconv.FormatInt(expireAt, 10))
+	}
+	return args
+}
+
+// LoadAOF loads the base file and replays the incremental files listed in
+// the manifest in dir. Only the last file may be truncated. A single file
+// AOF from older versions is loaded and moved into dir as the base file
+func (s *Storage) LoadAOF(dir, fileName string, allowTruncated bool, apply func(*command.Command) error) error {
+	manifest, err := ReadManifest(filepath.Join(dir, manifestName(fileName)))
+	if errors.Is(err, os.ErrNotExist) {
+		return s.upgradeAOF(dir, fileName, allowTruncated, apply)
+	}
+	if err != nil {
+		return err
+	}
+
+	files := manifest.Files()
+	for i, info := range files {
+		path := filepath.Join(dir, info.Name)
+		if strings.HasSuffix(info.Name, ".rdb") {
+			err = s.ReadRDBFile(path)
+		} else {
+			err = ReadAOF(path, allowTruncated && i == len(files)-1, apply)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to load %s: %w", info.Name, err)
+		}
+	}
+	return nil
+}
+
+func (s *Storage) upgradeAOF(dir, fileName string, allowTruncated bool, apply func(*command.Command) error) error {
+	legacyPath := filepath.Join(filepath.Dir(dir), fileName)
+	if _, err := os.Stat(legacyPath); errors.Is(err, os.ErrNotExist) {
+		log.Printf("append only file doesn't exist in %s, starting with an empty dataset\n", dir)
+		return nil
+	}
+
+	if err := ReadAOF(legacyPath, allowTruncated, apply); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	if err := os.Rename(legacyPath, filepath.Join(dir, fileName)); err != nil {
+		return err
+	}
+
+	manifest := &Manifest{Base: &AOFInfo{Name: fileName, Seq: 1, Type: AOFTypeBase}}
+	log.Printf("moved the append only file %s into %s\n", fileName, dir)
+	return manifest.Write(filepath.Join(dir, manifestName(fileName)))
+}
+
+// ReadAOF parses the commands of the AOF at path and passes them to apply.
+// When the file ends in the middle of a command and allowTruncated is set,
+// the incomplete tail is cut off from the file like Redis does with
+// aof-load-truncated
+func ReadAOF(path string, allowTruncated bool, apply func(*command.Command) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(file)
+	offset := int64(0)
+	loaded := 0
+	for offset < info.Size() {
+		userCommand, err := command.NewCommand(reader)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return truncateAOF(path, offset, info.Size(), allowTruncated)
+		}
+		if err != nil {
+			return fmt.Errorf("bad file format reading the append only file at offset %d: %w", offset, err)
+		}
+		if len(userCommand.Args) == 0 {
+			return fmt.Errorf("bad file format reading the append only file at offset %d", offset)
+		}
+
+		if err := apply(userCommand); err != nil {
+			return fmt.Errorf("failed to replay the command at offset %d of the append only file: %w", offset, err)
+		}
+		offset += int64(userCommand.Size)
+		loaded++
+	}
+
+	log.Printf("loaded %d commands from %s\n", loaded, filepath.Base(path))
+	return nil
+}
+
+func truncateAOF(path string, offset, size int64, allowTruncated bool) error {
+	if !allowTruncated {
+		return fmt.Errorf("%w, the last command at offset %d is incomplete", ErrAOFTruncated, offset)
+	}
+
+	log.Printf("AOF loaded anyway because aof-load-truncated is enabled, truncating %d bytes at offset %d\n",
+		size-offset, offset)
+	return os.Truncate(path, offset)
+}
+
+// AppendAOF writes a command to the AOF when it is enabled
+func (s *Storage) AppendAOF(data string) {
+	s.aofLock.Lock()
+	aof := s.aof
+	s.aofLock.Unlock()
+	if aof == nil {
+		return
+	}
+
+	if err := aof.Append(data); err != nil {
+		log.Printf("failed to write to the AOF: %s\n", err.Error())
+	}
+}
+
+func (s *Storage) SetAOFFsync(fsync string) {
+	s.aofLock.Lock()
+	defer s.aofLock.Unlock()
+	if s.aof != nil {
+		s.aof.SetFsync(fsync)
+	}
+}
+
+func (s *Storage) AOFEnabled() bool {
+	s.aofLock.Lock()
+	defer s.aofLock.Unlock()
+	return s.aof != nil
+}
+
+// AOFLastWriteOK is false when the last write or fsync of the AOF failed
+func (s *Storage) AOFLastWriteOK() bool {
+	return !s.aofState(func(aof *AOF) bool { return aof.lastErr != nil })
+}
+
+// CloseAOF syncs and closes the AOF, used on shutdown and when appendonly is disabled
+func (s *Storage) CloseAOF() error {
+	s.aofLock.Lock()
+	aof := s.aof
+	s.aof = nil
+	s.aofLock.Unlock()
+	if aof == nil {
+		return nil
+	}
+	return aof.Close()
+}
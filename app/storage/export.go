@@ -0,0 +1,292 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/command"
+	"github.com/codecrafters-io/redis-starter-go/rdb"
+)
+
+// Formats of a keyspace export
+const (
+	ExportJSON = "json"
+	ExportRESP = "resp"
+)
+
+// ExportedKey is a line of a JSON export. TTL is the time to live in
+// milliseconds, -1 when the key doesn't expire. The value is a string,
+// a list of strings for lists and sets, a list of members for sorted sets
+// and an object for hashes. Streams are not decoded, their value is their
+// DUMP payload in base64
+type ExportedKey struct {
+	Key   string `json:"key"`
+	Type  string `json:"type"`
+	TTL   int64  `json:"ttl"`
+	Value any    `json:"value"`
+}
+
+// ExportedMember is a member of a sorted set. The score is a string since
+// JSON has no infinities, they are written as inf and -inf like Redis does
+type ExportedMember struct {
+	Member string `json:"member"`
+	Score  string `json:"score"`
+}
+
+// Export writes the entries as JSON lines or as a RESP command stream that
+// can be sent to a server with `redis-cli --pipe`
+func Export(w io.Writer, entries []rdb.Entry, format string) error {
+	switch format {
+	case ExportJSON:
+		return exportJSON(w, entries)
+	case ExportRESP:
+		return exportRESP(w, entries)
+	default:
+		return fmt.Errorf("unknown export format %s", format)
+	}
+}
+
+func exportJSON(w io.Writer, entries []rdb.Entry) error {
+	encoder := json.NewEncoder(w)
+	now := time.Now().UnixMilli()
+	for _, entry := range entries {
+		exported := ExportedKey{Key: entry.Key, Type: entry.Value.TypeName(), TTL: -1}
+		if entry.ExpireAt != 0 {
+			// A key about to expire still needs a positive TTL
+			exported.TTL = max(entry.ExpireAt-now, 1)
+		}
+
+		switch value := entry.Value.(type) {
+		case rdb.String:
+			exported.Value = string(value)
+		case rdb.List:
+			exported.Value = []string(value)
+		case rdb.Set:
+			exported.Value = []string(value)
+		case rdb.ZSet:
+			members := make([]ExportedMember, 0, len(value))
+			for _, member := range value {
+				members = append(members, ExportedMember{Member: member.Member, Score: formatScore(member.Score)})
+			}
+			exported.Value = members
+		case rdb.Hash:
+			fields := make(map[string]string, len(value))
+			for _, field := range value {
+				fields[field.Field] = field.Value
+			}
+			exported.Value = fields
+		case rdb.Stream:
+			payload, err := rdb.Dump(value)
+			if err != nil {
+				return err
+			}
+			exported.Value = payload
+		}
+
+		if err := encoder.Encode(exported); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The commands that create the keys: SET for strings and RESTORE with a
+// DUMP payload for the other types, the server having no command to write them
+func exportRESP(w io.Writer, entries []rdb.Entry) error {
+	for _, entry := range entries {
+		args := []string{}
+		if value, isString := entry.Value.(rdb.String); isString {
+			args = setCommand(entry.Key, string(value), entry.ExpireAt)
+		} else {
+			payload, err := rdb.Dump(entry.Value)
+			if err != nil {
+				return err
+			}
+			args = restoreCommand(entry.Key, payload, entry.ExpireAt, true)
+		}
+		if _, err := io.WriteString(w, command.NewArray(args)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RESTORE replacing the key, with an absolute expiration when absolute is
+// set and a time to live otherwise. A zero ttl means the key doesn't expire
+func restoreCommand(key string, payload []byte, ttl int64, absolute bool) []string {
+	args := []string{strings.ToUpper(command.Restore), key, strconv.FormatInt(ttl, 10), string(payload),
+		strings.ToUpper(command.Replace)}
+	if absolute && ttl != 0 {
+		args = append(args, strings.ToUpper(command.Absttl))
+	}
+	return args
+}
+
+func formatScore(score float64) string {
+	switch {
+	case math.IsInf(score, 1):
+		return "inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(score, 'g', 17, 64)
+}
+
+// ExportFile writes the dataset to path in the given format
+func (s *Storage) ExportFile(path, format string) error {
+	entries := s.Snapshot()
+	return writeFileAtomically(path, fmt.Sprintf("temp-export-%d.%s", os.Getpid(), format), func(w io.Writer) error {
+		return Export(w, entries, format)
+	})
+}
+
+// ReadExport parses an export and passes the commands that recreate its
+// keys to apply, JSON lines are turned into SET commands for strings and
+// RESTORE commands for the other types, with a relative expiration
+func ReadExport(r io.Reader, format string, apply func(*command.Command) error) error {
+	switch format {
+	case ExportJSON:
+		return readJSONExport(r, apply)
+	case ExportRESP:
+		return readRESPExport(r, apply)
+	default:
+		return fmt.Errorf("unknown export format %s", format)
+	}
+}
+
+func readJSONExport(r io.Reader, apply func(*command.Command) error) error {
+	decoder := json.NewDecoder(r)
+	for line := 1; ; line++ {
+		var exported struct {
+			ExportedKey
+			Value json.RawMessage `json:"value"`
+		}
+		err := decoder.Decode(&exported)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("invalid export at line %d: %w", line, err)
+		}
+
+		args, err := importCommand(exported.Key, exported.Type, exported.TTL, exported.Value)
+		if err != nil {
+			return fmt.Errorf("invalid value of key %s at line %d: %w", exported.Key, line, err)
+		}
+		raw := command.NewArray(args)
+		if err := apply(&command.Command{Args: args, Size: len(raw), Raw: raw}); err != nil {
+			return err
+		}
+	}
+}
+
+// The command recreating a key of a JSON export
+func importCommand(key, valueType string, ttl int64, data json.RawMessage) ([]string, error) {
+	if valueType == "string" {
+		var value string
+		if err := json.Unmarshal(data, &value); err != nil {
+			return nil, err
+		}
+		args := []string{strings.ToUpper(command.Set), key, value}
+		if ttl > 0 {
+			args = append(args, strings.ToUpper(command.Px), strconv.FormatInt(ttl, 10))
+		}
+		return args, nil
+	}
+
+	payload, err := importPayload(valueType, data)
+	if err != nil {
+		return nil, err
+	}
+	return restoreCommand(key, payload, max(ttl, 0), false), nil
+}
+
+// The DUMP payload of a value of a JSON export that isn't a string
+func importPayload(valueType string, data json.RawMessage) ([]byte, error) {
+	var value rdb.Value
+	switch valueType {
+	case "list", "set":
+		var elements []string
+		if err := json.Unmarshal(data, &elements); err != nil {
+			return nil, err
+		}
+		value = rdb.List(elements)
+		if valueType == "set" {
+			value = rdb.Set(elements)
+		}
+	case "zset":
+		var members []ExportedMember
+		if err := json.Unmarshal(data, &members); err != nil {
+			return nil, err
+		}
+		zset := make(rdb.ZSet, 0, len(members))
+		for _, member := range members {
+			score, err := strconv.ParseFloat(member.Score, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid score %q of member %s", member.Score, member.Member)
+			}
+			zset = append(zset, rdb.ZMember{Member: member.Member, Score: score})
+		}
+		value = zset
+	case "hash":
+		var fields map[string]string
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return nil, err
+		}
+		names := make([]string, 0, len(fields))
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		hash := make(rdb.Hash, 0, len(fields))
+		for _, name := range names {
+			hash = append(hash, rdb.HashField{Field: name, Value: fields[name]})
+		}
+		value = hash
+	case "stream":
+		// Already a DUMP payload, RESTORE verifies it
+		var payload []byte
+		if err := json.Unmarshal(data, &payload); err != nil {
+			return nil, err
+		}
+		return payload, nil
+	default:
+		return nil, fmt.Errorf("unknown type %s", valueType)
+	}
+	return rdb.Dump(value)
+}
+
+func readRESPExport(r io.Reader, apply func(*command.Command) error) error {
+	reader := bufio.NewReader(r)
+	offset := 0
+	for {
+		if _, err := reader.Peek(1); err == io.EOF {
+			return nil
+		}
+
+		userCommand, err := command.NewCommand(reader)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return fmt.Errorf("the export ends in the middle of the command at offset %d", offset)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid export at offset %d: %w", offset, err)
+		}
+		if len(userCommand.Args) == 0 {
+			return fmt.Errorf("invalid export at offset %d", offset)
+		}
+
+		if err := apply(userCommand); err != nil {
+			return err
+		}
+		offset += userCommand.Size
+	}
+}
@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/codecrafters-io/redis-starter-go/app/command"
+	"github.com/codecrafters-io/redis-starter-go/rdb"
+)
+
+// Every format of export is read back into the commands recreating the keys
+func TestExportRoundTrip(t *testing.T) {
+	entries := []rdb.Entry{
+		{Key: "string", Value: rdb.String("value")},
+		{Key: "list", Value: rdb.List{"a", "b", "a"}},
+		{Key: "set", Value: rdb.Set{"x", "y"}},
+		{Key: "zset", Value: rdb.ZSet{{Member: "m", Score: 1.5}, {Member: "top", Score: math.Inf(1)}}},
+		{Key: "hash", Value: rdb.Hash{{Field: "a", Value: "1"}, {Field: "b", Value: "2"}}},
+	}
+
+	for _, format := range []string{ExportJSON, ExportRESP} {
+		export := &bytes.Buffer{}
+		if err := Export(export, entries, format); err != nil {
+			t.Fatalf("%s: %s", format, err)
+		}
+
+		imported := []rdb.Entry{}
+		err := ReadExport(export, format, func(userCommand *command.Command) error {
+			args := userCommand.Args
+			switch strings.ToLower(args[0]) {
+			case command.Set:
+				imported = append(imported, rdb.Entry{Key: args[1], Value: rdb.String(args[2])})
+			case command.Restore:
+				value, err := rdb.Restore([]byte(args[3]))
+				if err != nil {
+					return err
+				}
+				imported = append(imported, rdb.Entry{Key: args[1], Value: value})
+			default:
+				t.Errorf("%s: unexpected command %q", format, args)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s: %s", format, err)
+		}
+		if !reflect.DeepEqual(imported, entries) {
+			t.Errorf("%s: got %v, want %v", format, imported, entries)
+		}
+	}
+}
+
+func TestExportExpiration(t *testing.T) {
+	entries := []rdb.Entry{
+		{Key: "string", Value: rdb.String("value"), ExpireAt: 4102444800000},
+		{Key: "list", Value: rdb.List{"a"}, ExpireAt: 4102444800000},
+	}
+	export := &bytes.Buffer{}
+	if err := Export(export, entries, ExportRESP); err != nil {
+		t.Fatal(err)
+	}
+
+	commands := [][]string{}
+	err := ReadExport(export, ExportRESP, func(userCommand *command.Command) error {
+		commands = append(commands, userCommand.Args)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commands) != 2 || !reflect.DeepEqual(commands[0][3:], []string{"PXAT", "4102444800000"}) ||
+		commands[1][2] != "4102444800000" || !reflect.DeepEqual(commands[1][4:], []string{"REPLACE", "ABSTTL"}) {
+		t.Errorf("got %q, want absolute expirations", commands)
+	}
+}
+
+func TestReadJSONExportInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+	}{
+		{"unknown type", `{"key":"k","type":"module","ttl":-1,"value":"x"}`},
+		{"list of numbers", `{"key":"k","type":"list","ttl":-1,"value":[1,2]}`},
+		{"invalid score", `{"key":"k","type":"zset","ttl":-1,"value":[{"member":"m","score":"high"}]}`},
+		{"not json", `{"key":`},
+	}
+	for _, test := range tests {
+		err := ReadExport(strings.NewReader(test.line), ExportJSON, func(*command.Command) error { return nil })
+		if err == nil {
+			t.Errorf("%s: read without error", test.name)
+		}
+	}
+}
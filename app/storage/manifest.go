@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Types of the files listed in the AOF manifest
+const (
+	AOFTypeBase    = "b"
+	AOFTypeIncr    = "i"
+	AOFTypeHistory = "h"
+)
+
+// AOFInfo is a `file <name> seq <seq> type <type>` line of the manifest
+type AOFInfo struct {
+	Name string
+	Seq  int
+	Type string
+}
+
+// Manifest tracks the files of a multi-part AOF: a base file with a
+// snapshot of the dataset followed by the incremental files with the
+// commands received since. History files are left by a rewrite and
+// deleted once the new manifest is written
+type Manifest struct {
+	Base    *AOFInfo
+	Incrs   []AOFInfo
+	History []AOFInfo
+}
+
+func manifestName(fileName string) string {
+	return fileName + ".manifest"
+}
+
+// ReadManifest parses the manifest at path
+func ReadManifest(path string) (*Manifest, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	manifest := &Manifest{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		info, err := parseAOFInfo(line)
+		if err != nil {
+			return nil, err
+		}
+		switch info.Type {
+		case AOFTypeBase:
+			if manifest.Base != nil {
+				return nil, fmt.Errorf("invalid AOF manifest, found more than one base file")
+			}
+			manifest.Base = &info
+		case AOFTypeIncr:
+			manifest.Incrs = append(manifest.Incrs, info)
+		case AOFTypeHistory:
+			manifest.History = append(manifest.History, info)
+		default:
+			return nil, fmt.Errorf("invalid AOF manifest, unknown file type %s", info.Type)
+		}
+	}
+	return manifest, scanner.Err()
+}
+
+func parseAOFInfo(line string) (AOFInfo, error) {
+	fields := strings.Fields(line)
+	if len(fields)%2 != 0 {
+		return AOFInfo{}, fmt.Errorf("invalid AOF manifest line: %s", line)
+	}
+
+	info := AOFInfo{}
+	for i := 0; i < len(fields); i += 2 {
+		switch fields[i] {
+		case "file":
+			info.Name = fields[i+1]
+		case "seq":
+			seq, err := strconv.Atoi(fields[i+1])
+			if err != nil {
+				return AOFInfo{}, fmt.Errorf("invalid AOF manifest line: %s", line)
+			}
+			info.Seq = seq
+		case "type":
+			info.Type = fields[i+1]
+		}
+	}
+	if info.Name == "" || info.Type == "" {
+		return AOFInfo{}, fmt.Errorf("invalid AOF manifest line: %s", line)
+	}
+	return info, nil
+}
+
+// Files returns the base file and the incremental files in loading order
+func (m *Manifest) Files() []AOFInfo {
+	files := []AOFInfo{}
+	if m.Base != nil {
+		files = append(files, *m.Base)
+	}
+	return append(files, m.Incrs...)
+}
+
+// Write replaces the manifest at path, the file is renamed into place so
+// a crash leaves either the old or the new manifest
+func (m *Manifest) Write(path string) error {
+	return writeFileAtomically(path, "temp-"+filepath.Base(path), func(w io.Writer) error {
+		lines := []AOFInfo{}
+		if m.Base != nil {
+			lines = append(lines, *m.Base)
+		}
+		lines = append(lines, m.History...)
+		lines = append(lines, m.Incrs...)
+
+		for _, info := range lines {
+			if _, err := fmt.Fprintf(w, "file %s seq %d type %s\n", info.Name, info.Seq, info.Type); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Next incremental file, its sequence follows the last one
+func (m *Manifest) nextIncr(fileName string) AOFInfo {
+	seq := 1
+	if len(m.Incrs) > 0 {
+		seq = m.Incrs[len(m.Incrs)-1].Seq + 1
+	}
+	return AOFInfo{Name: fmt.Sprintf("%s.%d.incr.aof", fileName, seq), Seq: seq, Type: AOFTypeIncr}
+}
+
+// Next base file, in RDB or AOF format
+func (m *Manifest) nextBase(fileName string, rdbFormat bool) AOFInfo {
+	seq := 1
+	if m.Base != nil {
+		seq = m.Base.Seq + 1
+	}
+	extension := "aof"
+	if rdbFormat {
+		extension = "rdb"
+	}
+	return AOFInfo{Name: fmt.Sprintf("%s.%d.base.%s", fileName, seq, extension), Seq: seq, Type: AOFTypeBase}
+}
@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadManifest(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof.manifest")
+	content := "# comment\n" +
+		"file appendonly.aof.2.base.rdb seq 2 type b\n" +
+		"file appendonly.aof.1.incr.aof seq 1 type h\n" +
+		"\n" +
+		"file appendonly.aof.3.incr.aof seq 3 type i\n" +
+		"file appendonly.aof.4.incr.aof seq 4 type i\n"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := ReadManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Manifest{
+		Base:    &AOFInfo{Name: "appendonly.aof.2.base.rdb", Seq: 2, Type: AOFTypeBase},
+		History: []AOFInfo{{Name: "appendonly.aof.1.incr.aof", Seq: 1, Type: AOFTypeHistory}},
+		Incrs: []AOFInfo{
+			{Name: "appendonly.aof.3.incr.aof", Seq: 3, Type: AOFTypeIncr},
+			{Name: "appendonly.aof.4.incr.aof", Seq: 4, Type: AOFTypeIncr},
+		},
+	}
+	if !reflect.DeepEqual(manifest, want) {
+		t.Errorf("got %+v, want %+v", manifest, want)
+	}
+	if files := manifest.Files(); len(files) != 3 || files[0] != *want.Base {
+		t.Errorf("got files %+v, want the base followed by the incremental files", files)
+	}
+	if next := manifest.nextIncr("appendonly.aof"); next.Name != "appendonly.aof.5.incr.aof" || next.Seq != 5 {
+		t.Errorf("got next incremental file %+v", next)
+	}
+
+	// Writing it back keeps the same content
+	if err := manifest.Write(path); err != nil {
+		t.Fatal(err)
+	}
+	written, err := ReadManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(written, want) {
+		t.Errorf("got %+v after writing, want %+v", written, want)
+	}
+}
+
+func TestReadManifestInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"odd number of fields", "file a.aof seq 1 type\n"},
+		{"missing type", "file a.aof seq 1\n"},
+		{"invalid seq", "file a.aof seq one type i\n"},
+		{"unknown type", "file a.aof seq 1 type x\n"},
+		{"two base files", "file a.rdb seq 1 type b\nfile b.rdb seq 2 type b\n"},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "appendonly.aof.manifest")
+		if err := os.WriteFile(path, []byte(test.content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadManifest(path); err == nil {
+			t.Errorf("%s: read without error", test.name)
+		}
+	}
+}
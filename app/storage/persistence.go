@@ -0,0 +1,189 @@
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/rdb"
+)
+
+const redisVersion = "7.2.0"
+
+// ErrBgsaveInProgress is returned when a save is requested while a background save runs
+var ErrBgsaveInProgress = fmt.Errorf("Background save already in progress")
+
+// AuxFields are the metadata written at the start of every RDB file
+func AuxFields() []rdb.AuxField {
+	return []rdb.AuxField{
+		{Key: "redis-ver", Value: redisVersion},
+		{Key: "redis-bits", Value: strconv.Itoa(strconv.IntSize)},
+		{Key: "ctime", Value: strconv.FormatInt(time.Now().Unix(), 10)},
+		{Key: "aof-base", Value: "0"},
+	}
+}
+
+// WriteRDB writes a RDB file with the given entries
+func WriteRDB(w io.Writer, entries []rdb.Entry) error {
+	return rdb.Save(w, AuxFields(), entries)
+}
+
+// Save writes the dataset to path, blocking writes while it runs like `SAVE`
+func (s *Storage) Save(path string) error {
+	s.saveLock.Lock()
+	defer s.saveLock.Unlock()
+	if s.bgsaveInProgress {
+		return ErrBgsaveInProgress
+	}
+	return s.save(path)
+}
+
+// SaveAfterBackgroundSave is Save waiting for the end of the background
+// save in progress instead of failing, like SHUTDOWN needs
+func (s *Storage) SaveAfterBackgroundSave(path string) error {
+	s.saveLock.Lock()
+	defer s.saveLock.Unlock()
+	for s.bgsaveInProgress {
+		s.bgsaveDone.Wait()
+	}
+	return s.save(path)
+}
+
+// Writes the dataset with saveLock held
+func (s *Storage) save(path string) error {
+	var err error
+	s.Freeze(func() {
+		err = writeRDBFile(path, s.Snapshot())
+		if err == nil {
+			s.lock.Lock()
+			s.dirty = 0
+			s.lock.Unlock()
+		}
+	})
+	if err != nil {
+		return err
+	}
+	s.lastSave = time.Now()
+	return nil
+}
+
+// BackgroundSave takes a snapshot of the dataset and writes it to path
+// without blocking the clients, like `BGSAVE`
+func (s *Storage) BackgroundSave(path string) error {
+	s.saveLock.Lock()
+	defer s.saveLock.Unlock()
+	if s.bgsaveInProgress {
+		return ErrBgsaveInProgress
+	}
+
+	var entries []rdb.Entry
+	dirtyAtSnapshot := 0
+	s.Freeze(func() {
+		entries = s.Snapshot()
+		dirtyAtSnapshot = s.Dirty()
+	})
+	s.bgsaveInProgress = true
+	s.lastBgsaveTry = time.Now()
+
+	go func() {
+		err := writeRDBFile(path, entries)
+
+		s.saveLock.Lock()
+		defer s.saveLock.Unlock()
+		s.bgsaveInProgress = false
+		s.bgsaveDone.Broadcast()
+		s.lastBgsaveOK = err == nil
+		if err != nil {
+			log.Printf("background saving failed: %s\n", err.Error())
+			return
+		}
+		// Changes made while the snapshot was written still have to be saved
+		s.lock.Lock()
+		s.dirty -= dirtyAtSnapshot
+		s.lock.Unlock()
+		s.lastSave = time.Now()
+		log.Println("background saving terminated with success")
+	}()
+	return nil
+}
+
+// Dirty is the number of changes since the last successful save
+func (s *Storage) Dirty() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.dirty
+}
+
+// LastBgsaveTry is the time the last background save started
+func (s *Storage) LastBgsaveTry() time.Time {
+	s.saveLock.Lock()
+	defer s.saveLock.Unlock()
+	return s.lastBgsaveTry
+}
+
+// LastSave is the time of the last successful save
+func (s *Storage) LastSave() time.Time {
+	s.saveLock.Lock()
+	defer s.saveLock.Unlock()
+	return s.lastSave
+}
+
+func (s *Storage) BgsaveInProgress() bool {
+	s.saveLock.Lock()
+	defer s.saveLock.Unlock()
+	return s.bgsaveInProgress
+}
+
+func (s *Storage) LastBgsaveOK() bool {
+	s.saveLock.Lock()
+	defer s.saveLock.Unlock()
+	return s.lastBgsaveOK
+}
+
+// Writes the file under a temporary name and renames it once it is
+// complete, so a crash never leaves a truncated RDB file behind
+func writeRDBFile(path string, entries []rdb.Entry) error {
+	tempName := fmt.Sprintf("temp-%d.rdb", os.Getpid())
+	return writeFileAtomically(path, tempName, func(w io.Writer) error {
+		return WriteRDB(w, entries)
+	})
+}
+
+// Writes tempName in the directory of path, syncs it and renames it to path
+func writeFileAtomically(path, tempName string, write func(io.Writer) error) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	tempPath := filepath.Join(dir, tempName)
+	file, err := os.Create(tempPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempPath)
+
+	writer := bufio.NewWriter(file)
+	if err := write(writer); err != nil {
+		file.Close()
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tempPath, path)
+}
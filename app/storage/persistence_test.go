@@ -0,0 +1,40 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestSaveAfterBackgroundSave(t *testing.T) {
+	db := NewStorage()
+	for i := 0; i < 10000; i++ {
+		db.Set("key"+strconv.Itoa(i), "value", 0)
+	}
+	path := filepath.Join(t.TempDir(), "dump.rdb")
+
+	if err := db.BackgroundSave(path); err != nil {
+		t.Fatal(err)
+	}
+	db.Set("late", "value", 0)
+	if err := db.SaveAfterBackgroundSave(path); err != nil {
+		t.Fatalf("got %v, want the save to wait for the background save", err)
+	}
+	if db.BgsaveInProgress() || db.Dirty() != 0 {
+		t.Errorf("got bgsave in progress %t and %d changes, want everything saved", db.BgsaveInProgress(), db.Dirty())
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	entries, err := readRDB(file, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 10001 {
+		t.Errorf("got %d keys in the file, want 10001", len(entries))
+	}
+}
@@ -1,33 +1,82 @@
 package storage
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"os"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
 
+	"github.com/codecrafters-io/redis-starter-go/app/server/cluster"
 	"github.com/codecrafters-io/redis-starter-go/rdb"
 )
 
+// ErrWrongType is returned when a string operation is used on another kind of value
+var ErrWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+// ErrBusyKey is returned when a restored key exists and REPLACE wasn't given
+var ErrBusyKey = errors.New("BUSYKEY Target key name already exists.")
+
 type dataStorage struct {
-	value          string
+	value          rdb.Value
 	expirationTime *time.Time
 }
 
 type Storage struct {
 	db   map[string]dataStorage
 	lock *sync.RWMutex
+	// Keys of each hash slot, only indexed in cluster mode like Redis does.
+	// Nil until IndexSlots is called
+	slots []map[string]struct{}
+	// RDB persistence state, dirty counts the changes since the last save
+	dirty            int
+	lastSave         time.Time
+	lastBgsaveTry    time.Time
+	bgsaveInProgress bool
+	lastBgsaveOK     bool
+	saveLock         *sync.Mutex
+	// Signaled with saveLock held when a background save ends
+	bgsaveDone *sync.Cond
+	// Append only file, nil when appendonly is disabled
+	aof     *AOF
+	aofLock *sync.Mutex
+	// Held in read mode by running write commands and in write mode by
+	// Freeze, so snapshots never see a write halfway through propagation
+	writesLock *sync.RWMutex
 }
 
 func NewStorage() *Storage {
+	saveLock := &sync.Mutex{}
 	return &Storage{
-		db:   make(map[string]dataStorage),
-		lock: &sync.RWMutex{},
+		db:         make(map[string]dataStorage),
+		lock:       &sync.RWMutex{},
+		writesLock: &sync.RWMutex{},
+		lastSave:   time.Now(),
+		saveLock:   saveLock,
+		bgsaveDone: sync.NewCond(saveLock),
+		aofLock:    &sync.Mutex{},
+		// Like Redis, the status is ok until a background save fails
+		lastBgsaveOK: true,
 	}
 }
 
+// BeginWrite marks the start of a write command, the returned function ends it
+func (s *Storage) BeginWrite() func() {
+	s.writesLock.RLock()
+	return s.writesLock.RUnlock
+}
+
+// Freeze runs fn while no write command is executing
+func (s *Storage) Freeze(fn func()) {
+	s.writesLock.Lock()
+	defer s.writesLock.Unlock()
+	fn()
+}
+
 func (s *Storage) Set(key string, val string, expirationTime int) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
@@ -44,131 +93,345 @@ func (s *Storage) Set(key string, val string, expirationTime int) {
 		}
 	}
 
-	s.db[key] = dataStorage{
-		value:          val,
+	s.setKey(key, dataStorage{
+		value:          rdb.String(val),
 		expirationTime: expiration,
+	})
+	s.dirty++
+}
+
+// SetExpireAt sets a string that expires at a unix time in milliseconds,
+// a time in the past deletes the key
+func (s *Storage) SetExpireAt(key string, val string, expireAt int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	expiration := time.UnixMilli(expireAt)
+	if time.Now().After(expiration) {
+		s.deleteKey(key)
+	} else {
+		s.setKey(key, dataStorage{
+			value:          rdb.String(val),
+			expirationTime: &expiration,
+		})
 	}
+	s.dirty++
 }
 
 func (s *Storage) Get(key string) (string, error) {
-	s.lock.RLock()
-	defer s.lock.RUnlock()
+	s.lock.Lock()
+	defer s.lock.Unlock()
 
 	dataStorage, exist := s.db[key]
 	if !exist {
 		return "", fmt.Errorf("key %s doesn't exist", key)
 	}
 	if dataStorage.isExpired() {
-		delete(s.db, key)
+		s.deleteKey(key)
 		return "", fmt.Errorf("the key %s expired since %s", key, dataStorage.expirationTime)
 	}
 
-	return dataStorage.value, nil
+	value, isString := dataStorage.value.(rdb.String)
+	if !isString {
+		return "", ErrWrongType
+	}
+	return string(value), nil
+}
+
+// GetEntry returns a key of any type with its expiration
+func (s *Storage) GetEntry(key string) (rdb.Entry, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	data, exist := s.db[key]
+	if !exist {
+		return rdb.Entry{}, false
+	}
+	if data.isExpired() {
+		s.deleteKey(key)
+		return rdb.Entry{}, false
+	}
+
+	entry := rdb.Entry{Key: key, Value: data.value}
+	if data.expirationTime != nil {
+		entry.ExpireAt = data.expirationTime.UnixMilli()
+	}
+	return entry, true
+}
+
+// Delete removes the keys and returns how many existed
+func (s *Storage) Delete(keys ...string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	deleted := 0
+	for _, key := range keys {
+		data, exist := s.db[key]
+		if !exist {
+			continue
+		}
+		s.deleteKey(key)
+		if !data.isExpired() {
+			deleted++
+			s.dirty++
+		}
+	}
+	return deleted
+}
+
+// Restore creates a key with a value of any type, it expires at a unix time
+// in milliseconds or never when expireAt is 0. An existing key is only
+// overwritten with replace, a time in the past deletes it
+func (s *Storage) Restore(key string, value rdb.Value, expireAt int64, replace bool) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if data, exist := s.db[key]; exist && !data.isExpired() && !replace {
+		return ErrBusyKey
+	}
+
+	entry := rdb.Entry{Key: key, Value: value, ExpireAt: expireAt}
+	if expireAt != 0 && time.Now().UnixMilli() >= expireAt {
+		s.deleteKey(key)
+	} else {
+		s.setKey(key, newDataStorage(entry))
+	}
+	s.dirty++
+	return nil
 }
 
 func (s *Storage) GetKeys() []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
 	var keys []string
+	for key, data := range s.db {
+		if !data.isExpired() {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// IndexSlots starts keeping the keys of each hash slot, so the keys of a
+// slot are found without going through the whole keyspace
+func (s *Storage) IndexSlots() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.indexSlots()
+}
+
+// Requires the lock to be held
+func (s *Storage) indexSlots() {
+	s.slots = make([]map[string]struct{}, cluster.Slots)
 	for key := range s.db {
-		keys = append(keys, key)
+		s.indexKey(key)
+	}
+}
+
+// Requires the lock to be held
+func (s *Storage) indexKey(key string) {
+	slot := cluster.KeySlot(key)
+	if s.slots[slot] == nil {
+		s.slots[slot] = map[string]struct{}{}
+	}
+	s.slots[slot][key] = struct{}{}
+}
+
+// Requires the lock to be held
+func (s *Storage) setKey(key string, data dataStorage) {
+	s.db[key] = data
+	if s.slots != nil {
+		s.indexKey(key)
+	}
+}
+
+// Requires the lock to be held
+func (s *Storage) deleteKey(key string) {
+	delete(s.db, key)
+	if s.slots != nil {
+		slot := cluster.KeySlot(key)
+		delete(s.slots[slot], key)
+		if len(s.slots[slot]) == 0 {
+			s.slots[slot] = nil
+		}
+	}
+}
+
+// SlotKeys returns up to count keys of a hash slot in lexicographic order,
+// all of them when count is negative. IndexSlots must have been called
+func (s *Storage) SlotKeys(slot, count int) []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	keys := []string{}
+	for key := range s.slots[slot] {
+		if data := s.db[key]; !data.isExpired() {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if count >= 0 && len(keys) > count {
+		keys = keys[:count]
 	}
 	return keys
 }
 
-func (s *Storage) ReadRDBFile(path string) error {
-	file, err := os.Open(path)
-	if err != nil {
-		return err
+// CountSlotKeys returns the number of keys of a hash slot.
+// IndexSlots must have been called
+func (s *Storage) CountSlotKeys(slot int) int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	count := 0
+	for key := range s.slots[slot] {
+		if data := s.db[key]; !data.isExpired() {
+			count++
+		}
 	}
-	defer file.Close()
+	return count
+}
 
-	reader := bufio.NewReader(file)
+// Snapshot copies the keys that are not expired, values are never modified
+// in place so they can be shared with the copy
+func (s *Storage) Snapshot() []rdb.Entry {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 
-	err = rdb.CheckMagicNumber(reader)
-	if err != nil {
-		return err
+	entries := make([]rdb.Entry, 0, len(s.db))
+	for key, data := range s.db {
+		if data.isExpired() {
+			continue
+		}
+		entry := rdb.Entry{Key: key, Value: data.value}
+		if data.expirationTime != nil {
+			entry.ExpireAt = data.expirationTime.UnixMilli()
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// Replace swaps the whole dataset, used when a replica loads the master snapshot
+func (s *Storage) Replace(entries []rdb.Entry) {
+	db := make(map[string]dataStorage, len(entries))
+	for _, entry := range entries {
+		db[entry.Key] = newDataStorage(entry)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.db = db
+	if s.slots != nil {
+		s.indexSlots()
 	}
+}
 
-	err = rdb.SkipMetadata(reader)
+func (s *Storage) ReadRDBFile(path string) error {
+	file, err := os.Open(path)
 	if err != nil {
 		return err
 	}
+	defer file.Close()
 
-	// Read db number
-	// FE 00                       # Indicates database selector. db number = 00
-	_, err = reader.ReadByte()
+	entries, err := readRDB(file, true)
 	if err != nil {
 		return err
 	}
 
-	err = s.loadFileContent(reader)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, entry := range entries {
+		s.setKey(entry.Key, newDataStorage(entry))
+	}
+	return nil
+}
+
+// LoadRDB replaces the dataset with the content of a RDB payload
+func (s *Storage) LoadRDB(payload io.Reader) error {
+	entries, err := readRDB(payload, false)
 	if err != nil {
 		return err
 	}
+	s.Replace(entries)
 	return nil
 }
 
-func (s *Storage) loadFileContent(reader *bufio.Reader) error {
+// Reads the entries of the first database, keys of other databases are
+// ignored since only one is supported. Masters skip the keys that already
+// expired, replicas keep them until the master propagates their deletion
+func readRDB(reader io.Reader, skipExpired bool) ([]rdb.Entry, error) {
+	rdbReader := rdb.NewReader(reader)
+	if err := rdbReader.ReadHeader(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UnixMilli()
+	entries := []rdb.Entry{}
+	// Number of keys skipped in each of the other databases
+	skipped := map[int]int{}
 	for {
-		opcode, err := reader.ReadByte()
-		if err != nil {
-			return err
+		record, err := rdbReader.Next()
+		if err == io.EOF {
+			logSkippedKeys(skipped)
+			return entries, nil
 		}
-
-		// End of the RDB file
-		if opcode == rdb.END_OPCODE {
-			return nil
+		if err != nil {
+			return nil, err
 		}
 
-		if opcode == rdb.OPCODE_SELECTDB {
-			err = rdb.ReadSelectDB(reader)
-			if err != nil {
-				return err
+		switch record.Type {
+		case rdb.RecordAux:
+			logAuxField(record.Aux, now)
+		case rdb.RecordFunction:
+			log.Println("skipping a function library, functions are not supported")
+		case rdb.RecordModuleAux:
+			log.Printf("skipping aux data of module %s\n", record.Module)
+		case rdb.RecordEntry:
+			entry := record.Entry
+			if entry.DB != 0 {
+				skipped[entry.DB]++
+				continue
 			}
-		}
-
-		if opcode == rdb.OPCODE_RESIZEDB {
-			err = rdb.ReadResizeDB(reader)
-			if err != nil {
-				return err
+			if skipExpired && entry.ExpireAt != 0 && entry.ExpireAt <= now {
+				continue
 			}
+			entries = append(entries, entry)
 		}
+	}
+}
 
-		// Skipping exp time bytes
-		if opcode == rdb.OPCODE_EXPIRETIME_MS {
-			fmt.Println("SKIPPING MS EXP TIME")
-			reader.Discard(9)
-		}
-		if opcode == rdb.OPCODE_EXPIRETIME {
-			fmt.Println("SKIPPING NOT MS EXP TIME")
-			reader.Discard(5)
-		}
-
-		// Length Encoding
-		keyLength, err := rdb.LengthEncodedInt(reader)
-		if err != nil {
-			return err
-		}
-		keyBytes := make([]byte, keyLength)
-		_, err = reader.Read(keyBytes)
-		if err != nil {
-			return err
+// Only the aux fields telling where the file comes from are logged, like
+// Redis does while loading
+func logAuxField(aux rdb.AuxField, now int64) {
+	switch aux.Key {
+	case "redis-ver":
+		log.Printf("loading RDB produced by version %s\n", aux.Value)
+	case "ctime":
+		if ctime, err := strconv.ParseInt(aux.Value, 10, 64); err == nil {
+			log.Printf("RDB age %d seconds\n", max(now/1000-ctime, 0))
 		}
+	}
+}
 
-		// Length Encoding
-		valueLength, err := rdb.LengthEncodedInt(reader)
-		if err != nil {
-			return err
-		}
-		valueBytes := make([]byte, valueLength)
-		_, err = reader.Read(valueBytes)
-		if err != nil {
-			return err
-		}
+func logSkippedKeys(skipped map[int]int) {
+	dbs := make([]int, 0, len(skipped))
+	for db := range skipped {
+		dbs = append(dbs, db)
+	}
+	sort.Ints(dbs)
+	for _, db := range dbs {
+		log.Printf("skipped %d keys of database %d, only database 0 is supported\n", skipped[db], db)
+	}
+}
 
-		// TODO: add support por exp time latter
-		fmt.Printf("READ KEY: %s, READ VAL: %s\n", string(keyBytes), string(valueBytes))
-		s.Set(string(keyBytes), string(valueBytes), 0)
+func newDataStorage(entry rdb.Entry) dataStorage {
+	data := dataStorage{value: entry.Value}
+	if entry.ExpireAt != 0 {
+		expiration := time.UnixMilli(entry.ExpireAt)
+		data.expirationTime = &expiration
 	}
+	return data
 }
 
 func (ds *dataStorage) isExpired() bool {
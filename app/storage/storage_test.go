@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/server/cluster"
+	"github.com/codecrafters-io/redis-starter-go/rdb"
+)
+
+func TestSlotKeys(t *testing.T) {
+	slot := cluster.KeySlot("{tag}")
+	tests := []struct {
+		name   string
+		change func(db *Storage)
+		want   []string
+	}{
+		{"set", func(db *Storage) { db.Set("{tag}c", "v", 0) }, []string{"{tag}a", "{tag}b", "{tag}c"}},
+		{"delete", func(db *Storage) { db.Delete("{tag}a") }, []string{"{tag}b"}},
+		{"expired", func(db *Storage) { db.SetExpireAt("{tag}b", "v", 1) }, []string{"{tag}a"}},
+		{"restore", func(db *Storage) { db.Restore("{tag}0", rdb.List{"x"}, 0, false) }, []string{"{tag}0", "{tag}a", "{tag}b"}},
+		{
+			"replace",
+			func(db *Storage) {
+				db.Replace([]rdb.Entry{{Key: "{tag}z", Value: rdb.String("v")}, {Key: "other", Value: rdb.String("v")}})
+			},
+			[]string{"{tag}z"},
+		},
+		{
+			"expires later",
+			func(db *Storage) { db.SetExpireAt("{tag}a", "v", time.Now().Add(time.Hour).UnixMilli()) },
+			[]string{"{tag}a", "{tag}b"},
+		},
+	}
+	for _, test := range tests {
+		db := NewStorage()
+		// Keys set before the index is enabled are indexed too
+		db.Set("{tag}a", "v", 0)
+		db.IndexSlots()
+		db.Set("{tag}b", "v", 0)
+		db.Set("other", "v", 0)
+		test.change(db)
+
+		if got := db.SlotKeys(slot, -1); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got keys %q, want %q", test.name, got, test.want)
+		}
+		if got := db.CountSlotKeys(slot); got != len(test.want) {
+			t.Errorf("%s: got %d keys, want %d", test.name, got, len(test.want))
+		}
+		if got := db.SlotKeys(slot, 1); !reflect.DeepEqual(got, test.want[:1]) {
+			t.Errorf("%s: got first key %q, want %q", test.name, got, test.want[:1])
+		}
+	}
+}
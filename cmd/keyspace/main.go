@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"github.com/codecrafters-io/redis-starter-go/app/command"
+	"github.com/codecrafters-io/redis-starter-go/app/storage"
+)
+
+const usage = `usage: keyspace export [-addr host:port] [-format json|resp]
+       keyspace import [-addr host:port] [-format json|resp] <file>
+
+export writes the keyspace of the server to the standard output,
+import sends the commands that recreate the keys of an export`
+
+// Commands sent before reading their replies when importing
+const pipelineSize = 1000
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	flags := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	addr := flags.String("addr", "localhost:6379", "address of the server")
+	format := flags.String("format", storage.ExportJSON, "format of the export, json or resp")
+	flags.Usage = func() { fmt.Fprintln(os.Stderr, usage) }
+	flags.Parse(os.Args[2:])
+
+	var err error
+	switch {
+	case os.Args[1] == command.Export && flags.NArg() == 0:
+		err = export(*addr, *format)
+	case os.Args[1] == "import" && flags.NArg() == 1:
+		err = importFile(*addr, *format, flags.Arg(0))
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+func export(addr, format string) error {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := io.WriteString(conn, command.NewArray([]string{command.Debug, command.Export, format})); err != nil {
+		return err
+	}
+	reply, err := command.ReadReply(bufio.NewReader(conn))
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(os.Stdout, reply)
+	return err
+}
+
+// Commands are pipelined, the replies of a batch are read before the next
+// one is sent so neither side blocks on a full socket buffer
+func importFile(addr, format, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	sent, failed := 0, 0
+	flush := func() error {
+		if err := writer.Flush(); err != nil {
+			return err
+		}
+		for ; sent > 0; sent-- {
+			if _, err := command.ReadReply(reader); err != nil {
+				if _, isReplyError := err.(command.ReplyError); !isReplyError {
+					return err
+				}
+				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+				failed++
+			}
+		}
+		return nil
+	}
+
+	imported := 0
+	err = storage.ReadExport(file, format, func(userCommand *command.Command) error {
+		if _, err := writer.WriteString(userCommand.Raw); err != nil {
+			return err
+		}
+		sent++
+		imported++
+		if sent == pipelineSize {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	fmt.Printf("imported %d keys, errors: %d\n", imported-failed, failed)
+	return nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/rdb"
+)
+
+const usage = `usage: rdb-tool <command> <file>
+
+commands:
+  check   validate the file and print its header, aux fields and key counts
+  dump    print every key as a JSON line with its type, TTL and size`
+
+// Keys and expires found in a database, next to the sizes announced by RESIZEDB
+type dbStats struct {
+	keys        int
+	expires     int
+	resizeKeys  int
+	resizeExpir int
+}
+
+// One line of the dump
+type keyInfo struct {
+	DB       int    `json:"db"`
+	Key      string `json:"key"`
+	Type     string `json:"type"`
+	ExpireAt *int64 `json:"expire_at,omitempty"`
+	TTL      *int64 `json:"ttl_ms,omitempty"`
+	// Number of elements, or bytes for strings
+	Length int `json:"length"`
+	// Bytes the key takes in the file
+	Size int64 `json:"rdb_size"`
+}
+
+func main() {
+	if len(os.Args) != 3 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	file, err := os.Open(os.Args[2])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to open %s: %s\n", os.Args[2], err.Error())
+		os.Exit(1)
+	}
+	defer file.Close()
+
+	switch os.Args[1] {
+	case "check":
+		err = check(file)
+	case "dump":
+		err = dump(file)
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		reportError(err)
+		os.Exit(1)
+	}
+}
+
+func check(file io.Reader) error {
+	reader := rdb.NewReader(file)
+	if err := reader.ReadHeader(); err != nil {
+		return err
+	}
+	fmt.Printf("RDB version: %d\n", reader.Version)
+
+	stats := map[int]*dbStats{}
+	statsOf := func(db int) *dbStats {
+		if stats[db] == nil {
+			stats[db] = &dbStats{}
+		}
+		return stats[db]
+	}
+	functions := 0
+
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			printStats(stats)
+			return err
+		}
+
+		switch record.Type {
+		case rdb.RecordAux:
+			fmt.Printf("aux %s: %s\n", record.Aux.Key, record.Aux.Value)
+		case rdb.RecordModuleAux:
+			fmt.Printf("module aux data: %s\n", record.Module)
+		case rdb.RecordFunction:
+			functions++
+		case rdb.RecordResizeDB:
+			db := statsOf(record.Resize.DB)
+			db.resizeKeys = record.Resize.Keys
+			db.resizeExpir = record.Resize.Expires
+		case rdb.RecordEntry:
+			db := statsOf(record.Entry.DB)
+			db.keys++
+			if record.Entry.ExpireAt != 0 {
+				db.expires++
+			}
+		}
+	}
+
+	if functions > 0 {
+		fmt.Printf("function libraries: %d\n", functions)
+	}
+	printStats(stats)
+	switch {
+	case reader.Version < rdb.RDB_CHECKSUM_VERSION:
+		fmt.Println("checksum: none before version 5")
+	case reader.Checksum == 0:
+		fmt.Println("checksum: disabled")
+	default:
+		fmt.Printf("checksum: %016x OK\n", reader.Checksum)
+	}
+	fmt.Printf("file size: %d bytes\n", reader.Offset())
+	return nil
+}
+
+func printStats(stats map[int]*dbStats) {
+	dbs := make([]int, 0, len(stats))
+	for db := range stats {
+		dbs = append(dbs, db)
+	}
+	sort.Ints(dbs)
+
+	for _, db := range dbs {
+		fmt.Printf("db%d: keys=%d expires=%d (resizedb keys=%d expires=%d)\n",
+			db, stats[db].keys, stats[db].expires, stats[db].resizeKeys, stats[db].resizeExpir)
+	}
+}
+
+func dump(file io.Reader) error {
+	reader := rdb.NewReader(file)
+	if err := reader.ReadHeader(); err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	now := time.Now().UnixMilli()
+	for {
+		start := reader.Offset()
+		record, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if record.Type != rdb.RecordEntry {
+			continue
+		}
+
+		entry := record.Entry
+		info := keyInfo{
+			DB:     entry.DB,
+			Key:    entry.Key,
+			Type:   entry.Value.TypeName(),
+			Length: valueLength(entry.Value),
+			Size:   reader.Offset() - start,
+		}
+		if entry.ExpireAt != 0 {
+			expireAt, ttl := entry.ExpireAt, entry.ExpireAt-now
+			info.ExpireAt, info.TTL = &expireAt, &ttl
+		}
+		if err := encoder.Encode(info); err != nil {
+			return err
+		}
+	}
+}
+
+func valueLength(value rdb.Value) int {
+	switch v := value.(type) {
+	case rdb.String:
+		return len(v)
+	case rdb.List:
+		return len(v)
+	case rdb.Set:
+		return len(v)
+	case rdb.ZSet:
+		return len(v)
+	case rdb.Hash:
+		return len(v)
+	}
+	// Streams are not decoded
+	return 0
+}
+
+// Corruptions are reported with the offset where the reader stopped
+func reportError(err error) {
+	var formatErr *rdb.FormatError
+	if errors.As(err, &formatErr) {
+		fmt.Fprintf(os.Stderr, "corruption found at offset %d (0x%x): %s\n",
+			formatErr.Offset, formatErr.Offset, formatErr.Err.Error())
+		return
+	}
+	fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/codecrafters-io/redis-starter-go/rdb"
+)
+
+func TestCheckReportsCorruptionOffset(t *testing.T) {
+	valid := &bytes.Buffer{}
+	if err := rdb.Save(valid, nil, []rdb.Entry{{Key: "key", Value: rdb.String("value")}}); err != nil {
+		t.Fatal(err)
+	}
+	// REDIS0011, then FE 00 to select the database and FB 01 00 to resize it
+	entryOffset := int64(9 + 2 + 3)
+	badChecksum := bytes.Clone(valid.Bytes())
+	badChecksum[len(badChecksum)-1] ^= 0xff
+
+	tests := []struct {
+		name   string
+		data   []byte
+		offset int64
+	}{
+		{"empty file", nil, 0},
+		{"wrong magic number", []byte("REDIX0011\xff"), 0},
+		{"invalid version", []byte("REDIS00x1\xff"), 5},
+		{"unsupported version", []byte("REDIS0099\xff"), 5},
+		{
+			"huge list length",
+			[]byte("REDIS0011\x01\x01k\x81\x7f\xff\xff\xff\xff\xff\xff\xff"),
+			12,
+		},
+		{
+			"negative string length",
+			[]byte("REDIS0011\x00\x01k\x81\xff\xff\xff\xff\xff\xff\xff\xff"),
+			12,
+		},
+		{"invalid length encoding", []byte("REDIS0011\x00\x82k\x01v\xff"), 10},
+		{"unknown value type", []byte("REDIS0011\x63\x01k\x01v\xff"), 9},
+		{"opcode of a newer version", []byte("REDIS0009\xf5\x01f\xff"), 9},
+		// The length of the value is larger than the rest of the file
+		{"truncated value", valid.Bytes()[:entryOffset+6], entryOffset + 5},
+		{"truncated length", valid.Bytes()[:entryOffset+5], entryOffset + 5},
+		{"missing checksum", valid.Bytes()[:valid.Len()-8], int64(valid.Len() - 8)},
+		{"wrong checksum", badChecksum, int64(valid.Len() - 8)},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "dump.rdb")
+		if err := os.WriteFile(path, test.data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		for name, command := range map[string]func(*os.File) error{
+			"check": func(file *os.File) error { return check(file) },
+			"dump":  func(file *os.File) error { return dump(file) },
+		} {
+			file, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = command(file)
+			file.Close()
+
+			var formatErr *rdb.FormatError
+			if !errors.As(err, &formatErr) {
+				t.Errorf("%s %s: got %v, want a format error", name, test.name, err)
+				continue
+			}
+			if formatErr.Offset != test.offset {
+				t.Errorf("%s %s: got offset %d, want %d (%s)", name, test.name, formatErr.Offset, test.offset, err)
+			}
+		}
+	}
+}
+
+func TestCheckValidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.rdb")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := []rdb.Entry{
+		{Key: "string", Value: rdb.String("value"), ExpireAt: 1700000000000},
+		{Key: "list", Value: rdb.List{"a", "b"}},
+	}
+	if err := rdb.Save(file, []rdb.AuxField{{Key: "redis-ver", Value: "7.2.0"}}, entries); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	file, err = os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err := check(file); err != nil {
+		t.Errorf("got %v, want no error", err)
+	}
+}
@@ -2,12 +2,22 @@ package rdb
 
 const (
 	MAGIC_NUMBER           = "REDIS"
+	RDB_VERSION            = 11
+	RDB_MAX_VERSION        = 12 // Newest version that can be loaded
+	RDB_CHECKSUM_VERSION   = 5  // Older files end without a checksum
 	DATABASE_SELECT_OPCODE = 0xFE
 	END_OPCODE             = 0xFF
+	OPCODE_AUX             = 0xFA
 	OPCODE_EXPIRETIME_MS   = 0xFC
 	OPCODE_EXPIRETIME      = 0xFD
 	OPCODE_SELECTDB        = 0xFE
 	OPCODE_RESIZEDB        = 0xFB
+	OPCODE_MODULE_AUX      = 0xF7
+	OPCODE_IDLE            = 0xF8
+	OPCODE_FREQ            = 0xF9
+	OPCODE_SLOT_INFO       = 0xF4
+	OPCODE_FUNCTION2       = 0xF5
+	OPCODE_FUNCTION_PRE_GA = 0xF6
 )
 
 // Length Encoding Constants
@@ -21,3 +31,65 @@ const (
 	// 11
 	ENC_LZF = 0b11
 )
+
+// 10 followed by one of these bytes for lengths that don't fit in 14 bits
+const (
+	LEN_32BIT = 0x80
+	LEN_64BIT = 0x81
+)
+
+// Special formats of 11 encoded strings
+const (
+	ENC_SPECIAL_INT8  = 0
+	ENC_SPECIAL_INT16 = 1
+	ENC_SPECIAL_INT32 = 2
+	ENC_SPECIAL_LZF   = 3
+)
+
+// Value types
+const (
+	TYPE_STRING = 0
+	TYPE_LIST   = 1
+	TYPE_SET    = 2
+	TYPE_ZSET   = 3
+	TYPE_HASH   = 4
+	TYPE_ZSET_2 = 5
+	// Module values, 6 was only used by release candidates
+	TYPE_MODULE_PRE_GA = 6
+	TYPE_MODULE_2      = 7
+	// Compact encodings, the value is a string holding the encoded structure
+	TYPE_HASH_ZIPMAP        = 9
+	TYPE_LIST_ZIPLIST       = 10
+	TYPE_SET_INTSET         = 11
+	TYPE_ZSET_ZIPLIST       = 12
+	TYPE_HASH_ZIPLIST       = 13
+	TYPE_LIST_QUICKLIST     = 14
+	TYPE_STREAM_LISTPACKS   = 15
+	TYPE_HASH_LISTPACK      = 16
+	TYPE_ZSET_LISTPACK      = 17
+	TYPE_LIST_QUICKLIST_2   = 18
+	TYPE_STREAM_LISTPACKS_2 = 19
+	TYPE_SET_LISTPACK       = 20
+	TYPE_STREAM_LISTPACKS_3 = 21
+	// Hashes with fields expiration
+	TYPE_HASH_METADATA_PRE_GA    = 22
+	TYPE_HASH_LISTPACK_EX_PRE_GA = 23
+	TYPE_HASH_METADATA           = 24
+	TYPE_HASH_LISTPACK_EX        = 25
+)
+
+// Containers of the quicklist 2 nodes
+const (
+	QUICKLIST_NODE_PLAIN  = 1
+	QUICKLIST_NODE_PACKED = 2
+)
+
+// Types of the values stored in module aux data
+const (
+	MODULE_OPCODE_EOF    = 0
+	MODULE_OPCODE_SINT   = 1
+	MODULE_OPCODE_UINT   = 2
+	MODULE_OPCODE_FLOAT  = 3
+	MODULE_OPCODE_DOUBLE = 4
+	MODULE_OPCODE_STRING = 5
+)
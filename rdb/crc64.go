@@ -0,0 +1,31 @@
+package rdb
+
+// CRC-64/Jones as used by Redis for the RDB checksum and DUMP payloads:
+// reflected polynomial, zero initial value and no final xor
+const crc64Poly = 0x95AC9329AC4BC9B5
+
+var crc64Table = makeCRC64Table()
+
+func makeCRC64Table() *[256]uint64 {
+	table := &[256]uint64{}
+	for i := range table {
+		crc := uint64(i)
+		for j := 0; j < 8; j++ {
+			if crc&1 == 1 {
+				crc = (crc >> 1) ^ crc64Poly
+			} else {
+				crc >>= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}
+
+// CRC64 continues the checksum crc with data
+func CRC64(crc uint64, data []byte) uint64 {
+	for _, b := range data {
+		crc = crc64Table[byte(crc)^b] ^ (crc >> 8)
+	}
+	return crc
+}
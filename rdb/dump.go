@@ -0,0 +1,75 @@
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrDumpPayload = errors.New("DUMP payload version or checksum are wrong")
+	ErrBadData     = errors.New("Bad data format")
+)
+
+// Size of the RDB version and the CRC64 closing a DUMP payload
+const dumpFooterSize = 10
+
+/*
+A DUMP payload is a single value as it is encoded in a RDB file:
+- The value type byte followed by the value
+- The RDB version as 2 bytes little endian
+- The CRC64 of everything before as 8 bytes little endian
+*/
+func Dump(value Value) ([]byte, error) {
+	payload := &bytes.Buffer{}
+	writer := NewWriter(payload)
+	writer.write([]byte{ValueType(value)})
+	writer.WriteValue(value)
+
+	footer := make([]byte, dumpFooterSize)
+	binary.LittleEndian.PutUint16(footer, RDB_VERSION)
+	writer.write(footer[:2])
+	binary.LittleEndian.PutUint64(footer[2:], writer.Checksum())
+	writer.write(footer[2:])
+
+	if err := writer.Flush(); err != nil {
+		return nil, err
+	}
+	return payload.Bytes(), nil
+}
+
+// Restore decodes a DUMP payload once its version and checksum are verified.
+// Payloads of any version the reader supports are accepted
+func Restore(payload []byte) (Value, error) {
+	if len(payload) < dumpFooterSize+1 {
+		return nil, ErrDumpPayload
+	}
+	body, footer := payload[:len(payload)-dumpFooterSize], payload[len(payload)-dumpFooterSize:]
+	version := int(binary.LittleEndian.Uint16(footer))
+	if version > RDB_MAX_VERSION {
+		return nil, ErrDumpPayload
+	}
+	if CRC64(0, payload[:len(payload)-8]) != binary.LittleEndian.Uint64(footer[2:]) {
+		return nil, ErrDumpPayload
+	}
+
+	reader := NewReader(bytes.NewReader(body))
+	reader.Version = version
+	valueType, err := reader.ReadByte()
+	if err != nil {
+		return nil, ErrBadData
+	}
+	if err := checkOpcode(version, valueType); err != nil {
+		return nil, fmt.Errorf("%w, %s", ErrBadData, err.Error())
+	}
+
+	value, err := reader.ReadValue(valueType)
+	if err != nil {
+		return nil, fmt.Errorf("%w, %s", ErrBadData, err.Error())
+	}
+	if reader.Offset() != int64(len(body)) {
+		return nil, ErrBadData
+	}
+	return value, nil
+}
@@ -0,0 +1,317 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+)
+
+var errTruncated = fmt.Errorf("truncated encoded value")
+
+// Helper over the bytes of a ziplist, listpack, intset or zipmap
+type blob struct {
+	data []byte
+	pos  int
+}
+
+func (b *blob) next(n int) ([]byte, error) {
+	if n < 0 || b.pos+n > len(b.data) {
+		return nil, errTruncated
+	}
+	data := b.data[b.pos : b.pos+n]
+	b.pos += n
+	return data, nil
+}
+
+func (b *blob) remaining() int {
+	return len(b.data) - b.pos
+}
+
+func (b *blob) byte() (byte, error) {
+	data, err := b.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return data[0], nil
+}
+
+// Little endian signed integer of n bytes
+func (b *blob) int(n int) (int64, error) {
+	data, err := b.next(n)
+	if err != nil {
+		return 0, err
+	}
+	var value uint64
+	for i := n - 1; i >= 0; i-- {
+		value = value<<8 | uint64(data[i])
+	}
+	// Sign extend to 64 bits
+	shift := 64 - 8*n
+	return int64(value<<shift) >> shift, nil
+}
+
+/*
+<zlbytes><zltail><zllen><entry>...<entry><zlend>
+Every entry is <prevlen><encoding><data>, prevlen is 1 byte or 0xFE
+followed by 4 bytes, and the encoding tells whether data is a string or an integer
+*/
+func decodeZiplist(data []byte) ([]string, error) {
+	b := &blob{data: data}
+	if _, err := b.next(10); err != nil {
+		return nil, err
+	}
+
+	values := []string{}
+	for {
+		prevlen, err := b.byte()
+		if err != nil {
+			return nil, err
+		}
+		if prevlen == 0xFF {
+			return values, nil
+		}
+		if prevlen == 0xFE {
+			if _, err := b.next(4); err != nil {
+				return nil, err
+			}
+		}
+
+		encoding, err := b.byte()
+		if err != nil {
+			return nil, err
+		}
+
+		var value []byte
+		switch {
+		case encoding>>6 == 0b00:
+			value, err = b.next(int(encoding & 0x3F))
+		case encoding>>6 == 0b01:
+			var low byte
+			if low, err = b.byte(); err == nil {
+				value, err = b.next(int(encoding&0x3F)<<8 | int(low))
+			}
+		case encoding>>6 == 0b10:
+			var length []byte
+			if length, err = b.next(4); err == nil {
+				value, err = b.next(int(binary.BigEndian.Uint32(length)))
+			}
+		default:
+			var number int64
+			number, err = b.ziplistInt(encoding)
+			value = []byte(strconv.FormatInt(number, 10))
+		}
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, string(value))
+	}
+}
+
+func (b *blob) ziplistInt(encoding byte) (int64, error) {
+	switch encoding {
+	case 0xC0:
+		return b.int(2)
+	case 0xD0:
+		return b.int(4)
+	case 0xE0:
+		return b.int(8)
+	case 0xF0:
+		return b.int(3)
+	case 0xFE:
+		return b.int(1)
+	}
+	// 1111xxxx, a 4 bit integer between 0 and 12 stored as xxxx - 1
+	if encoding >= 0xF1 && encoding <= 0xFD {
+		return int64(encoding&0x0F) - 1, nil
+	}
+	return 0, fmt.Errorf("unknown ziplist encoding 0x%x", encoding)
+}
+
+/*
+<total bytes><num elements><element>...<element><end>
+Every element is <encoding><data><backlen>, backlen stores the size of
+encoding and data to walk the list backwards, so it's just skipped here
+*/
+func decodeListpack(data []byte) ([]string, error) {
+	b := &blob{data: data}
+	if _, err := b.next(6); err != nil {
+		return nil, err
+	}
+
+	values := []string{}
+	for {
+		start := b.pos
+		encoding, err := b.byte()
+		if err != nil {
+			return nil, err
+		}
+		if encoding == 0xFF {
+			return values, nil
+		}
+
+		var value []byte
+		switch {
+		case encoding>>7 == 0b0:
+			value = []byte(strconv.Itoa(int(encoding)))
+		case encoding>>6 == 0b10:
+			value, err = b.next(int(encoding & 0x3F))
+		case encoding>>5 == 0b110:
+			var low byte
+			if low, err = b.byte(); err == nil {
+				number := int(encoding&0x1F)<<8 | int(low)
+				// 13 bit two's complement
+				if number >= 1<<12 {
+					number -= 1 << 13
+				}
+				value = []byte(strconv.Itoa(number))
+			}
+		case encoding>>4 == 0b1110:
+			var low byte
+			if low, err = b.byte(); err == nil {
+				value, err = b.next(int(encoding&0x0F)<<8 | int(low))
+			}
+		case encoding == 0xF0:
+			var length []byte
+			if length, err = b.next(4); err == nil {
+				value, err = b.next(int(binary.LittleEndian.Uint32(length)))
+			}
+		default:
+			var number int64
+			number, err = b.listpackInt(encoding)
+			value = []byte(strconv.FormatInt(number, 10))
+		}
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, string(value))
+
+		if _, err := b.next(backlenSize(b.pos - start)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (b *blob) listpackInt(encoding byte) (int64, error) {
+	switch encoding {
+	case 0xF1:
+		return b.int(2)
+	case 0xF2:
+		return b.int(3)
+	case 0xF3:
+		return b.int(4)
+	case 0xF4:
+		return b.int(8)
+	}
+	return 0, fmt.Errorf("unknown listpack encoding 0x%x", encoding)
+}
+
+// The backlen uses 7 bits per byte, with the thresholds of Redis
+// lpEncodeBacklen which keeps the largest value of each size for the next one
+func backlenSize(length int) int {
+	switch {
+	case length <= 127:
+		return 1
+	case length < 16383:
+		return 2
+	case length < 2097151:
+		return 3
+	case length < 268435455:
+		return 4
+	}
+	return 5
+}
+
+// <encoding><length><contents>, the encoding is the size in bytes of
+// every integer of the sorted contents
+func decodeIntset(data []byte) ([]string, error) {
+	b := &blob{data: data}
+	encoding, err := b.int(4)
+	if err != nil {
+		return nil, err
+	}
+	if encoding != 2 && encoding != 4 && encoding != 8 {
+		return nil, fmt.Errorf("unknown intset encoding %d", encoding)
+	}
+	length, err := b.int(4)
+	if err != nil {
+		return nil, err
+	}
+	if length < 0 || length*encoding > int64(b.remaining()) {
+		return nil, fmt.Errorf("intset length %d doesn't match its %d bytes", length, b.remaining())
+	}
+
+	values := make([]string, 0, length)
+	for i := int64(0); i < length; i++ {
+		value, err := b.int(int(encoding))
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, strconv.FormatInt(value, 10))
+	}
+	return values, nil
+}
+
+/*
+<zmlen><len>"key"<len><free>"value"...<end>
+Lengths are 1 byte, or 254 followed by 4 bytes, free counts the unused
+bytes after the value
+*/
+func decodeZipmap(data []byte) (Value, error) {
+	b := &blob{data: data}
+	if _, err := b.byte(); err != nil {
+		return nil, err
+	}
+
+	hash := Hash{}
+	for {
+		field, end, err := b.zipmapString(false)
+		if err != nil {
+			return nil, err
+		}
+		if end {
+			return hash, nil
+		}
+		value, _, err := b.zipmapString(true)
+		if err != nil {
+			return nil, err
+		}
+		hash = append(hash, HashField{Field: field, Value: value})
+	}
+}
+
+func (b *blob) zipmapString(hasFree bool) (string, bool, error) {
+	length, err := b.byte()
+	if err != nil {
+		return "", false, err
+	}
+	if length == 0xFF {
+		return "", true, nil
+	}
+
+	size := int(length)
+	if length == 0xFE {
+		buf, err := b.next(4)
+		if err != nil {
+			return "", false, err
+		}
+		size = int(binary.LittleEndian.Uint32(buf))
+	}
+
+	free := 0
+	if hasFree {
+		freeByte, err := b.byte()
+		if err != nil {
+			return "", false, err
+		}
+		free = int(freeByte)
+	}
+
+	value, err := b.next(size)
+	if err != nil {
+		return "", false, err
+	}
+	if _, err := b.next(free); err != nil {
+		return "", false, err
+	}
+	return string(value), false, nil
+}
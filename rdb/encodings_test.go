@@ -0,0 +1,180 @@
+package rdb
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeZiplist(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want []string
+	}{
+		{
+			// The "2" and "5" example of ziplist.c
+			name: "small integers",
+			data: []byte{0x0f, 0, 0, 0, 0x0c, 0, 0, 0, 0x02, 0, 0x00, 0xf3, 0x02, 0xf6, 0xff},
+			want: []string{"2", "5"},
+		},
+		{
+			name: "strings and integers",
+			data: []byte{
+				0x1b, 0, 0, 0, 0x14, 0, 0, 0, 0x04, 0,
+				0x00, 0x05, 'h', 'e', 'l', 'l', 'o',
+				0x07, 0xc0, 0x00, 0x04,
+				0x04, 0xfe, 0x85,
+				0x03, 0xd0, 0xff, 0xff, 0xff, 0xff,
+				0xff,
+			},
+			want: []string{"hello", "1024", "-123", "-1"},
+		},
+	}
+	for _, test := range tests {
+		got, err := decodeZiplist(test.data)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDecodeListpack(t *testing.T) {
+	long := bytes.Repeat([]byte{'x'}, 200)
+	data := []byte{0, 0, 0, 0, 0x05, 0}
+	// 7 bit unsigned integer, 6 bit string, 13 bit integer and 16 bit integer
+	data = append(data, 0x07, 0x01)
+	data = append(data, 0x82, 'o', 'k', 0x03)
+	data = append(data, 0xdf, 0xff, 0x02)
+	data = append(data, 0xf1, 0x00, 0x80, 0x03)
+	// 12 bit string, its backlen takes 2 bytes
+	data = append(data, 0xe0, byte(len(long)))
+	data = append(data, long...)
+	data = append(data, 0x01, 0xca, 0xff)
+
+	got, err := decodeListpack(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"7", "ok", "-1", "-32768", string(long)}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestBacklenSize(t *testing.T) {
+	tests := []struct {
+		length int
+		want   int
+	}{
+		{1, 1},
+		{127, 1},
+		{128, 2},
+		{16382, 2},
+		{16383, 3},
+		{2097150, 3},
+		{2097151, 4},
+		{268435454, 4},
+		{268435455, 5},
+	}
+	for _, test := range tests {
+		if got := backlenSize(test.length); got != test.want {
+			t.Errorf("backlenSize(%d) = %d, want %d", test.length, got, test.want)
+		}
+	}
+}
+
+func TestDecodeIntset(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want []string
+	}{
+		{
+			name: "16 bit",
+			data: []byte{0x02, 0, 0, 0, 0x03, 0, 0, 0, 0x01, 0x00, 0x02, 0x00, 0xff, 0xff},
+			want: []string{"1", "2", "-1"},
+		},
+		{
+			name: "64 bit",
+			data: []byte{0x08, 0, 0, 0, 0x01, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x80},
+			want: []string{"-9223372036854775808"},
+		},
+	}
+	for _, test := range tests {
+		got, err := decodeIntset(test.data)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDecodeZipmap(t *testing.T) {
+	// The "foo" => "bar", "hello" => "world" example of zipmap.c
+	data := []byte{0x02, 0x03, 'f', 'o', 'o', 0x03, 0x00, 'b', 'a', 'r',
+		0x05, 'h', 'e', 'l', 'l', 'o', 0x05, 0x00, 'w', 'o', 'r', 'l', 'd', 0xff}
+	got, err := decodeZipmap(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Hash{{Field: "foo", Value: "bar"}, {Field: "hello", Value: "world"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestDecodeCorrupted(t *testing.T) {
+	tests := []struct {
+		name   string
+		decode func([]byte) error
+		data   []byte
+	}{
+		{"ziplist without end", ziplistErr, []byte{0x0f, 0, 0, 0, 0x0c, 0, 0, 0, 0x02, 0, 0x00, 0xf3}},
+		{"ziplist string past the end", ziplistErr, []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x00, 0x80, 0xff, 0xff, 0xff, 0xff, 'a', 0xff}},
+		{"listpack string past the end", listpackErr, []byte{0, 0, 0, 0, 0, 0, 0xf0, 0xff, 0xff, 0xff, 0x7f, 'a'}},
+		{"listpack missing backlen", listpackErr, []byte{0, 0, 0, 0, 0, 0, 0x82, 'o', 'k'}},
+		{"intset negative length", intsetErr, []byte{0x08, 0, 0, 0, 0xff, 0xff, 0xff, 0xff}},
+		{"intset length past the end", intsetErr, []byte{0x02, 0, 0, 0, 0xff, 0xff, 0xff, 0x7f, 0x01, 0x00}},
+		{"intset unknown encoding", intsetErr, []byte{0x03, 0, 0, 0, 0x00, 0, 0, 0}},
+		{"zipmap value past the end", zipmapErr, []byte{0x01, 0x01, 'a', 0xfe, 0xff, 0xff, 0xff, 0xff, 0x00, 'b', 0xff}},
+	}
+	for _, test := range tests {
+		if err := test.decode(test.data); err == nil {
+			t.Errorf("%s: decoded without error", test.name)
+		}
+	}
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	_, err := decodeZiplist([]byte{0x0f, 0, 0})
+	if !errors.Is(err, errTruncated) {
+		t.Errorf("got %v, want %v", err, errTruncated)
+	}
+}
+
+func ziplistErr(data []byte) error {
+	_, err := decodeZiplist(data)
+	return err
+}
+
+func listpackErr(data []byte) error {
+	_, err := decodeListpack(data)
+	return err
+}
+
+func intsetErr(data []byte) error {
+	_, err := decodeIntset(data)
+	return err
+}
+
+func zipmapErr(data []byte) error {
+	_, err := decodeZipmap(data)
+	return err
+}
@@ -0,0 +1,130 @@
+package rdb
+
+import "fmt"
+
+// LZF limits, back references reach 8KB behind and copy up to 264 bytes
+const (
+	lzfMaxLiteral = 1 << 5
+	lzfMaxOffset  = 1 << 13
+	lzfMaxRef     = (1 << 8) + (1 << 3)
+	lzfHashLog    = 14
+	// Shorter strings are never compressed by the writer
+	lzfMinLength = 20
+)
+
+/*
+The compressed data is a sequence of chunks starting with a control byte
+- 000LLLLL: a run of L+1 literal bytes follows
+- LLLOOOOO: a back reference of L+2 bytes, when L is 7 the next byte is added
+to it. The offset is O followed by the next byte, counting back from the end
+of the output minus one
+*/
+func lzfDecompress(data []byte, length int) ([]byte, error) {
+	// No chunk produces more than lzfMaxRef bytes per byte of input, a larger
+	// length can only come from a corrupted file
+	if length < 0 || length > len(data)*lzfMaxRef {
+		return nil, fmt.Errorf("LZF uncompressed length %d is impossible for %d compressed bytes", length, len(data))
+	}
+	out := make([]byte, 0, length)
+	for i := 0; i < len(data); {
+		ctrl := int(data[i])
+		i++
+
+		if ctrl < lzfMaxLiteral {
+			run := ctrl + 1
+			if i+run > len(data) {
+				return nil, fmt.Errorf("LZF literal run past the end of the input")
+			}
+			out = append(out, data[i:i+run]...)
+			i += run
+			continue
+		}
+
+		run := ctrl >> 5
+		if run == 7 {
+			if i >= len(data) {
+				return nil, fmt.Errorf("LZF back reference past the end of the input")
+			}
+			run += int(data[i])
+			i++
+		}
+		if i >= len(data) {
+			return nil, fmt.Errorf("LZF back reference past the end of the input")
+		}
+		ref := len(out) - (ctrl&0x1F)<<8 - int(data[i]) - 1
+		i++
+		if ref < 0 {
+			return nil, fmt.Errorf("LZF back reference before the start of the output")
+		}
+
+		// The reference may overlap the bytes being written, copy one at a time
+		for j := 0; j < run+2; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+
+	if len(out) != length {
+		return nil, fmt.Errorf("LZF data decompressed to %d bytes instead of %d", len(out), length)
+	}
+	return out, nil
+}
+
+// lzfCompress is the reverse of lzfDecompress, repeated sequences of 3 or
+// more bytes found through a hash of their first bytes become back references
+func lzfCompress(data []byte) []byte {
+	// Positions are stored plus one so zero means empty
+	table := make([]int, 1<<lzfHashLog)
+	out := []byte{0}
+	ctrl, literals := 0, 0
+
+	closeLiterals := func() {
+		if literals == 0 {
+			out = out[:ctrl]
+		} else {
+			out[ctrl] = byte(literals - 1)
+		}
+	}
+
+	for i := 0; i < len(data); {
+		if i+2 < len(data) {
+			value := uint32(data[i])<<16 | uint32(data[i+1])<<8 | uint32(data[i+2])
+			hash := ((value >> (24 - lzfHashLog)) - value*5) & (1<<lzfHashLog - 1)
+			ref := table[hash] - 1
+			table[hash] = i + 1
+
+			offset := i - ref - 1
+			if ref >= 0 && offset < lzfMaxOffset &&
+				data[ref] == data[i] && data[ref+1] == data[i+1] && data[ref+2] == data[i+2] {
+				run := 3
+				for run < lzfMaxRef && i+run < len(data) && data[ref+run] == data[i+run] {
+					run++
+				}
+
+				closeLiterals()
+				if run-2 < 7 {
+					out = append(out, byte((run-2)<<5|offset>>8))
+				} else {
+					out = append(out, byte(7<<5|offset>>8), byte(run-2-7))
+				}
+				out = append(out, byte(offset))
+
+				ctrl, literals = len(out), 0
+				out = append(out, 0)
+				i += run
+				continue
+			}
+		}
+
+		out = append(out, data[i])
+		literals++
+		i++
+		if literals == lzfMaxLiteral {
+			out[ctrl] = byte(literals - 1)
+			ctrl, literals = len(out), 0
+			out = append(out, 0)
+		}
+	}
+
+	closeLiterals()
+	return out
+}
@@ -0,0 +1,66 @@
+package rdb
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestLZFDecompress(t *testing.T) {
+	tests := []struct {
+		name       string
+		compressed []byte
+		want       string
+	}{
+		{"literal run", []byte{0x02, 'a', 'b', 'c'}, "abc"},
+		// A back reference overlapping the bytes it copies
+		{"repeated byte", []byte{0x00, 'a', 0xe0, 0x03, 0x00}, "aaaaaaaaaaaaa"},
+		{"short back reference", []byte{0x02, 'a', 'b', 'c', 0x20, 0x02, 0x00, 'd'}, "abcabcd"},
+	}
+	for _, test := range tests {
+		got, err := lzfDecompress(test.compressed, len(test.want))
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if string(got) != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestLZFRoundTrip(t *testing.T) {
+	inputs := [][]byte{
+		[]byte("hello hello hello hello hello"),
+		bytes.Repeat([]byte{0}, 100000),
+		bytes.Repeat([]byte("0123456789abcdefghijklmnopqrstuvwxyz"), 500),
+	}
+	for _, input := range inputs {
+		compressed := lzfCompress(input)
+		got, err := lzfDecompress(compressed, len(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, input) {
+			t.Errorf("round trip of %d bytes changed the data", len(input))
+		}
+	}
+}
+
+func TestLZFCorrupted(t *testing.T) {
+	tests := []struct {
+		name       string
+		compressed []byte
+		length     int
+	}{
+		{"literal past the end", []byte{0x05, 'a'}, 6},
+		{"reference before the start", []byte{0x00, 'a', 0x20, 0x05}, 4},
+		{"reference without offset", []byte{0x00, 'a', 0x20}, 4},
+		{"wrong length", []byte{0x02, 'a', 'b', 'c'}, 4},
+		{"negative length", []byte{0x02, 'a', 'b', 'c'}, -1},
+		{"impossible length", []byte{0x00, 'a', 0xe0, 0xff, 0x00}, 1 << 40},
+	}
+	for _, test := range tests {
+		if _, err := lzfDecompress(test.compressed, test.length); err == nil {
+			t.Errorf("%s: decompressed without error", test.name)
+		}
+	}
+}
@@ -3,32 +3,176 @@ package rdb
 import (
 	"bufio"
 	"encoding/binary"
-	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
-	"os"
+	"io"
+	"math"
+	"slices"
+	"strconv"
 )
 
+// Collections and strings are allocated at most this large ahead of their
+// content when the size of the input is unknown, so a corrupted length
+// fails on the missing bytes instead of allocating them
+const preallocLimit = 1 << 16
+
+// ErrChecksum is returned when the CRC64 footer doesn't match the file content
+var ErrChecksum = errors.New("RDB checksum mismatch")
+
+// FormatError reports a corrupted or unsupported RDB file and where the problem was found
+type FormatError struct {
+	Offset int64
+	Err    error
+}
+
+func (e *FormatError) Error() string {
+	return fmt.Sprintf("invalid RDB file at offset %d: %s", e.Offset, e.Err.Error())
+}
+
+func (e *FormatError) Unwrap() error {
+	return e.Err
+}
+
+type RecordType int
+
 const (
-	rdbFile        = "rdb/data.txt"
-	rdbExtension   = ".rdb"
-	maxBytesToRead = 1024
+	RecordAux RecordType = iota
+	RecordResizeDB
+	RecordEntry
+	RecordFunction
+	RecordModuleAux
 )
 
-// Function to pass `Empty RDB Transfer` stage probably can be removed latter
-func GetEmptyRDBContent() ([]byte, error) {
-	content, err := os.ReadFile(rdbFile)
+// Record is one element of the file, only the field matching Type is set
+type Record struct {
+	Type   RecordType
+	Aux    AuxField
+	Resize ResizeDB
+	Entry  Entry
+	// Code of a function library
+	Function string
+	// Name of the module that stored the aux data, which is skipped
+	Module string
+}
+
+// ResizeDB holds the sizes announced for the current database
+type ResizeDB struct {
+	DB      int
+	Keys    int
+	Expires int
+}
+
+// Reader decodes a RDB file record by record, independently of the storage.
+// It keeps the CRC64 of the bytes read to verify the footer
+type Reader struct {
+	r      *bufio.Reader
+	crc    uint64
+	offset int64
+	// Size of the input, -1 when it can't be known in advance
+	size int64
+	// When set, the bytes read are also kept here, used to carry streams as is
+	capture []byte
+	// Version of the file, read by ReadHeader
+	Version  int
+	Checksum uint64
+	db       int
+	done     bool
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r), size: inputSize(r)}
+}
+
+// Files and in memory payloads tell their size, which bounds the lengths
+// found in them
+func inputSize(r io.Reader) int64 {
+	seeker, ok := r.(io.Seeker)
+	if !ok {
+		return -1
+	}
+	current, err := seeker.Seek(0, io.SeekCurrent)
 	if err != nil {
-		return nil, err
+		return -1
+	}
+	end, err := seeker.Seek(0, io.SeekEnd)
+	if err != nil {
+		return -1
 	}
+	if _, err := seeker.Seek(current, io.SeekStart); err != nil {
+		return -1
+	}
+	return end - current
+}
+
+// Offset is the number of bytes consumed so far
+func (r *Reader) Offset() int64 {
+	return r.offset
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	n, err := io.ReadFull(r.r, p)
+	r.consumed(p[:n])
+	return n, err
+}
 
-	result := make([]byte, hex.DecodedLen(len(content)))
-	_, err = hex.Decode(result, content)
+func (r *Reader) ReadByte() (byte, error) {
+	b, err := r.r.ReadByte()
 	if err != nil {
-		return nil, err
+		return 0, err
+	}
+	r.consumed([]byte{b})
+	return b, nil
+}
+
+func (r *Reader) consumed(data []byte) {
+	r.crc = CRC64(r.crc, data)
+	r.offset += int64(len(data))
+	if r.capture != nil {
+		r.capture = append(r.capture, data...)
 	}
+}
+
+// Bytes left in the input, or preallocLimit when its size is unknown
+func (r *Reader) remaining() int64 {
+	if r.size < 0 {
+		return preallocLimit
+	}
+	return r.size - r.offset
+}
+
+// Rejects the lengths no valid file holds: negative ones, and ones larger
+// than the bytes left since every byte or element takes at least a byte.
+// The error points at start, where the length was read
+func (r *Reader) checkLength(start int64, length int) error {
+	if length < 0 {
+		return r.formatErrorAt(start, fmt.Errorf("invalid length %d", length))
+	}
+	if r.size >= 0 && int64(length) > r.remaining() {
+		return r.formatErrorAt(start, fmt.Errorf("length %d exceeds the %d bytes left", length, r.remaining()))
+	}
+	return nil
+}
+
+// Capacity to allocate for length bytes or elements, once checked
+func (r *Reader) capacity(length int) int {
+	return int(min(int64(length), max(r.remaining(), 0)))
+}
 
-	return result, nil
+func (r *Reader) readN(n int) ([]byte, error) {
+	if err := r.checkLength(r.offset, n); err != nil {
+		return nil, err
+	}
+	// The buffer grows with the bytes actually read
+	buf := make([]byte, 0, r.capacity(n))
+	for len(buf) < n {
+		start := len(buf)
+		buf = slices.Grow(buf, min(n-start, preallocLimit))
+		buf = buf[:start+min(n-start, preallocLimit)]
+		if _, err := r.Read(buf[start:]); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
 }
 
 /*
@@ -36,82 +180,203 @@ The file header consists of two parts: the Magic Number and the version number
 - RDB files start with the ASCII-encoded 'REDIS' as the File Magic Number to represent their file type
 - The next 4 bytes represent the version number of the RDB file
 */
-func CheckMagicNumber(reader *bufio.Reader) error {
+func (r *Reader) ReadHeader() error {
 	// 52 45 44 49 53              # Magic String "REDIS"
-	magicNumber, err := reader.Peek(5)
+	magicNumber, err := r.readN(len(MAGIC_NUMBER))
 	if err != nil {
-		return err
+		return r.formatError(err)
 	}
 	if string(magicNumber) != MAGIC_NUMBER {
-		return fmt.Errorf("invalid RDB file")
-	}
-
-	_, err = reader.Discard(5)
-	if err != nil {
-		return err
+		return r.formatErrorAt(0, fmt.Errorf("missing the %s magic number", MAGIC_NUMBER))
 	}
 
 	// The next 4 bytes are the RDB Version Number
 	// 30 30 30 33                 # RDB Version Number as ASCII string. "0003" = 3
-	_, err = reader.Discard(4)
+	version, err := r.readN(4)
 	if err != nil {
-		return err
+		return r.formatError(err)
+	}
+	r.Version, err = strconv.Atoi(string(version))
+	if err != nil {
+		return r.formatErrorAt(int64(len(MAGIC_NUMBER)), fmt.Errorf("invalid version number %q", version))
+	}
+	if err := checkVersion(r.Version); err != nil {
+		return r.formatErrorAt(int64(len(MAGIC_NUMBER)), err)
 	}
 	return nil
 }
 
-func SkipMetadata(reader *bufio.Reader) error {
-	currentBytesRead := 0
-	// skip to 0xFE opcode
+// Next returns the next record of the file, or io.EOF once the end of file
+// opcode and the checksum were read
+func (r *Reader) Next() (*Record, error) {
+	if r.done {
+		return nil, io.EOF
+	}
+
+	var expireAt int64
 	for {
-		opcode, err := reader.ReadByte()
+		start := r.offset
+		opcode, err := r.ReadByte()
 		if err != nil {
-			return err
-		}
-		currentBytesRead++
-
-		if opcode == DATABASE_SELECT_OPCODE {
-			return nil
+			return nil, r.formatError(err)
 		}
-		if currentBytesRead >= maxBytesToRead {
-			return fmt.Errorf("invalid RDB file format")
+		if err := checkOpcode(r.Version, opcode); err != nil {
+			return nil, r.formatErrorAt(start, err)
 		}
-		if opcode == END_OPCODE {
-			return fmt.Errorf("invalid RDB file format")
+
+		switch opcode {
+		case END_OPCODE:
+			return nil, r.readChecksum()
+
+		case OPCODE_AUX:
+			// FA <key> <value>
+			key, err := r.ReadString()
+			if err != nil {
+				return nil, r.formatError(err)
+			}
+			value, err := r.ReadString()
+			if err != nil {
+				return nil, r.formatError(err)
+			}
+			return &Record{Type: RecordAux, Aux: AuxField{Key: key, Value: value}}, nil
+
+		case OPCODE_SELECTDB:
+			// FE <database-id>             # Select the database to associate the following keys with.
+			db, err := r.ReadLength()
+			if err != nil {
+				return nil, r.formatError(err)
+			}
+			r.db = db
+
+		case OPCODE_RESIZEDB:
+			// FB <length> <length>         # Resize database
+			keys, err := r.ReadLength()
+			if err != nil {
+				return nil, r.formatError(err)
+			}
+			expires, err := r.ReadLength()
+			if err != nil {
+				return nil, r.formatError(err)
+			}
+			return &Record{Type: RecordResizeDB, Resize: ResizeDB{DB: r.db, Keys: keys, Expires: expires}}, nil
+
+		case OPCODE_EXPIRETIME_MS:
+			// FC <8 bytes unix time in ms, little endian>
+			buf, err := r.readN(8)
+			if err != nil {
+				return nil, r.formatError(err)
+			}
+			expireAt = int64(binary.LittleEndian.Uint64(buf))
+
+		case OPCODE_EXPIRETIME:
+			// FD <4 bytes unix time in seconds, little endian>
+			buf, err := r.readN(4)
+			if err != nil {
+				return nil, r.formatError(err)
+			}
+			expireAt = int64(binary.LittleEndian.Uint32(buf)) * 1000
+
+		case OPCODE_IDLE:
+			// LRU idle time of the next key, unused without eviction
+			if _, err := r.ReadLength(); err != nil {
+				return nil, r.formatError(err)
+			}
+
+		case OPCODE_FREQ:
+			// LFU frequency of the next key, unused without eviction
+			if _, err := r.ReadByte(); err != nil {
+				return nil, r.formatError(err)
+			}
+
+		case OPCODE_SLOT_INFO:
+			// Slot id, slot size and expires slot size, only a hint for cluster mode
+			for i := 0; i < 3; i++ {
+				if _, err := r.ReadLength(); err != nil {
+					return nil, r.formatError(err)
+				}
+			}
+
+		case OPCODE_MODULE_AUX:
+			module, err := r.skipModuleAux()
+			if err != nil {
+				return nil, r.formatError(err)
+			}
+			return &Record{Type: RecordModuleAux, Module: module}, nil
+
+		case OPCODE_FUNCTION2:
+			code, err := r.ReadString()
+			if err != nil {
+				return nil, r.formatError(err)
+			}
+			return &Record{Type: RecordFunction, Function: code}, nil
+
+		case OPCODE_FUNCTION_PRE_GA:
+			code, err := r.readPreGAFunction()
+			if err != nil {
+				return nil, r.formatError(err)
+			}
+			return &Record{Type: RecordFunction, Function: code}, nil
+
+		default:
+			key, err := r.ReadString()
+			if err != nil {
+				return nil, r.formatError(err)
+			}
+			value, err := r.ReadValue(opcode)
+			if err != nil {
+				return nil, r.formatError(r.encodingError(start, err))
+			}
+			return &Record{
+				Type:  RecordEntry,
+				Entry: Entry{DB: r.db, Key: key, Value: value, ExpireAt: expireAt},
+			}, nil
 		}
 	}
 }
 
-func ReadSelectDB(reader *bufio.Reader) error {
-	// FE <database-id>             # Select the database to associate the following keys with.
-	_, err := reader.ReadByte()
+// The CRC64 of the whole file follows the end of file opcode since
+// version 5, a zero checksum means the file was saved with checksums disabled
+func (r *Reader) readChecksum() error {
+	if r.Version < RDB_CHECKSUM_VERSION {
+		r.done = true
+		return io.EOF
+	}
+	expected, offset := r.crc, r.offset
+	buf, err := r.readN(8)
 	if err != nil {
-		return err
+		return r.formatError(err)
 	}
+	r.done = true
 
-	_, err = reader.ReadByte()
-	if err != nil {
+	r.Checksum = binary.LittleEndian.Uint64(buf)
+	if r.Checksum != 0 && r.Checksum != expected {
+		return r.formatErrorAt(offset, ErrChecksum)
+	}
+	return io.EOF
+}
+
+// Invalid encodings and values point at start, where they begin, while the
+// end of the input is reported where it was reached
+func (r *Reader) encodingError(start int64, err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
 		return err
 	}
+	return r.formatErrorAt(start, err)
+}
 
-	return nil
+func (r *Reader) formatError(err error) error {
+	return r.formatErrorAt(r.offset, err)
 }
 
-func ReadResizeDB(reader *bufio.Reader) error {
-	// FB <length> <length>         # Resize database
-	// Number of keys in the database (Length Encoding)
-	numOfKeys, err := LengthEncodedInt(reader)
-	if err != nil {
-		return err
+func (r *Reader) formatErrorAt(offset int64, err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
 	}
-	log.Println("Number of Keys in the Database: ", numOfKeys)
-	// Number of keys with an expire time set
-	numOfKeysWithExpireTime, err := LengthEncodedInt(reader)
-	if err != nil {
+	var formatErr *FormatError
+	if errors.As(err, &formatErr) {
 		return err
 	}
-	log.Println("Number of Keys with an Expire Time Set: ", numOfKeysWithExpireTime)
-	return nil
+	return &FormatError{Offset: offset, Err: err}
 }
 
 /*
@@ -121,60 +386,586 @@ Bits	How to parse
 10	Discard the remaining 6 bits. The next 4 bytes from the stream represent the length
 11	The next object is encoded in a special format. The remaining 6 bits indicate the format. May be used to store numbers or Strings, see String Encoding
 */
-func LengthEncodedInt(reader *bufio.Reader) (int, error) {
+func LengthEncodedInt(reader io.ByteReader) (int, bool, error) {
 	opcode, err := reader.ReadByte()
 	if err != nil {
-		return -1, err
+		return -1, false, err
 	}
 	// Represented the opcode in little endian -- 2 most significant bits
 	switch opcode >> 6 {
 	case ENC_INT8:
 		// It's 00, so read the next 6 bits
-		return int(binary.LittleEndian.Uint16([]byte{opcode, 00})), nil
+		return int(opcode & 0x3F), false, nil
 	case ENC_INT16:
-		// It's 01, so read one additional byte
+		// It's 01, so read one additional byte, the 14 bits are big endian
 		int16Byte, err := reader.ReadByte()
 		if err != nil {
-			return -1, err
+			return -1, false, err
 		}
-		return int(binary.LittleEndian.Uint16([]byte{opcode & 0x3F, int16Byte})), nil
+		return int(opcode&0x3F)<<8 | int(int16Byte), false, nil
 	case ENC_INT32:
-		// It's 10, so discard the remaining 6 bits
-		int32Bytes, err := reader.Peek(4)
+		// It's 10, 0x80 is followed by a 32 bit and 0x81 by a 64 bit big endian length
+		size := 4
+		if opcode == LEN_64BIT {
+			size = 8
+		} else if opcode != LEN_32BIT {
+			return -1, false, fmt.Errorf("unknown length encoding 0x%x", opcode)
+		}
+		buf, err := readBytes(reader, size)
+		if err != nil {
+			return -1, false, err
+		}
+		if size == 4 {
+			return int(binary.BigEndian.Uint32(buf)), false, nil
+		}
+		return int(binary.BigEndian.Uint64(buf)), false, nil
+	}
+	// It's 11, so the next object is encoded in a special format
+	// The remaining 6 bits indicate the format
+	return int(opcode & 0x3F), true, nil
+}
+
+// ReadLength reads a length, special string formats are an error here
+func (r *Reader) ReadLength() (int, error) {
+	start := r.offset
+	length, special, err := LengthEncodedInt(r)
+	if err != nil {
+		return -1, r.encodingError(start, err)
+	}
+	if special {
+		return -1, r.formatErrorAt(start, fmt.Errorf("unexpected special encoding %d instead of a length", length))
+	}
+	return length, nil
+}
+
+// Reads the length of a string or the number of elements of a collection
+func (r *Reader) readCount() (int, error) {
+	start := r.offset
+	length, err := r.ReadLength()
+	if err != nil {
+		return -1, err
+	}
+	if err := r.checkLength(start, length); err != nil {
+		return -1, err
+	}
+	return length, nil
+}
+
+// ReadString reads a length prefixed string or one stored in a special format
+func (r *Reader) ReadString() (string, error) {
+	data, err := r.ReadBytes()
+	return string(data), err
+}
+
+// ReadBytes is ReadString for binary content like ziplists and listpacks
+func (r *Reader) ReadBytes() ([]byte, error) {
+	start := r.offset
+	length, special, err := LengthEncodedInt(r)
+	if err != nil {
+		return nil, r.encodingError(start, err)
+	}
+	if !special {
+		if err := r.checkLength(start, length); err != nil {
+			return nil, err
+		}
+		return r.readN(length)
+	}
+
+	switch length {
+	case ENC_SPECIAL_INT8:
+		buf, err := r.readN(1)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strconv.Itoa(int(int8(buf[0])))), nil
+	case ENC_SPECIAL_INT16:
+		buf, err := r.readN(2)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strconv.Itoa(int(int16(binary.LittleEndian.Uint16(buf))))), nil
+	case ENC_SPECIAL_INT32:
+		buf, err := r.readN(4)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strconv.Itoa(int(int32(binary.LittleEndian.Uint32(buf))))), nil
+	case ENC_SPECIAL_LZF:
+		// <compressed length> <uncompressed length> <compressed data>
+		compressedLength, err := r.readCount()
+		if err != nil {
+			return nil, err
+		}
+		length, err := r.ReadLength()
+		if err != nil {
+			return nil, err
+		}
+		compressed, err := r.readN(compressedLength)
+		if err != nil {
+			return nil, err
+		}
+		data, err := lzfDecompress(compressed, length)
+		if err != nil {
+			return nil, r.formatErrorAt(start, err)
+		}
+		return data, nil
+	}
+	return nil, r.formatErrorAt(start, fmt.Errorf("unknown string encoding %d", length))
+}
+
+func (r *Reader) readStrings() ([]string, error) {
+	length, err := r.readCount()
+	if err != nil {
+		return nil, err
+	}
+	values := make([]string, 0, r.capacity(length))
+	for i := 0; i < length; i++ {
+		value, err := r.ReadString()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// ReadValue reads a value of the given type, turning every compact encoding
+// into the plain value kinds
+func (r *Reader) ReadValue(valueType byte) (Value, error) {
+	switch valueType {
+	case TYPE_STRING:
+		value, err := r.ReadString()
+		return String(value), err
+
+	case TYPE_LIST:
+		values, err := r.readStrings()
+		return List(values), err
+
+	case TYPE_SET:
+		values, err := r.readStrings()
+		return Set(values), err
+
+	case TYPE_ZSET, TYPE_ZSET_2:
+		return r.readZSet(valueType == TYPE_ZSET_2)
+
+	case TYPE_HASH:
+		// The length is the number of field value pairs
+		length, err := r.readCount()
 		if err != nil {
-			return -1, err
+			return nil, err
 		}
-		_, err = reader.Discard(4)
+		hash := make(Hash, 0, r.capacity(length))
+		for i := 0; i < length; i++ {
+			field, err := r.ReadString()
+			if err != nil {
+				return nil, err
+			}
+			value, err := r.ReadString()
+			if err != nil {
+				return nil, err
+			}
+			hash = append(hash, HashField{Field: field, Value: value})
+		}
+		return hash, nil
+
+	case TYPE_MODULE_PRE_GA, TYPE_MODULE_2:
+		return nil, fmt.Errorf("module values are not supported")
+
+	case TYPE_HASH_METADATA_PRE_GA, TYPE_HASH_LISTPACK_EX_PRE_GA, TYPE_HASH_METADATA, TYPE_HASH_LISTPACK_EX:
+		return nil, fmt.Errorf("hashes with fields expiration are not supported")
+
+	case TYPE_HASH_ZIPMAP:
+		return r.readEncoded(decodeZipmap)
+
+	case TYPE_LIST_ZIPLIST:
+		return r.readEncoded(func(data []byte) (Value, error) {
+			values, err := decodeZiplist(data)
+			return List(values), err
+		})
+
+	case TYPE_SET_INTSET:
+		return r.readEncoded(func(data []byte) (Value, error) {
+			values, err := decodeIntset(data)
+			return Set(values), err
+		})
+
+	case TYPE_SET_LISTPACK:
+		return r.readEncoded(func(data []byte) (Value, error) {
+			values, err := decodeListpack(data)
+			return Set(values), err
+		})
+
+	case TYPE_ZSET_ZIPLIST:
+		return r.readEncoded(func(data []byte) (Value, error) {
+			values, err := decodeZiplist(data)
+			if err != nil {
+				return nil, err
+			}
+			return pairsToZSet(values)
+		})
+
+	case TYPE_ZSET_LISTPACK:
+		return r.readEncoded(func(data []byte) (Value, error) {
+			values, err := decodeListpack(data)
+			if err != nil {
+				return nil, err
+			}
+			return pairsToZSet(values)
+		})
+
+	case TYPE_HASH_ZIPLIST:
+		return r.readEncoded(func(data []byte) (Value, error) {
+			values, err := decodeZiplist(data)
+			if err != nil {
+				return nil, err
+			}
+			return pairsToHash(values)
+		})
+
+	case TYPE_HASH_LISTPACK:
+		return r.readEncoded(func(data []byte) (Value, error) {
+			values, err := decodeListpack(data)
+			if err != nil {
+				return nil, err
+			}
+			return pairsToHash(values)
+		})
+
+	case TYPE_LIST_QUICKLIST:
+		return r.readQuicklist(false)
+
+	case TYPE_LIST_QUICKLIST_2:
+		return r.readQuicklist(true)
+
+	case TYPE_STREAM_LISTPACKS, TYPE_STREAM_LISTPACKS_2, TYPE_STREAM_LISTPACKS_3:
+		return r.readStream(valueType)
+	}
+	return nil, fmt.Errorf("unknown value type %d", valueType)
+}
+
+// Reads a string holding a ziplist, listpack, intset or zipmap and decodes it,
+// errors point at the start of the string
+func (r *Reader) readEncoded(decode func([]byte) (Value, error)) (Value, error) {
+	start := r.offset
+	data, err := r.ReadBytes()
+	if err != nil {
+		return nil, err
+	}
+	value, err := decode(data)
+	if err != nil {
+		return nil, r.formatErrorAt(start, err)
+	}
+	return value, nil
+}
+
+func (r *Reader) readZSet(binaryScores bool) (Value, error) {
+	length, err := r.readCount()
+	if err != nil {
+		return nil, err
+	}
+
+	zset := make(ZSet, 0, r.capacity(length))
+	for i := 0; i < length; i++ {
+		member, err := r.ReadString()
 		if err != nil {
-			return -1, err
+			return nil, err
 		}
-		return int(binary.LittleEndian.Uint32([]byte{opcode & 0x3F, int32Bytes[0], int32Bytes[1], int32Bytes[2], int32Bytes[3]})), nil
-	case ENC_LZF:
-		// It's 11, so the next object is encoded in a special format
-		// The remaining 6 bits indicate the format
-		switch opcode & 0x3F {
-		case 0:
-			buf := make([]byte, 1)
-			_, err := reader.Read(buf)
+
+		var score float64
+		if binaryScores {
+			buf, err := r.readN(8)
 			if err != nil {
-				return -1, err
+				return nil, err
 			}
-			return int(binary.LittleEndian.Uint16([]byte{buf[0], 00})), nil
-		case 1:
-			buf := make([]byte, 2)
-			_, err := reader.Read(buf)
+			score = math.Float64frombits(binary.LittleEndian.Uint64(buf))
+		} else {
+			score, err = r.readStringDouble()
 			if err != nil {
-				return -1, err
+				return nil, err
+			}
+		}
+		zset = append(zset, ZMember{Member: member, Score: score})
+	}
+	return zset, nil
+}
+
+// Old zsets store scores as a length byte followed by the number as text,
+// with 253, 254 and 255 standing for NaN, +inf and -inf
+func (r *Reader) readStringDouble() (float64, error) {
+	length, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	switch length {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	buf, err := r.readN(int(length))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(string(buf), 64)
+}
+
+// Quicklists are a list of ziplists, version 2 nodes are either listpacks
+// or single plain elements
+func (r *Reader) readQuicklist(version2 bool) (Value, error) {
+	nodes, err := r.readCount()
+	if err != nil {
+		return nil, err
+	}
+
+	list := List{}
+	for i := 0; i < nodes; i++ {
+		container := QUICKLIST_NODE_PACKED
+		if version2 {
+			if container, err = r.ReadLength(); err != nil {
+				return nil, err
+			}
+		}
+
+		start := r.offset
+		data, err := r.ReadBytes()
+		if err != nil {
+			return nil, err
+		}
+
+		var values []string
+		switch {
+		case container == QUICKLIST_NODE_PLAIN:
+			values = []string{string(data)}
+		case version2:
+			values, err = decodeListpack(data)
+		default:
+			values, err = decodeZiplist(data)
+		}
+		if err != nil {
+			return nil, r.formatErrorAt(start, err)
+		}
+		list = append(list, values...)
+	}
+	return list, nil
+}
+
+// Streams are not decoded, the serialized value is kept as found so it can
+// be written back. The structure still has to be walked to find its end
+func (r *Reader) readStream(valueType byte) (Value, error) {
+	r.capture = []byte{}
+	defer func() { r.capture = nil }()
+
+	if err := r.skipStream(valueType); err != nil {
+		return nil, err
+	}
+	return Stream{Type: valueType, Payload: r.capture}, nil
+}
+
+func (r *Reader) skipStream(valueType byte) error {
+	// Listpacks with the entries, each one preceded by its master ID
+	listpacks, err := r.readCount()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < listpacks; i++ {
+		if _, err := r.ReadBytes(); err != nil {
+			return err
+		}
+		if _, err := r.ReadBytes(); err != nil {
+			return err
+		}
+	}
+
+	// Number of entries and last ID
+	if err := r.skipLengths(3); err != nil {
+		return err
+	}
+	if valueType >= TYPE_STREAM_LISTPACKS_2 {
+		// First ID, max deleted entry ID and entries added
+		if err := r.skipLengths(5); err != nil {
+			return err
+		}
+	}
+
+	groups, err := r.readCount()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < groups; i++ {
+		// Name and last delivered ID
+		if _, err := r.ReadBytes(); err != nil {
+			return err
+		}
+		if err := r.skipLengths(2); err != nil {
+			return err
+		}
+		if valueType >= TYPE_STREAM_LISTPACKS_2 {
+			// Entries read
+			if err := r.skipLengths(1); err != nil {
+				return err
 			}
-			return int(binary.LittleEndian.Uint16(buf)), nil
-		case 2:
-			buf := make([]byte, 4)
-			_, err := reader.Read(buf)
+		}
+
+		// Pending entries list: raw ID, delivery time and delivery count
+		pending, err := r.readCount()
+		if err != nil {
+			return err
+		}
+		for j := 0; j < pending; j++ {
+			if _, err := r.readN(16 + 8); err != nil {
+				return err
+			}
+			if err := r.skipLengths(1); err != nil {
+				return err
+			}
+		}
+
+		consumers, err := r.readCount()
+		if err != nil {
+			return err
+		}
+		for j := 0; j < consumers; j++ {
+			// Name, seen time and, since version 3, active time
+			if _, err := r.ReadBytes(); err != nil {
+				return err
+			}
+			times := 8
+			if valueType >= TYPE_STREAM_LISTPACKS_3 {
+				times = 16
+			}
+			if _, err := r.readN(times); err != nil {
+				return err
+			}
+
+			// Raw IDs of the pending entries of the consumer
+			consumerPending, err := r.readCount()
 			if err != nil {
-				return -1, err
+				return err
 			}
-			return int(binary.LittleEndian.Uint32(buf)), nil
+			if _, err := r.readN(16 * consumerPending); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *Reader) skipLengths(count int) error {
+	for i := 0; i < count; i++ {
+		if _, err := r.ReadLength(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Module aux data is `<module id> <when opcode> <when>` followed by values
+// tagged with their type until the EOF tag
+func (r *Reader) skipModuleAux() (string, error) {
+	moduleID, _, err := LengthEncodedInt(r)
+	if err != nil {
+		return "", err
+	}
+	if _, err := r.ReadLength(); err != nil {
+		return "", err
+	}
+	if _, err := r.ReadLength(); err != nil {
+		return "", err
+	}
+
+	for {
+		opcode, err := r.ReadLength()
+		if err != nil {
+			return "", err
+		}
+		switch opcode {
+		case MODULE_OPCODE_EOF:
+			return moduleName(uint64(moduleID)), nil
+		case MODULE_OPCODE_SINT, MODULE_OPCODE_UINT:
+			_, err = r.ReadLength()
+		case MODULE_OPCODE_FLOAT:
+			_, err = r.readN(4)
+		case MODULE_OPCODE_DOUBLE:
+			_, err = r.readN(8)
+		case MODULE_OPCODE_STRING:
+			_, err = r.ReadBytes()
+		default:
+			err = fmt.Errorf("unknown module opcode %d", opcode)
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+// Module IDs hold the 9 characters of the module name in 6 bit groups,
+// followed by 10 bits of encoding version
+func moduleName(moduleID uint64) string {
+	const charset = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+	name := make([]byte, 9)
+	for i := 8; i >= 0; i-- {
+		name[8-i] = charset[(moduleID>>(10+6*i))&0x3F]
+	}
+	return string(name)
+}
+
+// Functions saved by Redis 7.0 release candidates: name, engine,
+// an optional description and the code
+func (r *Reader) readPreGAFunction() (string, error) {
+	if _, err := r.ReadString(); err != nil {
+		return "", err
+	}
+	if _, err := r.ReadString(); err != nil {
+		return "", err
+	}
+	hasDescription, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	if hasDescription != 0 {
+		if _, err := r.ReadString(); err != nil {
+			return "", err
+		}
+	}
+	return r.ReadString()
+}
+
+func pairsToHash(values []string) (Value, error) {
+	if len(values)%2 != 0 {
+		return nil, fmt.Errorf("hash with an odd number of elements")
+	}
+	hash := make(Hash, 0, len(values)/2)
+	for i := 0; i < len(values); i += 2 {
+		hash = append(hash, HashField{Field: values[i], Value: values[i+1]})
+	}
+	return hash, nil
+}
+
+func pairsToZSet(values []string) (Value, error) {
+	if len(values)%2 != 0 {
+		return nil, fmt.Errorf("sorted set with an odd number of elements")
+	}
+	zset := make(ZSet, 0, len(values)/2)
+	for i := 0; i < len(values); i += 2 {
+		score, err := strconv.ParseFloat(values[i+1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sorted set score %q", values[i+1])
+		}
+		zset = append(zset, ZMember{Member: values[i], Score: score})
+	}
+	return zset, nil
+}
+
+func readBytes(reader io.ByteReader, n int) ([]byte, error) {
+	buf := make([]byte, n)
+	for i := range buf {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
 		}
+		buf[i] = b
 	}
-	return -1, nil
+	return buf, nil
 }
@@ -0,0 +1,121 @@
+package rdb
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestCRC64(t *testing.T) {
+	// Check value of the Redis crc64 test
+	if got := CRC64(0, []byte("123456789")); got != 0xe9c6d914c4b8d9ca {
+		t.Errorf("got %x, want e9c6d914c4b8d9ca", got)
+	}
+}
+
+func TestSaveAndRead(t *testing.T) {
+	entries := []Entry{
+		{Key: "string", Value: String("value")},
+		{Key: "number", Value: String("-1234"), ExpireAt: 1700000000000},
+		{Key: "long", Value: String(bytes.Repeat([]byte("abcd"), 100))},
+		{Key: "list", Value: List{"a", "b", "c"}},
+		{Key: "set", Value: Set{"x", "y"}},
+		{Key: "zset", Value: ZSet{{Member: "m", Score: 1.5}}},
+		{Key: "hash", Value: Hash{{Field: "f", Value: "v"}}},
+	}
+	file := &bytes.Buffer{}
+	if err := Save(file, []AuxField{{Key: "redis-ver", Value: "7.2.0"}}, entries); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := NewReader(bytes.NewReader(file.Bytes()))
+	if err := reader.ReadHeader(); err != nil {
+		t.Fatal(err)
+	}
+	got := []Entry{}
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record.Type == RecordEntry {
+			got = append(got, record.Entry)
+		}
+	}
+	if !reflect.DeepEqual(got, entries) {
+		t.Errorf("got %v, want %v", got, entries)
+	}
+	if reader.Checksum != CRC64(0, file.Bytes()[:file.Len()-8]) {
+		t.Errorf("checksum %x doesn't match the file", reader.Checksum)
+	}
+}
+
+func TestReadChecksumMismatch(t *testing.T) {
+	file := &bytes.Buffer{}
+	if err := Save(file, nil, []Entry{{Key: "k", Value: String("v")}}); err != nil {
+		t.Fatal(err)
+	}
+	data := file.Bytes()
+	data[len(data)-1] ^= 0xff
+
+	err := readAll(bytes.NewReader(data))
+	if !errors.Is(err, ErrChecksum) {
+		t.Errorf("got %v, want %v", err, ErrChecksum)
+	}
+}
+
+func TestReadWithoutChecksum(t *testing.T) {
+	data := []byte("REDIS0004\xfe\x00\x00\x01k\x01v\xff")
+	if err := readAll(bytes.NewReader(data)); err != nil {
+		t.Errorf("got %v, want no error", err)
+	}
+}
+
+// Corrupted lengths are rejected before anything is allocated for them,
+// whether the size of the input is known or not
+func TestReadImpossibleLengths(t *testing.T) {
+	huge := []byte{0x81, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	negative := []byte{0x81, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	tests := []struct {
+		name  string
+		entry []byte
+	}{
+		{"list length", append([]byte{TYPE_LIST, 0x01, 'k'}, huge...)},
+		{"negative list length", append([]byte{TYPE_LIST, 0x01, 'k'}, negative...)},
+		{"string length", append([]byte{TYPE_STRING, 0x01, 'k'}, huge...)},
+		{"hash length", append([]byte{TYPE_HASH, 0x01, 'k'}, huge...)},
+		{"zset length", append([]byte{TYPE_ZSET_2, 0x01, 'k'}, huge...)},
+		{"quicklist nodes", append([]byte{TYPE_LIST_QUICKLIST_2, 0x01, 'k'}, huge...)},
+		{"stream listpacks", append([]byte{TYPE_STREAM_LISTPACKS_3, 0x01, 'k'}, huge...)},
+		{"lzf length", append(append([]byte{TYPE_STRING, 0x01, 'k', 0xc3, 0x02}, huge...), 0x00, 'a')},
+		{"intset length", []byte{TYPE_SET_INTSET, 0x01, 'k', 0x08, 0x08, 0, 0, 0, 0xff, 0xff, 0xff, 0xff}},
+	}
+	for _, test := range tests {
+		data := append([]byte("REDIS0011"), test.entry...)
+		for _, input := range []io.Reader{bytes.NewReader(data), struct{ io.Reader }{bytes.NewReader(data)}} {
+			var formatErr *FormatError
+			if err := readAll(input); !errors.As(err, &formatErr) {
+				t.Errorf("%s: got %v, want a format error", test.name, err)
+			}
+		}
+	}
+}
+
+func readAll(input io.Reader) error {
+	reader := NewReader(input)
+	if err := reader.ReadHeader(); err != nil {
+		return err
+	}
+	for {
+		if _, err := reader.Next(); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
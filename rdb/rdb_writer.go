@@ -0,0 +1,271 @@
+package rdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// AuxField is a `FA <key> <value>` metadata field like redis-ver or ctime
+type AuxField struct {
+	Key   string
+	Value string
+}
+
+// Writer encodes a RDB file, keeping the CRC64 of everything written so far
+type Writer struct {
+	w   *bufio.Writer
+	crc uint64
+	err error
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+// Save writes a complete RDB file with the given aux fields and entries
+func Save(w io.Writer, aux []AuxField, entries []Entry) error {
+	writer := NewWriter(w)
+	writer.WriteHeader()
+	for _, field := range aux {
+		writer.WriteAux(field.Key, field.Value)
+	}
+
+	byDB := map[int][]Entry{}
+	for _, entry := range entries {
+		byDB[entry.DB] = append(byDB[entry.DB], entry)
+	}
+	dbs := make([]int, 0, len(byDB))
+	for db := range byDB {
+		dbs = append(dbs, db)
+	}
+	sort.Ints(dbs)
+
+	for _, db := range dbs {
+		expires := 0
+		for _, entry := range byDB[db] {
+			if entry.ExpireAt != 0 {
+				expires++
+			}
+		}
+
+		writer.WriteSelectDB(db)
+		writer.WriteResizeDB(len(byDB[db]), expires)
+		for _, entry := range byDB[db] {
+			writer.WriteEntry(entry)
+		}
+	}
+
+	return writer.WriteFooter()
+}
+
+/*
+The file header consists of two parts: the Magic Number and the version number
+- RDB files start with the ASCII-encoded 'REDIS' as the File Magic Number to represent their file type
+- The next 4 bytes represent the version number of the RDB file
+*/
+func (w *Writer) WriteHeader() error {
+	w.write([]byte(fmt.Sprintf("%s%04d", MAGIC_NUMBER, RDB_VERSION)))
+	return w.err
+}
+
+func (w *Writer) WriteAux(key, value string) error {
+	w.write([]byte{OPCODE_AUX})
+	w.writeString(key)
+	w.writeString(value)
+	return w.err
+}
+
+func (w *Writer) WriteSelectDB(db int) error {
+	w.write([]byte{OPCODE_SELECTDB})
+	w.writeLength(uint64(db))
+	return w.err
+}
+
+func (w *Writer) WriteResizeDB(keys, expires int) error {
+	w.write([]byte{OPCODE_RESIZEDB})
+	w.writeLength(uint64(keys))
+	w.writeLength(uint64(expires))
+	return w.err
+}
+
+// WriteEntry writes `[FC <expire ms>] <type> <key> <value>`
+func (w *Writer) WriteEntry(entry Entry) error {
+	if entry.ExpireAt != 0 {
+		expire := make([]byte, 8)
+		binary.LittleEndian.PutUint64(expire, uint64(entry.ExpireAt))
+		w.write([]byte{OPCODE_EXPIRETIME_MS})
+		w.write(expire)
+	}
+
+	w.write([]byte{ValueType(entry.Value)})
+	w.writeString(entry.Key)
+	w.WriteValue(entry.Value)
+	return w.err
+}
+
+// WriteValue writes the value without its type byte
+func (w *Writer) WriteValue(value Value) error {
+	switch v := value.(type) {
+	case String:
+		w.writeString(string(v))
+	case List:
+		w.writeStrings(v)
+	case Set:
+		w.writeStrings(v)
+	case ZSet:
+		w.writeLength(uint64(len(v)))
+		for _, member := range v {
+			w.writeString(member.Member)
+			score := make([]byte, 8)
+			binary.LittleEndian.PutUint64(score, math.Float64bits(member.Score))
+			w.write(score)
+		}
+	case Hash:
+		w.writeLength(uint64(len(v)))
+		for _, field := range v {
+			w.writeString(field.Field)
+			w.writeString(field.Value)
+		}
+	case Stream:
+		w.write(v.Payload)
+	default:
+		w.setErr(fmt.Errorf("unsupported value type %T", value))
+	}
+	return w.err
+}
+
+// WriteFooter writes the end of file opcode followed by the CRC64 checksum
+func (w *Writer) WriteFooter() error {
+	w.write([]byte{END_OPCODE})
+
+	checksum := make([]byte, 8)
+	binary.LittleEndian.PutUint64(checksum, w.crc)
+	w.write(checksum)
+	return w.Flush()
+}
+
+func (w *Writer) Flush() error {
+	if w.err != nil {
+		return w.err
+	}
+	return w.w.Flush()
+}
+
+// Checksum is the CRC64 of the bytes written so far
+func (w *Writer) Checksum() uint64 {
+	return w.crc
+}
+
+// ValueType returns the RDB type byte used to encode value
+func ValueType(value Value) byte {
+	switch v := value.(type) {
+	case List:
+		return TYPE_LIST
+	case Set:
+		return TYPE_SET
+	case ZSet:
+		return TYPE_ZSET_2
+	case Hash:
+		return TYPE_HASH
+	case Stream:
+		return v.Type
+	}
+	return TYPE_STRING
+}
+
+func (w *Writer) write(data []byte) {
+	if w.err != nil {
+		return
+	}
+	w.crc = CRC64(w.crc, data)
+	_, err := w.w.Write(data)
+	w.setErr(err)
+}
+
+func (w *Writer) setErr(err error) {
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+/*
+Bits	Length
+00	The next 6 bits represent the length
+01	Read one additional byte. The combined 14 bits represent the length
+10	Followed by 0x80 and a 32 bit or 0x81 and a 64 bit big endian length
+*/
+func (w *Writer) writeLength(length uint64) {
+	switch {
+	case length < 1<<6:
+		w.write([]byte{byte(length)})
+	case length < 1<<14:
+		w.write([]byte{byte(length>>8) | ENC_INT16<<6, byte(length)})
+	case length <= math.MaxUint32:
+		buf := make([]byte, 5)
+		buf[0] = LEN_32BIT
+		binary.BigEndian.PutUint32(buf[1:], uint32(length))
+		w.write(buf)
+	default:
+		buf := make([]byte, 9)
+		buf[0] = LEN_64BIT
+		binary.BigEndian.PutUint64(buf[1:], length)
+		w.write(buf)
+	}
+}
+
+// Strings holding small integers are stored with the 11 special formats,
+// long ones are LZF compressed when that saves at least 4 bytes
+func (w *Writer) writeString(s string) {
+	if encoded, ok := encodeIntString(s); ok {
+		w.write(encoded)
+		return
+	}
+	if len(s) > lzfMinLength {
+		if compressed := lzfCompress([]byte(s)); len(compressed) <= len(s)-4 {
+			w.write([]byte{ENC_LZF<<6 | ENC_SPECIAL_LZF})
+			w.writeLength(uint64(len(compressed)))
+			w.writeLength(uint64(len(s)))
+			w.write(compressed)
+			return
+		}
+	}
+	w.writeLength(uint64(len(s)))
+	w.write([]byte(s))
+}
+
+func (w *Writer) writeStrings(values []string) {
+	w.writeLength(uint64(len(values)))
+	for _, value := range values {
+		w.writeString(value)
+	}
+}
+
+func encodeIntString(s string) ([]byte, bool) {
+	if len(s) == 0 || len(s) > 11 {
+		return nil, false
+	}
+	value, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || strconv.FormatInt(value, 10) != s {
+		return nil, false
+	}
+
+	special := byte(ENC_LZF << 6)
+	switch {
+	case value >= math.MinInt8 && value <= math.MaxInt8:
+		return []byte{special | ENC_SPECIAL_INT8, byte(value)}, true
+	case value >= math.MinInt16 && value <= math.MaxInt16:
+		buf := []byte{special | ENC_SPECIAL_INT16, 0, 0}
+		binary.LittleEndian.PutUint16(buf[1:], uint16(value))
+		return buf, true
+	case value >= math.MinInt32 && value <= math.MaxInt32:
+		buf := []byte{special | ENC_SPECIAL_INT32, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint32(buf[1:], uint32(value))
+		return buf, true
+	}
+	return nil, false
+}
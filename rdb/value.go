@@ -0,0 +1,50 @@
+package rdb
+
+// Value is one of the value kinds that can be stored in a RDB file:
+// String, List, Set, ZSet, Hash or Stream
+type Value interface {
+	TypeName() string
+}
+
+type String string
+
+type List []string
+
+type Set []string
+
+type ZMember struct {
+	Member string
+	Score  float64
+}
+
+type ZSet []ZMember
+
+type HashField struct {
+	Field string
+	Value string
+}
+
+type Hash []HashField
+
+// Stream keeps the serialized stream as found in the file, the server has no
+// stream commands so it is only carried from one file to another
+type Stream struct {
+	Type    byte
+	Payload []byte
+}
+
+func (String) TypeName() string { return "string" }
+func (List) TypeName() string   { return "list" }
+func (Set) TypeName() string    { return "set" }
+func (ZSet) TypeName() string   { return "zset" }
+func (Hash) TypeName() string   { return "hash" }
+func (Stream) TypeName() string { return "stream" }
+
+// Entry is a key of the dataset with its value.
+// ExpireAt is the expiration in unix milliseconds, 0 when the key doesn't expire
+type Entry struct {
+	DB       int
+	Key      string
+	Value    Value
+	ExpireAt int64
+}
@@ -0,0 +1,67 @@
+package rdb
+
+import "fmt"
+
+// ErrUnsupportedVersion is returned for files written by a newer Redis
+var ErrUnsupportedVersion = fmt.Errorf("unsupported RDB version")
+
+/*
+RDB versions and the Redis releases writing them
+- 5: Redis 2.6, CRC64 checksum after the end of file opcode
+- 7: Redis 3.2, aux fields, resize db and quicklists
+- 8: Redis 4.0, binary zset scores and modules
+- 9: Redis 5.0, streams, LRU/LFU info and module aux data
+- 10: Redis 7.0, listpack encodings and functions
+- 11: Redis 7.2, set listpacks and stream consumers active time
+- 12: Redis 7.4, hash fields expiration
+*/
+
+// Version that introduced each value type, older ones exist since the first version
+var typeVersions = map[byte]int{
+	TYPE_ZSET_2:                  8,
+	TYPE_MODULE_PRE_GA:           8,
+	TYPE_MODULE_2:                8,
+	TYPE_LIST_QUICKLIST:          7,
+	TYPE_STREAM_LISTPACKS:        9,
+	TYPE_HASH_LISTPACK:           10,
+	TYPE_ZSET_LISTPACK:           10,
+	TYPE_LIST_QUICKLIST_2:        10,
+	TYPE_STREAM_LISTPACKS_2:      10,
+	TYPE_SET_LISTPACK:            11,
+	TYPE_STREAM_LISTPACKS_3:      11,
+	TYPE_HASH_METADATA_PRE_GA:    12,
+	TYPE_HASH_LISTPACK_EX_PRE_GA: 12,
+	TYPE_HASH_METADATA:           12,
+	TYPE_HASH_LISTPACK_EX:        12,
+}
+
+// Version that introduced each opcode
+var opcodeVersions = map[byte]int{
+	OPCODE_AUX:             7,
+	OPCODE_RESIZEDB:        7,
+	OPCODE_MODULE_AUX:      9,
+	OPCODE_IDLE:            9,
+	OPCODE_FREQ:            9,
+	OPCODE_FUNCTION_PRE_GA: 10,
+	OPCODE_FUNCTION2:       10,
+	OPCODE_SLOT_INFO:       12,
+}
+
+func checkVersion(version int) error {
+	if version < 1 || version > RDB_MAX_VERSION {
+		return fmt.Errorf("%w %d, versions up to %d can be loaded", ErrUnsupportedVersion, version, RDB_MAX_VERSION)
+	}
+	return nil
+}
+
+// Rejects opcodes and value types that didn't exist yet in the version of
+// the file, they can only come from a corrupted file
+func checkOpcode(version int, opcode byte) error {
+	if minVersion, ok := opcodeVersions[opcode]; ok && version < minVersion {
+		return fmt.Errorf("opcode 0x%x is not valid in RDB version %d", opcode, version)
+	}
+	if minVersion, ok := typeVersions[opcode]; ok && version < minVersion {
+		return fmt.Errorf("value type %d is not valid in RDB version %d", opcode, version)
+	}
+	return nil
+}